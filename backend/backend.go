@@ -6,14 +6,18 @@ package backend
 
 import (
 	"bytes"
+	"context"
 	"io"
-	"log"
 	"net/url"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/chengshiwen/influx-proxy/logging"
+	"github.com/chengshiwen/influx-proxy/tracing"
 	"github.com/panjf2000/ants/v2"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
 )
 
 type CacheBuffer struct {
@@ -103,6 +107,7 @@ func (ib *Backend) WritePoint(point *LinePoint) (err error) {
 		return io.ErrClosedPipe
 	}
 	ib.chWrite <- point
+	backendPoints.WithLabelValues(ib.Name).Inc()
 	return
 }
 
@@ -122,18 +127,18 @@ func (ib *Backend) WriteBuffer(point *LinePoint) (err error) {
 	}
 	n, err := cb.Buffer.Write(line)
 	if err != nil {
-		log.Printf("buffer write error: %s", err)
+		ib.logger().Error("buffer write error", zap.Error(err), logging.DB(db), logging.RP(rp))
 		return
 	}
 	if n != len(line) {
 		err = io.ErrShortWrite
-		log.Printf("buffer write error: %s", err)
+		ib.logger().Error("buffer write error", zap.Error(err), logging.DB(db), logging.RP(rp))
 		return
 	}
 	if line[len(line)-1] != '\n' {
 		err = cb.Buffer.WriteByte('\n')
 		if err != nil {
-			log.Printf("buffer write error: %s", err)
+			ib.logger().Error("buffer write error", zap.Error(err), logging.DB(db), logging.RP(rp))
 			return
 		}
 	}
@@ -162,35 +167,47 @@ func (ib *Backend) FlushBuffer(db, rp string) {
 	ib.wg.Add(1)
 	ib.pool.Submit(func() {
 		defer ib.wg.Done()
+		// batches gather the points of many requests, so each flush is traced on its own
+		ctx, span := tracing.Start(context.Background(), "Backend.FlushBuffer", tracing.Backend(ib.Name), tracing.URL(ib.Url),
+			tracing.DB(db), tracing.RP(rp), attribute.Int("bytes", len(p)))
+		var err error
+		defer func() { tracing.End(span, err) }()
 		var buf bytes.Buffer
-		err := Compress(&buf, p)
+		err = Compress(&buf, p)
 		if err != nil {
-			log.Print("compress buffer error: ", err)
+			ib.logger().Error("compress buffer error", zap.Error(err), logging.DB(db), logging.RP(rp))
 			return
 		}
 
 		p = buf.Bytes()
 
+		flushBatches.WithLabelValues(ib.Name).Inc()
 		if ib.IsActive() {
-			err = ib.WriteCompressed(db, rp, p)
+			start := time.Now()
+			err = ib.WriteCompressed(ctx, db, rp, p)
+			flushDuration.WithLabelValues(ib.Name).Observe(time.Since(start).Seconds())
 			switch err {
 			case nil:
 				return
 			case ErrBadRequest:
-				log.Printf("bad request, drop all data")
+				flushFailures.WithLabelValues(ib.Name).Inc()
+				ib.logger().Warn("bad request, drop all data", logging.DB(db), logging.RP(rp), zap.Int("plen", len(p)))
 				return
 			case ErrNotFound:
-				log.Printf("bad backend, drop all data")
+				flushFailures.WithLabelValues(ib.Name).Inc()
+				ib.logger().Warn("bad backend, drop all data", logging.DB(db), logging.RP(rp), zap.Int("plen", len(p)))
 				return
 			default:
-				log.Printf("write http error, url: %s, db: %s, rp: %s, plen: %d", ib.Url, db, rp, len(p))
+				ib.logger().Warn("write http error", zap.Error(err), logging.DB(db), logging.RP(rp), zap.Int("plen", len(p)))
 			}
 		}
+		flushFailures.WithLabelValues(ib.Name).Inc()
 
 		b := bytes.Join([][]byte{[]byte(url.QueryEscape(db)), []byte(url.QueryEscape(rp)), p}, []byte{' '})
+		span.SetAttributes(attribute.Bool("backlog", true))
 		err = ib.fb.Write(b)
 		if err != nil {
-			log.Printf("write db and data to file error: %s, db: %s, rp: %s, plen: %d", err, db, rp, len(p))
+			ib.logger().Error("write db and data to file error", zap.Error(err), logging.DB(db), logging.RP(rp), zap.Int("plen", len(p)))
 			return
 		}
 	})
@@ -235,7 +252,7 @@ func (ib *Backend) RewriteLoop() {
 func (ib *Backend) Rewrite() (err error) {
 	b, err := ib.fb.Read()
 	if err != nil {
-		log.Print("rewrite read file error: ", err)
+		ib.logger().Error("rewrite read file error", zap.Error(err))
 		return
 	}
 	if b == nil {
@@ -244,42 +261,47 @@ func (ib *Backend) Rewrite() (err error) {
 
 	p := bytes.SplitN(b, []byte{' '}, 3)
 	if len(p) < 3 {
-		log.Print("rewrite read invalid data with length: ", len(p))
+		ib.logger().Error("rewrite read invalid data", zap.Int("length", len(p)))
 		return
 	}
 	db, err := url.QueryUnescape(string(p[0]))
 	if err != nil {
-		log.Print("rewrite db unescape error: ", err)
+		ib.logger().Error("rewrite db unescape error", zap.Error(err))
 		return
 	}
 	rp, err := url.QueryUnescape(string(p[1]))
 	if err != nil {
-		log.Print("rewrite rp unescape error: ", err)
+		ib.logger().Error("rewrite rp unescape error", zap.Error(err), logging.DB(db))
 		return
 	}
-	err = ib.WriteCompressed(db, rp, p[2])
+	ctx, span := tracing.Start(context.Background(), "Backend.Rewrite", tracing.Backend(ib.Name), tracing.URL(ib.Url),
+		tracing.DB(db), tracing.RP(rp), attribute.Int("bytes", len(p[2])))
+	err = ib.WriteCompressed(ctx, db, rp, p[2])
+	tracing.End(span, err)
 
 	switch err {
 	case nil:
+		rewriteRecords.WithLabelValues(ib.Name).Inc()
+		rewriteBytes.WithLabelValues(ib.Name).Add(float64(len(p[2])))
 	case ErrBadRequest:
-		log.Printf("bad request, drop all data")
+		ib.logger().Warn("bad request, drop all data", logging.DB(db), logging.RP(rp), zap.Int("plen", len(p[2])))
 		err = nil
 	case ErrNotFound:
-		log.Printf("bad backend, drop all data")
+		ib.logger().Warn("bad backend, drop all data", logging.DB(db), logging.RP(rp), zap.Int("plen", len(p[2])))
 		err = nil
 	default:
-		log.Printf("rewrite http error, url: %s, db: %s, rp: %s, plen: %d", ib.Url, db, rp, len(p[1]))
+		ib.logger().Warn("rewrite http error", zap.Error(err), logging.DB(db), logging.RP(rp), zap.Int("plen", len(p[2])))
 
 		err = ib.fb.RollbackMeta()
 		if err != nil {
-			log.Printf("rollback meta error: %s", err)
+			ib.logger().Error("rollback meta error", zap.Error(err))
 		}
 		return
 	}
 
 	err = ib.fb.UpdateMeta()
 	if err != nil {
-		log.Printf("update meta error: %s", err)
+		ib.logger().Error("update meta error", zap.Error(err))
 	}
 	return
 }
@@ -326,7 +348,7 @@ func (ib *Backend) GetHealth(ic *Circle, withStats bool) interface{} {
 			for _, meas := range measurements {
 				key := GetKey(db, meas)
 				nb := ic.GetBackend(key)
-				if nb.Url == ib.Url {
+				if IsShardedKey(key) || nb.Url == ib.Url {
 					inplace++
 				} else {
 					incorrect++
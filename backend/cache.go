@@ -0,0 +1,183 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxql"
+)
+
+// cacheHeaders are the response headers replayed from a cached query response
+var cacheHeaders = []string{"Content-Type", "Content-Encoding", "X-Influxdb-Version", "X-Influxdb-Build"}
+
+type cacheEntry struct {
+	key     string
+	tags    []string
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// QueryCache is a LRU cache of select responses, entries are invalidated by writes to their measurements
+type QueryCache struct {
+	mu      sync.RWMutex
+	size    int
+	ttl     time.Duration
+	pastTTL time.Duration
+	lru     *list.List
+	entries map[string]*list.Element
+	tags    map[string]util.Set
+}
+
+func NewQueryCache(size int, ttl, pastTTL time.Duration) *QueryCache {
+	return &QueryCache{
+		size:    size,
+		ttl:     ttl,
+		pastTTL: pastTTL,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		tags:    make(map[string]util.Set),
+	}
+}
+
+// Key returns the cache key of a select statement, the invalidation tags of its measurements and its ttl,
+// ok is false if the query is not cacheable
+func (qc *QueryCache) Key(req *http.Request, q, db string) (key string, tags []string, ttl time.Duration, ok bool) {
+	if req.FormValue("chunked") == "true" {
+		return
+	}
+	st, err := influxql.ParseStatement(q)
+	if err != nil {
+		return
+	}
+	stmt, isSelect := st.(*influxql.SelectStatement)
+	if !isSelect || stmt.Target != nil {
+		return
+	}
+	// relative time ranges are resolved with now truncated to ttl, so that they share the key within a ttl
+	now := time.Now()
+	_, tr, err := influxql.ConditionExpr(stmt.Condition, &influxql.NowValuer{Now: now.Truncate(qc.ttl)})
+	if err != nil {
+		return
+	}
+	ttl = qc.ttl
+	if !tr.Max.IsZero() && tr.Max.Before(now) {
+		ttl = qc.pastTTL
+	}
+	tagSet := util.NewSet()
+	influxql.WalkFunc(stmt, func(n influxql.Node) {
+		if m, isMeas := n.(*influxql.Measurement); isMeas {
+			mdb := getSourceDatabase(m, db)
+			if m.Regex != nil {
+				tagSet.Add(cacheDatabaseTag(mdb))
+			} else {
+				tagSet.Add(GetKey(mdb, m.Name))
+			}
+		}
+	})
+	for tag := range tagSet {
+		tags = append(tags, tag)
+	}
+	format, _ := ResponseFormat(req)
+	key = strings.Join([]string{
+		stmt.String(), db, req.FormValue("rp"), req.FormValue("epoch"), req.FormValue("pretty"), format,
+		fmt.Sprintf("%d,%d", tr.MinTimeNano(), tr.MaxTimeNano()), cacheIdentity(req),
+	}, "\x00")
+	return key, tags, ttl, true
+}
+
+// cacheIdentity returns a digest of the credentials of the client, which are forwarded to backends without their own,
+// so that a response is only served to the clients authorized with the same credentials
+func cacheIdentity(req *http.Request) string {
+	u, p, _ := req.BasicAuth()
+	h := sha256.Sum256([]byte(strings.Join([]string{req.FormValue("u"), req.FormValue("p"), u, p, req.Header.Get("Authorization")}, "\x00")))
+	return hex.EncodeToString(h[:])
+}
+
+func (qc *QueryCache) Get(key string) (header http.Header, body []byte, ok bool) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	elem, ok := qc.entries[key]
+	if !ok {
+		return
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		qc.remove(elem)
+		return nil, nil, false
+	}
+	qc.lru.MoveToFront(elem)
+	return entry.header, entry.body, true
+}
+
+func (qc *QueryCache) Set(key string, tags []string, ttl time.Duration, header http.Header, body []byte) {
+	entry := &cacheEntry{key: key, tags: tags, header: make(http.Header), body: body, expires: time.Now().Add(ttl)}
+	for _, name := range cacheHeaders {
+		if v := header.Get(name); v != "" {
+			entry.header.Set(name, v)
+		}
+	}
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	if elem, ok := qc.entries[key]; ok {
+		qc.remove(elem)
+	}
+	qc.entries[key] = qc.lru.PushFront(entry)
+	for _, tag := range tags {
+		if qc.tags[tag] == nil {
+			qc.tags[tag] = util.NewSet()
+		}
+		qc.tags[tag].Add(key)
+	}
+	for qc.lru.Len() > qc.size {
+		qc.remove(qc.lru.Back())
+	}
+}
+
+// Invalidate removes the entries of the measurement and of regex queries on its database
+func (qc *QueryCache) Invalidate(db, meas string) {
+	key, dbTag := GetKey(db, meas), cacheDatabaseTag(db)
+	qc.mu.RLock()
+	found := len(qc.tags[key]) > 0 || len(qc.tags[dbTag]) > 0
+	qc.mu.RUnlock()
+	if !found {
+		return
+	}
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+	for _, tag := range []string{key, dbTag} {
+		for k := range qc.tags[tag] {
+			if elem, ok := qc.entries[k]; ok {
+				qc.remove(elem)
+			}
+		}
+	}
+}
+
+func (qc *QueryCache) remove(elem *list.Element) {
+	entry := qc.lru.Remove(elem).(*cacheEntry)
+	delete(qc.entries, entry.key)
+	for _, tag := range entry.tags {
+		if keys, ok := qc.tags[tag]; ok {
+			keys.Remove(entry.key)
+			if len(keys) == 0 {
+				delete(qc.tags, tag)
+			}
+		}
+	}
+}
+
+func cacheDatabaseTag(db string) string {
+	return "\x00" + db
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestQueryCacheKey(t *testing.T) {
+	qc := NewQueryCache(10, 10*time.Second, 300*time.Second)
+	tests := []struct {
+		name string
+		q    string
+		ok   bool
+		ttl  time.Duration
+		tags []string
+	}{
+		{"select", "select value from cpu where time > now() - 1h", true, 10 * time.Second, []string{"db,cpu"}},
+		{"past", "select value from cpu where time > '2021-01-01T00:00:00Z' and time < '2021-01-02T00:00:00Z'", true, 300 * time.Second, []string{"db,cpu"}},
+		{"other db", "select value from db2..cpu", true, 10 * time.Second, []string{"db2,cpu"}},
+		{"regex", "select value from /cpu.*/", true, 10 * time.Second, []string{"\x00db"}},
+		{"into", "select value into cpu2 from cpu", false, 0, nil},
+		{"show", "show measurements", false, 0, nil},
+	}
+	for _, tt := range tests {
+		req := NewQueryRequest("GET", "db", tt.q, "")
+		_, tags, ttl, ok := qc.Key(req, tt.q, "db")
+		if ok != tt.ok || ttl != tt.ttl || len(tags) != len(tt.tags) || len(tags) > 0 && tags[0] != tt.tags[0] {
+			t.Errorf("%v: got %v %v %q, expected %v %v %q", tt.name, ok, ttl, tags, tt.ok, tt.ttl, tt.tags)
+		}
+	}
+
+	q1, q2 := "SELECT value FROM cpu WHERE time > now() - 1h", "select  value from \"cpu\" where time > now()-1h"
+	k1, _, _, _ := qc.Key(NewQueryRequest("GET", "db", q1, ""), q1, "db")
+	k2, _, _, _ := qc.Key(NewQueryRequest("GET", "db", q2, ""), q2, "db")
+	if k1 != k2 {
+		t.Errorf("normalized keys differ: %q != %q", k1, k2)
+	}
+	req := NewQueryRequest("GET", "db", q1, "")
+	req.Form.Set("epoch", "ms")
+	if k3, _, _, _ := qc.Key(req, q1, "db"); k3 == k1 {
+		t.Errorf("key should differ by epoch")
+	}
+	req = NewQueryRequest("GET", "db", q1, "")
+	req.Form.Set("u", "admin")
+	req.Form.Set("p", "secret")
+	k4, _, _, _ := qc.Key(req, q1, "db")
+	req = NewQueryRequest("GET", "db", q1, "")
+	req.SetBasicAuth("admin", "secret")
+	k5, _, _, _ := qc.Key(req, q1, "db")
+	if k4 == k1 || k5 == k1 || k4 == k5 {
+		t.Errorf("key should differ by user")
+	}
+}
+
+func TestQueryCacheSetGet(t *testing.T) {
+	qc := NewQueryCache(2, time.Minute, time.Minute)
+	header := http.Header{"Content-Type": []string{"application/json"}, "Date": []string{"now"}}
+	qc.Set("k1", []string{"db,cpu"}, time.Minute, header, []byte("b1"))
+	qc.Set("k2", []string{"db,mem"}, time.Minute, header, []byte("b2"))
+	if h, b, ok := qc.Get("k1"); !ok || string(b) != "b1" || h.Get("Content-Type") != "application/json" || h.Get("Date") != "" {
+		t.Errorf("get k1 wrong: %v %q %v", ok, b, h)
+	}
+	// k2 is the least recently used entry
+	qc.Set("k3", []string{"\x00db"}, time.Minute, header, []byte("b3"))
+	if _, _, ok := qc.Get("k2"); ok {
+		t.Errorf("k2 should be evicted")
+	}
+	qc.Invalidate("db", "cpu")
+	for _, key := range []string{"k1", "k3"} {
+		if _, _, ok := qc.Get(key); ok {
+			t.Errorf("%s should be invalidated", key)
+		}
+	}
+	if len(qc.entries) != 0 || len(qc.tags) != 0 || qc.lru.Len() != 0 {
+		t.Errorf("cache should be empty: %v %v %v", qc.entries, qc.tags, qc.lru.Len())
+	}
+	qc.Set("k4", nil, -time.Second, header, []byte("b4"))
+	if _, _, ok := qc.Get("k4"); ok {
+		t.Errorf("k4 should be expired")
+	}
+}
@@ -69,6 +69,29 @@ func (ic *Circle) GetBackend(key string) *Backend {
 	return be
 }
 
+func (ic *Circle) checkBackends(keys []string, fn func(*Backend) bool) bool {
+	if keys == nil {
+		for _, be := range ic.Backends {
+			if !fn(be) {
+				return false
+			}
+		}
+		return true
+	}
+	for _, key := range keys {
+		if IsShardedKey(key) {
+			for _, be := range ic.Backends {
+				if !fn(be) {
+					return false
+				}
+			}
+		} else if !fn(ic.GetBackend(key)) {
+			return false
+		}
+	}
+	return true
+}
+
 func (ic *Circle) GetHealth(stats bool) interface{} {
 	var wg sync.WaitGroup
 	backends := make([]interface{}, len(ic.Backends))
@@ -6,8 +6,11 @@ package backend
 
 import (
 	"errors"
-	"log"
+	"fmt"
 
+	"github.com/chengshiwen/influx-proxy/logging"
+	"github.com/chengshiwen/influx-proxy/prometheus"
+	"github.com/chengshiwen/influx-proxy/tracing"
 	"github.com/chengshiwen/influx-proxy/util"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/spf13/viper"
@@ -25,15 +28,35 @@ var (
 	ErrEmptyBackendName      = errors.New("backend name cannot be empty")
 	ErrDuplicatedBackendName = errors.New("backend name duplicated")
 	ErrInvalidHashKey        = errors.New("invalid hash_key, require idx, exi, name or url")
+	ErrInvalidBackendType    = errors.New("invalid backend type, require v1 or v2")
+	ErrEmptyBackendToken     = errors.New("backend org and token cannot be empty for type v2")
+	ErrInvalidPromSchema     = errors.New("invalid prom_write_schema, require v1 or v2")
+)
+
+const (
+	BackendTypeV1 = "v1"
+	BackendTypeV2 = "v2"
 )
 
 type BackendConfig struct { // nolint:golint
-	Name        string `mapstructure:"name"`
-	Url         string `mapstructure:"url"` // nolint:golint
-	Username    string `mapstructure:"username"`
-	Password    string `mapstructure:"password"`
-	AuthEncrypt bool   `mapstructure:"auth_encrypt"`
-	WriteOnly   bool   `mapstructure:"write_only"`
+	Name         string         `mapstructure:"name"`
+	Url          string         `mapstructure:"url"` // nolint:golint
+	Username     string         `mapstructure:"username"`
+	Password     string         `mapstructure:"password"`
+	AuthEncrypt  bool           `mapstructure:"auth_encrypt"`
+	WriteOnly    bool           `mapstructure:"write_only"`
+	Type         string         `mapstructure:"type"`
+	Org          string         `mapstructure:"org"`
+	Token        string         `mapstructure:"token"`
+	DBRPMappings []*DBRPMapping `mapstructure:"dbrp_mappings"`
+}
+
+// DBRPMapping maps a database and retention policy to the bucket of an InfluxDB 2.x backend,
+// an empty retention policy maps the writes without retention policy
+type DBRPMapping struct {
+	Database        string `mapstructure:"database"`
+	RetentionPolicy string `mapstructure:"retention_policy"`
+	Bucket          string `mapstructure:"bucket"`
 }
 
 type CircleConfig struct {
@@ -42,29 +65,50 @@ type CircleConfig struct {
 }
 
 type ProxyConfig struct {
-	Circles            []*CircleConfig `mapstructure:"circles"`
-	ListenAddr         string          `mapstructure:"listen_addr"`
-	DBList             []string        `mapstructure:"db_list"`
-	DataDir            string          `mapstructure:"data_dir"`
-	TLogDir            string          `mapstructure:"tlog_dir"`
-	HashKey            string          `mapstructure:"hash_key"`
-	FlushSize          int             `mapstructure:"flush_size"`
-	FlushTime          int             `mapstructure:"flush_time"`
-	CheckInterval      int             `mapstructure:"check_interval"`
-	RewriteInterval    int             `mapstructure:"rewrite_interval"`
-	ConnPoolSize       int             `mapstructure:"conn_pool_size"`
-	WriteTimeout       int             `mapstructure:"write_timeout"`
-	IdleTimeout        int             `mapstructure:"idle_timeout"`
-	Username           string          `mapstructure:"username"`
-	Password           string          `mapstructure:"password"`
-	AuthEncrypt        bool            `mapstructure:"auth_encrypt"`
-	WriteTracing       bool            `mapstructure:"write_tracing"`
-	QueryTracing       bool            `mapstructure:"query_tracing"`
-	PprofEnabled       bool            `mapstructure:"pprof_enabled"`
-	HTTPSEnabled       bool            `mapstructure:"https_enabled"`
-	HTTPSCert          string          `mapstructure:"https_cert"`
-	HTTPSKey           string          `mapstructure:"https_key"`
-	HashKeyMeasureOnly bool            `mapstructure:"hash_key_measure_only"`
+	Circles             []*CircleConfig    `mapstructure:"circles"`
+	ListenAddr          string             `mapstructure:"listen_addr"`
+	DBList              []string           `mapstructure:"db_list"`
+	DataDir             string             `mapstructure:"data_dir"`
+	TLogDir             string             `mapstructure:"tlog_dir"`
+	LogLevel            string             `mapstructure:"log_level"`
+	LogFormat           string             `mapstructure:"log_format"`
+	HashKey             string             `mapstructure:"hash_key"`
+	FlushSize           int                `mapstructure:"flush_size"`
+	FlushTime           int                `mapstructure:"flush_time"`
+	CheckInterval       int                `mapstructure:"check_interval"`
+	RewriteInterval     int                `mapstructure:"rewrite_interval"`
+	ConnPoolSize        int                `mapstructure:"conn_pool_size"`
+	WriteTimeout        int                `mapstructure:"write_timeout"`
+	IdleTimeout         int                `mapstructure:"idle_timeout"`
+	QueryTimeout        int                `mapstructure:"query_timeout"`
+	Username            string             `mapstructure:"username"`
+	Password            string             `mapstructure:"password"`
+	AuthEncrypt         bool               `mapstructure:"auth_encrypt"`
+	WriteTracing        bool               `mapstructure:"write_tracing"`
+	QueryTracing        bool               `mapstructure:"query_tracing"`
+	PprofEnabled        bool               `mapstructure:"pprof_enabled"`
+	HTTPSEnabled        bool               `mapstructure:"https_enabled"`
+	HTTPSCert           string             `mapstructure:"https_cert"`
+	HTTPSKey            string             `mapstructure:"https_key"`
+	HashKeyMeasureOnly  bool               `mapstructure:"hash_key_measure_only"`
+	ShardedMeasurements []string           `mapstructure:"sharded_measurements"`
+	QueryCacheSize      int                `mapstructure:"query_cache_size"`
+	QueryCacheTTL       int                `mapstructure:"query_cache_ttl"`
+	QueryCachePastTTL   int                `mapstructure:"query_cache_past_ttl"`
+	QueryGuardrails     []*GuardrailConfig `mapstructure:"query_guardrails"`
+	ShadowReadRatio     float64            `mapstructure:"shadow_read_ratio"`
+	PromWriteSchema     string             `mapstructure:"prom_write_schema"`
+	PromMeasureLabel    string             `mapstructure:"prom_measurement_label"`
+	PromDropLabels      []string           `mapstructure:"prom_drop_labels"`
+	PromTenantHeader    string             `mapstructure:"prom_tenant_header"`
+	PromTenantLabel     string             `mapstructure:"prom_tenant_label"`
+	PromTenantStrip     bool               `mapstructure:"prom_tenant_strip"`
+	MonitorDatabase     string             `mapstructure:"monitor_database"`
+	MonitorInterval     int                `mapstructure:"monitor_interval"`
+	TraceExporter       string             `mapstructure:"trace_exporter"`
+	TraceEndpoint       string             `mapstructure:"trace_endpoint"`
+	TraceFile           string             `mapstructure:"trace_file"`
+	TraceSampleRatio    float64            `mapstructure:"trace_sample_ratio"`
 }
 
 func NewFileConfig(cfgfile string) (cfg *ProxyConfig, err error) {
@@ -93,6 +137,12 @@ func (cfg *ProxyConfig) setDefault() {
 	if cfg.TLogDir == "" {
 		cfg.TLogDir = "log"
 	}
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+	}
+	if cfg.LogFormat == "" {
+		cfg.LogFormat = logging.FormatConsole
+	}
 	if cfg.HashKey == "" {
 		cfg.HashKey = "idx"
 	}
@@ -117,6 +167,24 @@ func (cfg *ProxyConfig) setDefault() {
 	if cfg.IdleTimeout <= 0 {
 		cfg.IdleTimeout = 10
 	}
+	if cfg.QueryCacheTTL <= 0 {
+		cfg.QueryCacheTTL = 10
+	}
+	if cfg.QueryCachePastTTL <= 0 {
+		cfg.QueryCachePastTTL = 300
+	}
+	if cfg.MonitorInterval <= 0 {
+		cfg.MonitorInterval = 10
+	}
+	if cfg.PromWriteSchema == "" {
+		cfg.PromWriteSchema = prometheus.SchemaV1
+	}
+	if cfg.TraceFile == "" {
+		cfg.TraceFile = "trace.json"
+	}
+	if cfg.TraceSampleRatio <= 0 || cfg.TraceSampleRatio > 1 {
+		cfg.TraceSampleRatio = 1
+	}
 }
 
 func (cfg *ProxyConfig) checkConfig() (err error) {
@@ -136,24 +204,60 @@ func (cfg *ProxyConfig) checkConfig() (err error) {
 				return ErrDuplicatedBackendName
 			}
 			set.Add(backend.Name)
+			if backend.Type != "" && backend.Type != BackendTypeV1 && backend.Type != BackendTypeV2 {
+				return ErrInvalidBackendType
+			}
+			if backend.Type == BackendTypeV2 && (backend.Org == "" || backend.Token == "") {
+				return ErrEmptyBackendToken
+			}
 		}
 	}
 	if cfg.HashKey != "idx" && cfg.HashKey != "exi" && cfg.HashKey != "name" && cfg.HashKey != "url" {
 		return ErrInvalidHashKey
 	}
+	if cfg.PromWriteSchema != prometheus.SchemaV1 && cfg.PromWriteSchema != prometheus.SchemaV2 {
+		return ErrInvalidPromSchema
+	}
+	if cfg.TraceExporter != "" && cfg.TraceExporter != tracing.ExporterOTLP && cfg.TraceExporter != tracing.ExporterStdout && cfg.TraceExporter != tracing.ExporterFile {
+		return tracing.ErrInvalidExporter
+	}
 	return
 }
 
 func (cfg *ProxyConfig) PrintSummary() {
-	log.Printf("%d circles loaded from file", len(cfg.Circles))
+	logger := logging.L()
+	logger.Info(fmt.Sprintf("%d circles loaded from file", len(cfg.Circles)))
 	for id, circle := range cfg.Circles {
-		log.Printf("circle %d: %d backends loaded", id, len(circle.Backends))
+		logger.Info(fmt.Sprintf("%d backends loaded", len(circle.Backends)), logging.Circle(id))
 	}
-	log.Printf("hash key: %s", cfg.HashKey)
+	logger.Info("hash key: " + cfg.HashKey)
 	if len(cfg.DBList) > 0 {
-		log.Printf("db list: %v", cfg.DBList)
+		logger.Info(fmt.Sprintf("db list: %v", cfg.DBList))
+	}
+	if len(cfg.ShardedMeasurements) > 0 {
+		logger.Info(fmt.Sprintf("sharded measurements: %v", cfg.ShardedMeasurements))
+	}
+	if cfg.QueryCacheSize > 0 {
+		logger.Info(fmt.Sprintf("query cache: size %d, ttl %ds, past ttl %ds", cfg.QueryCacheSize, cfg.QueryCacheTTL, cfg.QueryCachePastTTL))
+	}
+	for _, g := range cfg.QueryGuardrails {
+		logger.Info(fmt.Sprintf("query guardrail: %+v", *g))
+	}
+	if cfg.ShadowReadRatio > 0 {
+		logger.Info(fmt.Sprintf("shadow read ratio: %g", cfg.ShadowReadRatio))
+	}
+	logger.Info("prom write schema: " + cfg.PromWriteSchema)
+	if cfg.PromTenantHeader != "" || cfg.PromTenantLabel != "" {
+		logger.Info(fmt.Sprintf("prom write tenant: header %q, label %q, strip label %t", cfg.PromTenantHeader, cfg.PromTenantLabel, cfg.PromTenantStrip))
+	}
+	if cfg.MonitorDatabase != "" {
+		logger.Info(fmt.Sprintf("monitor: interval %ds", cfg.MonitorInterval), logging.DB(cfg.MonitorDatabase))
+	}
+	logger.Info(fmt.Sprintf("log: level %s, format %s", cfg.LogLevel, cfg.LogFormat))
+	if cfg.TraceExporter != "" {
+		logger.Info(fmt.Sprintf("trace: exporter %s, sample ratio %g", cfg.TraceExporter, cfg.TraceSampleRatio))
 	}
-	log.Printf("auth: %t, encrypt: %t", cfg.Username != "" || cfg.Password != "", cfg.AuthEncrypt)
+	logger.Info(fmt.Sprintf("auth: %t, encrypt: %t", cfg.Username != "" || cfg.Password != "", cfg.AuthEncrypt))
 }
 
 func (cfg *ProxyConfig) String() string {
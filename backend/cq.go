@@ -0,0 +1,250 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/chengshiwen/influx-proxy/logging"
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxql"
+)
+
+var ErrContinuousQuery = errors.New("invalid continuous query statement")
+
+type ContinuousQuery struct {
+	Database string
+	Name     string
+	Query    string
+}
+
+func ParseContinuousQuery(q string) (*influxql.CreateContinuousQueryStatement, error) {
+	stmt, err := influxql.ParseStatement(q)
+	if err != nil {
+		return nil, err
+	}
+	cq, ok := stmt.(*influxql.CreateContinuousQueryStatement)
+	if !ok || cq.Source == nil || cq.Source.Target == nil {
+		return nil, ErrContinuousQuery
+	}
+	return cq, nil
+}
+
+// GetContinuousQueryOwners returns the backends owning the source measurements of the continuous query,
+// all backends are returned for regex or sharded sources, and warnings are returned for targets owned by other backends
+// and for sources owned by v2 backends, which have no continuous queries
+func (ic *Circle) GetContinuousQueryOwners(stmt *influxql.CreateContinuousQueryStatement) (owners []*Backend, warnings []string) {
+	urls := util.NewSet()
+	addOwner := func(be *Backend) {
+		if urls[be.Url] {
+			return
+		}
+		urls.Add(be.Url)
+		if be.IsV2() {
+			warnings = append(warnings, fmt.Sprintf("continuous query %s: skipped on v2 backend %s in circle %s", stmt.Name, be.Name, ic.Name))
+			return
+		}
+		owners = append(owners, be)
+	}
+	target := stmt.Source.Target.Measurement
+	tdb := target.Database
+	if tdb == "" {
+		tdb = stmt.Database
+	}
+	for _, source := range stmt.Source.Sources {
+		m, ok := source.(*influxql.Measurement)
+		if !ok {
+			continue
+		}
+		db := m.Database
+		if db == "" {
+			db = stmt.Database
+		}
+		key := GetKey(db, m.Name)
+		if m.Regex != nil || IsShardedKey(key) {
+			for _, be := range ic.Backends {
+				addOwner(be)
+			}
+			continue
+		}
+		owner := ic.GetBackend(key)
+		addOwner(owner)
+		tmeas := target.Name
+		if tmeas == "" {
+			// target of :MEASUREMENT backreference is the source measurement
+			tmeas = m.Name
+		}
+		if tbe := ic.GetBackend(GetKey(tdb, tmeas)); tbe.Url != owner.Url {
+			warnings = append(warnings, fmt.Sprintf("continuous query %s: target %s.%s is owned by backend %s but source %s.%s by backend %s in circle %s",
+				stmt.Name, tdb, tmeas, tbe.Name, db, m.Name, owner.Name, ic.Name))
+		}
+	}
+	return
+}
+
+// GetContinuousQueryOwners returns the owning backends of the continuous query in every circle
+func (ip *Proxy) GetContinuousQueryOwners(stmt *influxql.CreateContinuousQueryStatement) (owners []*Backend, warnings []string) {
+	for _, circle := range ip.Circles {
+		bes, warns := circle.GetContinuousQueryOwners(stmt)
+		owners = append(owners, bes...)
+		warnings = append(warnings, warns...)
+	}
+	return
+}
+
+func (hb *HttpBackend) GetContinuousQueries() (cqs []*ContinuousQuery, err error) {
+	qr := hb.Query(NewQueryRequest("GET", "", "show continuous queries", ""), nil, true)
+	if qr.Err != nil {
+		return nil, qr.Err
+	}
+	series, err := SeriesFromResponseBytes(qr.Body)
+	if err != nil {
+		return
+	}
+	for _, s := range series {
+		for _, v := range s.Values {
+			if len(v) < 2 {
+				continue
+			}
+			cqs = append(cqs, &ContinuousQuery{Database: s.Name, Name: util.CastString(v[0]), Query: util.CastString(v[1])})
+		}
+	}
+	return
+}
+
+func (hb *HttpBackend) CreateContinuousQuery(q string) error {
+	qr := hb.Query(NewQueryRequest("POST", "", q, ""), nil, true)
+	return qr.Err
+}
+
+func (hb *HttpBackend) DropContinuousQuery(db, name string) error {
+	q := fmt.Sprintf("drop continuous query %s on %s", influxql.QuoteIdent(name), influxql.QuoteIdent(db))
+	qr := hb.Query(NewQueryRequest("POST", "", q, ""), nil, true)
+	return qr.Err
+}
+
+func QueryCreateContinuousQL(w http.ResponseWriter, req *http.Request, ip *Proxy) (body []byte, err error) {
+	// all circles -> backends owning the sources -> create continuous query
+	stmt, err := ParseContinuousQuery(req.FormValue("q"))
+	if err != nil {
+		return
+	}
+	owners, warnings := ip.GetContinuousQueryOwners(stmt)
+	cr := CloneQueryRequest(req)
+	cr.Header.Del("Accept-Encoding")
+	cr.Header.Set("Accept", "application/json")
+	body, err = QueryBackends(owners, cr, w)
+	if err != nil || len(warnings) == 0 {
+		return
+	}
+	rsp, err := ResponseFromResponseBytes(body)
+	if err != nil {
+		return
+	}
+	if len(rsp.Results) == 0 {
+		rsp.Results = []*Result{{}}
+	}
+	for _, warning := range warnings {
+		logging.FromContext(req.Context()).Warn(warning, logging.DB(req.FormValue("db")))
+		rsp.Results[0].Messages = append(rsp.Results[0].Messages, &Message{Level: "warning", Text: warning})
+	}
+	return MarshalResponse(w, req, rsp)
+}
+
+func QueryDropContinuousQL(w http.ResponseWriter, req *http.Request, ip *Proxy) (body []byte, err error) {
+	// all circles -> v1 backends on which the continuous query is installed -> drop continuous query
+	stmt, err := influxql.ParseStatement(req.FormValue("q"))
+	if err != nil {
+		return
+	}
+	drop, ok := stmt.(*influxql.DropContinuousQueryStatement)
+	if !ok {
+		return nil, ErrContinuousQuery
+	}
+	owners, err := ip.GetContinuousQueryBackends(drop.Database, drop.Name)
+	if err != nil {
+		return
+	}
+	if len(owners) == 0 {
+		// dropping a continuous query that does not exist succeeds as influxdb does
+		return MarshalResponse(w, req, ResponseFromSeries(nil))
+	}
+	return QueryBackends(owners, req, w)
+}
+
+// GetContinuousQueryBackends returns the v1 backends on which the continuous query name on db is installed,
+// which are the owners of its sources unless they changed since it was created
+func (ip *Proxy) GetContinuousQueryBackends(db, name string) (backends []*Backend, err error) {
+	v1 := ip.GetV1Backends()
+	found := make([]bool, len(v1))
+	errs := make([]error, len(v1))
+	var wg sync.WaitGroup
+	for i, be := range v1 {
+		if !be.IsActive() {
+			return nil, fmt.Errorf("backend %s(%s) unavailable", be.Name, be.Url)
+		}
+		wg.Add(1)
+		go func(i int, be *Backend) {
+			defer wg.Done()
+			var cqs []*ContinuousQuery
+			cqs, errs[i] = be.GetContinuousQueries()
+			for _, cq := range cqs {
+				if cq.Database == db && cq.Name == name {
+					found[i] = true
+					return
+				}
+			}
+		}(i, be)
+	}
+	wg.Wait()
+	for i, be := range v1 {
+		if errs[i] != nil {
+			return nil, fmt.Errorf("show continuous queries of backend %s(%s) error: %s", be.Name, be.Url, errs[i])
+		}
+		if found[i] {
+			backends = append(backends, be)
+		}
+	}
+	return
+}
+
+// unionBySeries merges series of the same name and deduplicates their values by the first column
+func unionBySeries(rsps []*Response) (rsp *Response, err error) {
+	if err = checkResponses(rsps); err != nil {
+		return
+	}
+	var series models.Rows
+	seriesMap := make(map[string]*models.Row)
+	valuesMap := make(map[string]util.Set)
+	for _, r := range rsps {
+		for _, serie := range SeriesFromResponse(r) {
+			row, ok := seriesMap[serie.Name]
+			if !ok {
+				row = &models.Row{Name: serie.Name, Columns: serie.Columns, Values: make([][]interface{}, 0)}
+				seriesMap[serie.Name] = row
+				valuesMap[serie.Name] = util.NewSet()
+				series = append(series, row)
+			}
+			for _, value := range serie.Values {
+				if len(value) == 0 {
+					continue
+				}
+				if key := util.CastString(value[0]); !valuesMap[serie.Name][key] {
+					valuesMap[serie.Name].Add(key)
+					row.Values = append(row.Values, value)
+				}
+			}
+		}
+	}
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].Name < series[j].Name
+	})
+	return ResponseFromSeries(series), nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestQueryDropContinuousQL(t *testing.T) {
+	dir, err := os.MkdirTemp("", "influx-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	drops := make(map[string]int)
+	mock := func(name string, installed bool) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/ping" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			q := r.FormValue("q")
+			switch {
+			case q == "show continuous queries" && installed:
+				w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"db1","columns":["name","query"],"values":[["cq1","CREATE CONTINUOUS QUERY cq1 ON db1 BEGIN SELECT mean(value) INTO cpu_1h FROM cpu GROUP BY time(1h) END"]]}]}]}`))
+			case q == "show continuous queries":
+				w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+			case strings.HasPrefix(q, "DROP CONTINUOUS QUERY"):
+				mu.Lock()
+				drops[name]++
+				mu.Unlock()
+				w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+			}
+		}))
+	}
+	s1 := mock("b1", true)
+	defer s1.Close()
+	s2 := mock("b2", false)
+	defer s2.Close()
+
+	cfg := &ProxyConfig{
+		Circles: []*CircleConfig{{Name: "circle-1", Backends: []*BackendConfig{{Name: "b1", Url: s1.URL}, {Name: "b2", Url: s2.URL}}}},
+		DataDir: dir,
+	}
+	cfg.setDefault()
+	ip := NewProxy(cfg)
+	defer ip.Close()
+
+	for _, q := range []string{"DROP CONTINUOUS QUERY cq1 ON db1", "DROP CONTINUOUS QUERY cq2 ON db1"} {
+		req := &http.Request{Method: "POST", Header: http.Header{}, URL: &url.URL{}, Form: url.Values{"q": {q}}}
+		body, err := QueryContinuousQL(httptest.NewRecorder(), req, ip, "drop continuous query")
+		if err != nil {
+			t.Fatalf("%s: %s", q, err)
+		}
+		if got, want := strings.TrimSpace(string(body)), `{"results":[{"statement_id":0}]}`; got != want {
+			t.Errorf("%s: got %s, want %s", q, got, want)
+		}
+	}
+	// the continuous query is only dropped on the backend it is installed on, and a missing one is not dropped
+	if len(drops) != 1 || drops["b1"] != 1 {
+		t.Errorf("got drops %v, want map[b1:1]", drops)
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatCSV     = "csv"
+	FormatMsgpack = "msgpack"
+)
+
+// msgpackTimeExtension is the extension type used by influxdb to encode timestamps in msgpack
+const msgpackTimeExtension = 5
+
+// ResponseFormat returns the response format and content type negotiated by the Accept header
+func ResponseFormat(req *http.Request) (format string, contentType string) {
+	for _, accept := range strings.Split(req.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case "application/csv", "text/csv":
+			return FormatCSV, "text/csv"
+		case "application/x-msgpack":
+			return FormatMsgpack, "application/x-msgpack"
+		case "application/json":
+			return FormatJSON, "application/json"
+		}
+	}
+	return FormatJSON, "application/json"
+}
+
+// ResponseEncoder encodes decoded responses in the format negotiated by the client,
+// the csv state is kept across calls so that a chunked response only repeats the header when columns change
+type ResponseEncoder struct {
+	w           io.Writer
+	format      string
+	pretty      bool
+	statementID int
+	columns     []string
+}
+
+func NewResponseEncoder(w io.Writer, format string, pretty bool) *ResponseEncoder {
+	return &ResponseEncoder{w: w, format: format, pretty: pretty, statementID: -1}
+}
+
+func (enc *ResponseEncoder) Encode(rsp *Response) (err error) {
+	switch enc.format {
+	case FormatCSV:
+		return enc.encodeCSV(rsp)
+	case FormatMsgpack:
+		_, err = enc.w.Write(encodeMsgpack(rsp))
+		return
+	default:
+		_, err = enc.w.Write(util.MarshalJSON(rsp, enc.pretty))
+		return
+	}
+}
+
+func (enc *ResponseEncoder) encodeCSV(rsp *Response) (err error) {
+	cw := csv.NewWriter(enc.w)
+	if rsp.Err != "" {
+		cw.Write([]string{"error"})
+		cw.Write([]string{rsp.Err})
+		cw.Flush()
+		return cw.Error()
+	}
+	for _, result := range rsp.Results {
+		if result.StatementID != enc.statementID || enc.columns == nil {
+			if len(result.Series) == 0 {
+				continue
+			}
+			if enc.statementID >= 0 {
+				cw.Flush()
+				if _, err = io.WriteString(enc.w, "\n"); err != nil {
+					return
+				}
+			}
+			enc.statementID = result.StatementID
+			enc.setColumns(cw, result.Series[0].Columns)
+		}
+		for i, row := range result.Series {
+			if i > 0 && !columnsEqual(result.Series[i-1].Columns, row.Columns) {
+				cw.Flush()
+				if _, err = io.WriteString(enc.w, "\n"); err != nil {
+					return
+				}
+				enc.setColumns(cw, row.Columns)
+			}
+			enc.columns[0] = row.Name
+			enc.columns[1] = ""
+			if len(row.Tags) > 0 {
+				if hashKey := models.NewTags(row.Tags).HashKey(); len(hashKey) > 0 {
+					enc.columns[1] = string(hashKey[1:])
+				}
+			}
+			for _, values := range row.Values {
+				for j, value := range values {
+					if j+2 < len(enc.columns) {
+						enc.columns[j+2] = formatCSVValue(row.Columns[j], value)
+					}
+				}
+				if err = cw.Write(enc.columns); err != nil {
+					return
+				}
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (enc *ResponseEncoder) setColumns(cw *csv.Writer, columns []string) {
+	enc.columns = make([]string, 2+len(columns))
+	enc.columns[0] = "name"
+	enc.columns[1] = "tags"
+	copy(enc.columns[2:], columns)
+	cw.Write(enc.columns)
+}
+
+func columnsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func formatCSVValue(column string, value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case number:
+		if i, err := v.Int64(); err == nil {
+			return strconv.FormatInt(i, 10)
+		}
+		f, _ := v.Float64()
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case string:
+		// influxdb writes timestamps as nanoseconds in csv
+		if column == "time" {
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return strconv.FormatInt(t.UnixNano(), 10)
+			}
+		}
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// msgpackBuffer is a minimal msgpack encoder for the types found in a decoded response
+type msgpackBuffer struct {
+	bytes.Buffer
+}
+
+func encodeMsgpack(rsp *Response) []byte {
+	buf := &msgpackBuffer{}
+	if rsp.Err != "" {
+		buf.writeMapHeader(1)
+		buf.writeString("error")
+		buf.writeString(rsp.Err)
+		return buf.Bytes()
+	}
+	buf.writeMapHeader(1)
+	buf.writeString("results")
+	buf.writeArrayHeader(len(rsp.Results))
+	for _, result := range rsp.Results {
+		size := 1
+		if len(result.Series) > 0 {
+			size++
+		}
+		if len(result.Messages) > 0 {
+			size++
+		}
+		if result.Partial {
+			size++
+		}
+		if result.Err != "" {
+			size++
+		}
+		buf.writeMapHeader(size)
+		buf.writeString("statement_id")
+		buf.writeInt(int64(result.StatementID))
+		if len(result.Series) > 0 {
+			buf.writeString("series")
+			buf.writeArrayHeader(len(result.Series))
+			for _, row := range result.Series {
+				buf.writeRow(row)
+			}
+		}
+		if len(result.Messages) > 0 {
+			buf.writeString("messages")
+			buf.writeArrayHeader(len(result.Messages))
+			for _, m := range result.Messages {
+				buf.writeMapHeader(2)
+				buf.writeString("level")
+				buf.writeString(m.Level)
+				buf.writeString("text")
+				buf.writeString(m.Text)
+			}
+		}
+		if result.Partial {
+			buf.writeString("partial")
+			buf.writeBool(true)
+		}
+		if result.Err != "" {
+			buf.writeString("error")
+			buf.writeString(result.Err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func (buf *msgpackBuffer) writeRow(row *models.Row) {
+	size := 3
+	if len(row.Tags) > 0 {
+		size++
+	}
+	if row.Partial {
+		size++
+	}
+	buf.writeMapHeader(size)
+	buf.writeString("name")
+	buf.writeString(row.Name)
+	if len(row.Tags) > 0 {
+		tags := models.NewTags(row.Tags)
+		buf.writeString("tags")
+		buf.writeMapHeader(len(tags))
+		for _, tag := range tags {
+			buf.writeString(string(tag.Key))
+			buf.writeString(string(tag.Value))
+		}
+	}
+	buf.writeString("columns")
+	buf.writeArrayHeader(len(row.Columns))
+	for _, column := range row.Columns {
+		buf.writeString(column)
+	}
+	if row.Partial {
+		buf.writeString("partial")
+		buf.writeBool(true)
+	}
+	buf.writeString("values")
+	buf.writeArrayHeader(len(row.Values))
+	for _, values := range row.Values {
+		buf.writeArrayHeader(len(values))
+		for j, value := range values {
+			if j < len(row.Columns) && row.Columns[j] == "time" {
+				if s, ok := value.(string); ok {
+					if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+						buf.writeTime(t)
+						continue
+					}
+				}
+			}
+			buf.writeValue(value)
+		}
+	}
+}
+
+func (buf *msgpackBuffer) writeValue(value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		buf.writeBool(v)
+	case number:
+		if i, err := v.Int64(); err == nil {
+			buf.writeInt(i)
+			return
+		}
+		f, _ := v.Float64()
+		buf.writeFloat(f)
+	case float64:
+		buf.writeFloat(v)
+	case int64:
+		buf.writeInt(v)
+	case int:
+		buf.writeInt(int64(v))
+	case string:
+		buf.writeString(v)
+	default:
+		buf.writeString(fmt.Sprint(v))
+	}
+}
+
+func (buf *msgpackBuffer) writeBool(v bool) {
+	if v {
+		buf.WriteByte(0xc3)
+	} else {
+		buf.WriteByte(0xc2)
+	}
+}
+
+func (buf *msgpackBuffer) writeInt(v int64) {
+	switch {
+	case v >= 0 && v <= 0x7f:
+		buf.WriteByte(byte(v))
+	case v < 0 && v >= -32:
+		buf.WriteByte(byte(v))
+	default:
+		var b [9]byte
+		b[0] = 0xd3
+		binary.BigEndian.PutUint64(b[1:], uint64(v))
+		buf.Write(b[:])
+	}
+}
+
+func (buf *msgpackBuffer) writeFloat(v float64) {
+	var b [9]byte
+	b[0] = 0xcb
+	binary.BigEndian.PutUint64(b[1:], math.Float64bits(v))
+	buf.Write(b[:])
+}
+
+func (buf *msgpackBuffer) writeString(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.Write([]byte{0xd9, byte(n)})
+	case n <= math.MaxUint16:
+		buf.Write([]byte{0xda, byte(n >> 8), byte(n)})
+	default:
+		buf.Write([]byte{0xdb, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+	}
+	buf.WriteString(s)
+}
+
+func (buf *msgpackBuffer) writeArrayHeader(n int) {
+	switch {
+	case n < 16:
+		buf.WriteByte(0x90 | byte(n))
+	case n <= math.MaxUint16:
+		buf.Write([]byte{0xdc, byte(n >> 8), byte(n)})
+	default:
+		buf.Write([]byte{0xdd, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+	}
+}
+
+func (buf *msgpackBuffer) writeMapHeader(n int) {
+	switch {
+	case n < 16:
+		buf.WriteByte(0x80 | byte(n))
+	case n <= math.MaxUint16:
+		buf.Write([]byte{0xde, byte(n >> 8), byte(n)})
+	default:
+		buf.Write([]byte{0xdf, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+	}
+}
+
+// writeTime writes an ext8 of 12 bytes: seconds as int64 and nanoseconds as int32
+func (buf *msgpackBuffer) writeTime(t time.Time) {
+	var b [15]byte
+	b[0], b[1], b[2] = 0xc7, 12, msgpackTimeExtension
+	binary.BigEndian.PutUint64(b[3:], uint64(t.Unix()))
+	binary.BigEndian.PutUint32(b[11:], uint32(t.Nanosecond()))
+	buf.Write(b[:])
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestResponseFormat(t *testing.T) {
+	tests := map[string]string{
+		"":                                  FormatJSON,
+		"application/json":                  FormatJSON,
+		"application/csv":                   FormatCSV,
+		"text/csv; charset=utf-8":           FormatCSV,
+		"application/x-msgpack":             FormatMsgpack,
+		"text/html, application/x-msgpack":  FormatMsgpack,
+		"application/json, application/csv": FormatJSON,
+	}
+	for accept, want := range tests {
+		req := &http.Request{Header: http.Header{}}
+		req.Header.Set("Accept", accept)
+		if got, _ := ResponseFormat(req); got != want {
+			t.Errorf("format wrong: %s, %s != %s", accept, got, want)
+		}
+	}
+}
+
+func TestResponseEncoderCSV(t *testing.T) {
+	rsp, _ := ResponseFromResponseBytes([]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a","region":"x"},"columns":["time","value"],"values":[["1970-01-01T00:00:01Z",1.5],["1970-01-01T00:00:02Z",null]]},{"name":"databases","columns":["name"],"values":[["db,1"]]}]},{"statement_id":1,"series":[{"name":"mem","columns":["time","used"],"values":[[3,true]]}]}]}`))
+	var buf bytes.Buffer
+	if err := NewResponseEncoder(&buf, FormatCSV, false).Encode(rsp); err != nil {
+		t.Fatal(err)
+	}
+	want := "name,tags,time,value\ncpu,\"host=a,region=x\",1000000000,1.5\ncpu,\"host=a,region=x\",2000000000,\n\nname,tags,name\ndatabases,,\"db,1\"\n\nname,tags,time,used\nmem,,3,true\n"
+	if buf.String() != want {
+		t.Errorf("csv wrong: %q != %q", buf.String(), want)
+	}
+}
+
+func TestResponseEncoderMsgpack(t *testing.T) {
+	rsp, _ := ResponseFromResponseBytes([]byte(`{"results":[{"statement_id":0,"series":[{"name":"m","columns":["v"],"values":[[1,-2,"s",null]]}]}]}`))
+	var buf bytes.Buffer
+	if err := NewResponseEncoder(&buf, FormatMsgpack, false).Encode(rsp); err != nil {
+		t.Fatal(err)
+	}
+	want := []byte("\x81\xa7results\x91\x82\xacstatement_id\x00\xa6series\x91\x83\xa4name\xa1m\xa7columns\x91\xa1v\xa6values\x91\x94\x01\xfe\xa1s\xc0")
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("msgpack wrong: %q != %q", buf.Bytes(), want)
+	}
+}
@@ -6,15 +6,23 @@ package backend
 
 import (
 	"bytes"
+	"compress/gzip"
 	"errors"
 	"fmt"
-	"log"
+	"io"
 	"math/rand"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 
+	"github.com/chengshiwen/influx-proxy/logging"
+	"github.com/chengshiwen/influx-proxy/tracing"
 	"github.com/chengshiwen/influx-proxy/util"
 	"github.com/influxdata/influxdb1-client/models"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -23,6 +31,7 @@ var (
 	ErrBackendsUnavailable = errors.New("backends unavailable")
 	ErrGetMeasurement      = errors.New("can't get measurement")
 	ErrGetBackends         = errors.New("can't get backends")
+	ErrCardinalityV2       = errors.New("cardinality statements require a circle of v1 backends")
 )
 
 func query(w http.ResponseWriter, req *http.Request, ip *Proxy, key string, fn func(*Backend, *http.Request, http.ResponseWriter) ([]byte, error)) (body []byte, err error) {
@@ -33,19 +42,27 @@ func query(w http.ResponseWriter, req *http.Request, ip *Proxy, key string, fn f
 		if !be.IsActive() || be.IsRewriting() || be.IsWriteOnly() {
 			continue
 		}
-		body, err = fn(be, req, w)
+		qw := w
+		sr := ip.shadowRead(w, req, key, p)
+		if sr != nil {
+			qw = sr
+		}
+		body, err = attemptQuery(qw, req, be, p, fn)
 		if err == nil {
+			if sr != nil {
+				sr.compare(be, body)
+			}
 			return
 		}
 	}
 
 	// pass non-active, non-writing (excluding rewriting and write-only).
 	backends := ip.GetBackends(key)
-	for _, be := range backends {
+	for i, be := range backends {
 		if !be.IsActive() || !(be.IsRewriting() || be.IsWriteOnly()) {
 			continue
 		}
-		body, err = fn(be, req, w)
+		body, err = attemptQuery(w, req, be, i, fn)
 		if err == nil {
 			return
 		}
@@ -57,15 +74,12 @@ func query(w http.ResponseWriter, req *http.Request, ip *Proxy, key string, fn f
 	return nil, ErrBackendsUnavailable
 }
 
-func ReadProm(w http.ResponseWriter, req *http.Request, ip *Proxy, db, meas string) (err error) {
-	// all circles -> backend by key(db,meas) -> select or show
-	key := GetKey(db, meas)
-	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
-		err = be.ReadProm(req, w)
-		return nil, err
-	}
-	_, err = query(w, req, ip, key, fn)
-	return
+// attemptQuery runs fn on the backend of circle within a span, so that the failover attempts of a query can be told apart
+func attemptQuery(w http.ResponseWriter, req *http.Request, be *Backend, circle int, fn func(*Backend, *http.Request, http.ResponseWriter) ([]byte, error)) (body []byte, err error) {
+	ctx, span := tracing.Start(req.Context(), "query.attempt", tracing.Backend(be.Name), tracing.URL(be.Url), tracing.Circle(circle),
+		attribute.Bool("rewriting", be.IsRewriting()), attribute.Bool("write_only", be.IsWriteOnly()))
+	defer func() { tracing.End(span, err) }()
+	return fn(be, req.WithContext(ctx), w)
 }
 
 func QueryFlux(w http.ResponseWriter, req *http.Request, ip *Proxy, bucket, meas string) (err error) {
@@ -85,42 +99,69 @@ func QueryFromQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	if err != nil {
 		return nil, ErrGetMeasurement
 	}
+	if req, err = CheckGuardrailQuery(req, ip, db); err != nil {
+		return
+	}
 	key := GetKey(db, meas)
+	if CheckFanOutFromTokens(tokens) || IsShardedKey(key) {
+		if CheckShowFromTokens(tokens) {
+			return QueryShowQL(w, req, ip, tokens)
+		}
+		if stmt, ok := ParseSelectStatement(req.FormValue("q")); ok {
+			return QueryFanOutQL(w, req, ip, stmt, db)
+		}
+		if IsShardedKey(key) {
+			return nil, ErrShardedQuery
+		}
+	}
 	fn := func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
 		qr := be.Query(req, w, false)
 		return qr.Body, qr.Err
 	}
+	if origin := req.Header.Get(HeaderQueryOrigin); origin == "" || origin == QuerySelectInto {
+		// the response of a single backend is streamed to the client, or to the writer of select into, so the body is nil
+		fn = func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
+			qr := be.QueryStream(req, w)
+			return nil, qr.Err
+		}
+	}
 	body, err = query(w, req, ip, key, fn)
 	return
 }
 
 func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []string) (body []byte, err error) {
 	// all circles -> all backends -> show
-	// remove support of query parameter `chunked`
-	req.Form.Del("chunked")
 	backends := ip.GetAllBackends()
 	bodies, inactive, err := QueryInParallel(backends, req, w, true)
 	if err != nil {
 		return
 	}
 	if inactive > 0 {
-		log.Printf("query: %s, inactive: %d/%d backends unavailable", req.FormValue("q"), inactive, inactive+len(bodies))
+		logging.FromContext(req.Context()).Warn(fmt.Sprintf("%d/%d backends unavailable", inactive, inactive+len(bodies)), logging.Query(req.FormValue("q")), logging.DB(req.FormValue("db")))
 		if len(bodies) == 0 {
 			return nil, ErrBackendsUnavailable
 		}
 	}
 
+	rsps, err := ResponsesFromResponseBytes(bodies)
+	if err != nil {
+		return
+	}
 	var rsp *Response
 	stmt2 := GetHeadStmtFromTokens(tokens, 2)
 	stmt3 := GetHeadStmtFromTokens(tokens, 3)
 	if stmt2 == "show measurements" || stmt2 == "show series" || stmt2 == "show databases" {
-		rsp, err = reduceByValues(bodies)
+		rsp, err = reduceByValues(rsps)
 	} else if stmt3 == "show field keys" || stmt3 == "show tag keys" || stmt3 == "show tag values" {
-		rsp, err = reduceBySeries(bodies)
+		rsp, err = reduceBySeries(rsps)
 	} else if stmt3 == "show retention policies" {
-		rsp, err = attachByValues(bodies)
+		rsp, err = attachByValues(rsps)
 	} else if stmt2 == "show stats" {
-		rsp, err = concatByResults(bodies)
+		rsp, err = concatByResults(rsps)
+		if err == nil {
+			// the stats of the proxy itself follow the stats of the backends
+			rsp.Results = append(rsp.Results, StatisticsResult(ip.Gatherer(), req.FormValue("q")))
+		}
 	}
 	if err != nil {
 		return
@@ -128,8 +169,99 @@ func QueryShowQL(w http.ResponseWriter, req *http.Request, ip *Proxy, tokens []s
 	if rsp == nil {
 		rsp = ResponseFromSeries(nil)
 	}
+	if req.FormValue("chunked") == "true" && req.Header.Get(HeaderQueryOrigin) != QueryStatements {
+		return nil, WriteChunkedResponse(w, req, rsp)
+	}
+	return MarshalResponse(w, req, rsp)
+}
+
+func QueryCardinalityQL(w http.ResponseWriter, req *http.Request, ip *Proxy, head string, exact bool) (body []byte, err error) {
+	// one circle -> all backends -> show cardinality, since every circle holds a full copy of data,
+	// the circle must consist of v1 backends since v2 backends don't support the cardinality statements
+	circle := ip.GetV1QueryCircle()
+	if circle == nil {
+		for _, c := range ip.Circles {
+			if c.checkBackends(nil, func(be *Backend) bool { return !be.IsV2() }) {
+				return nil, ErrBackendsUnavailable
+			}
+		}
+		return nil, ErrCardinalityV2
+	}
+	cr := CloneQueryRequest(req)
+	if exact {
+		// a value stored on several backends would be counted more than once, so values are listed and deduplicated
+		cr.Form.Set("q", ExactCardinalityToList(strings.TrimSpace(req.FormValue("q")), head))
+	}
+	cr.Form.Del("chunked")
+	bodies, inactive, err := QueryInParallel(circle.Backends, cr, w, true)
+	if err != nil {
+		return
+	}
+	if inactive > 0 {
+		return nil, ErrBackendsUnavailable
+	}
+	rsps, err := ResponsesFromResponseBytes(bodies)
+	if err != nil {
+		return
+	}
+	var rsp *Response
+	if exact {
+		rsp, err = countByValues(rsps, head)
+	} else {
+		rsp, err = sumByValues(rsps)
+	}
+	if err != nil {
+		return
+	}
+	return MarshalResponse(w, req, rsp)
+}
+
+// WriteChunkedResponse writes the response as a stream of json objects split by chunk_size,
+// so that a large merged result is not marshaled into one buffer. The rows of a show statement
+// are deduplicated across backends, so the merged response is still held in memory as a whole:
+// chunking only changes the wire format, it does not bound the memory of the proxy
+func WriteChunkedResponse(w http.ResponseWriter, req *http.Request, rsp *Response) (err error) {
+	chunkSize := DefaultChunkSize
+	if n, err := strconv.Atoi(req.FormValue("chunk_size")); err == nil && n > 0 {
+		chunkSize = n
+	}
+	format, contentType := ResponseFormat(req)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusOK)
+	var out io.Writer = w
+	if w.Header().Get("Content-Encoding") == "gzip" {
+		zip := gzip.NewWriter(w)
+		defer zip.Close()
+		out = zip
+	}
+	flusher, _ := w.(http.Flusher)
+	enc := NewResponseEncoder(out, format, req.URL.Query().Get("pretty") == "true")
+	for _, result := range rsp.Results {
+		chunks := ChunkResult(result, chunkSize)
+		for _, chunk := range chunks {
+			if err = enc.Encode(ResponseFromResults([]*Result{chunk})); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	return
+}
+
+// MarshalResponse encodes the merged response in the format negotiated by the client
+func MarshalResponse(w http.ResponseWriter, req *http.Request, rsp *Response) (body []byte, err error) {
 	pretty := req.URL.Query().Get("pretty") == "true"
-	body = util.MarshalJSON(rsp, pretty)
+	format, contentType := ResponseFormat(req)
+	var out bytes.Buffer
+	err = NewResponseEncoder(&out, format, pretty).Encode(rsp)
+	if err != nil {
+		return
+	}
+	body = out.Bytes()
+	w.Header().Set("Content-Type", contentType)
 	if w.Header().Get("Content-Encoding") == "gzip" {
 		var buf bytes.Buffer
 		err = Compress(&buf, body)
@@ -149,14 +281,16 @@ func QueryDeleteOrDropQL(w http.ResponseWriter, req *http.Request, ip *Proxy, to
 		return nil, err
 	}
 	key := GetKey(db, meas)
+	if IsShardedKey(key) {
+		return QueryBackends(ip.GetAllBackends(), req, w)
+	}
 	backends := ip.GetBackends(key)
 	return QueryBackends(backends, req, w)
 }
 
 func QueryAlterQL(w http.ResponseWriter, req *http.Request, ip *Proxy) (body []byte, err error) {
-	// all circles -> all backends -> create or drop database; create, alter or drop retention policy
-	backends := ip.GetAllBackends()
-	return QueryBackends(backends, req, w)
+	// all circles -> all v1 backends -> create or drop database; create, alter or drop retention policy
+	return QueryBackends(ip.GetV1Backends(), req, w)
 }
 
 func QueryBackends(backends []*Backend, req *http.Request, w http.ResponseWriter) (body []byte, err error) {
@@ -175,22 +309,115 @@ func QueryBackends(backends []*Backend, req *http.Request, w http.ResponseWriter
 	return bodies[0], nil
 }
 
+func QueryUserQL(w http.ResponseWriter, req *http.Request, ip *Proxy, show bool) (body []byte, err error) {
+	backends := ip.GetV1Backends()
+	if !show {
+		// all circles -> all v1 backends -> create, drop or set password of user; grant or revoke privileges
+		return QueryBackends(backends, req, w)
+	}
+	// all circles -> all active v1 backends -> show users or grants merged by majority
+	var active []*Backend
+	for _, be := range backends {
+		if be.IsActive() {
+			active = append(active, be)
+		}
+	}
+	if len(active) == 0 {
+		return nil, ErrBackendsUnavailable
+	}
+	rsp, err := queryUserShow(req, active)
+	if err != nil {
+		return
+	}
+	return MarshalResponse(w, req, rsp)
+}
+
+func QueryContinuousQL(w http.ResponseWriter, req *http.Request, ip *Proxy, stmt string) (body []byte, err error) {
+	switch stmt {
+	case "create continuous query":
+		return QueryCreateContinuousQL(w, req, ip)
+	case "drop continuous query":
+		return QueryDropContinuousQL(w, req, ip)
+	}
+	// all circles -> all v1 backends -> show continuous queries
+	bodies, inactive, err := QueryInParallel(ip.GetV1Backends(), req, w, true)
+	if err != nil {
+		return
+	}
+	if inactive > 0 && len(bodies) == 0 {
+		return nil, ErrBackendsUnavailable
+	}
+	rsps, err := ResponsesFromResponseBytes(bodies)
+	if err != nil {
+		return
+	}
+	rsp, err := unionBySeries(rsps)
+	if err != nil {
+		return
+	}
+	return MarshalResponse(w, req, rsp)
+}
+
+// QueryBackendsInOrder queries backends in parallel and returns decoded responses in the order of backends
+func QueryBackendsInOrder(backends []*Backend, req *http.Request) (rsps []*Response, errs []error) {
+	var wg sync.WaitGroup
+	rsps = make([]*Response, len(backends))
+	errs = make([]error, len(backends))
+	for i, be := range backends {
+		wg.Add(1)
+		go func(i int, be *Backend) {
+			defer wg.Done()
+			cr := CloneQueryRequest(req)
+			cr.Header.Set("Accept", "application/json")
+			qr := be.Query(cr, nil, true)
+			if qr.Err != nil {
+				errs[i] = qr.Err
+				return
+			}
+			rsps[i], errs[i] = ResponseFromResponseBytes(qr.Body)
+		}(i, be)
+	}
+	wg.Wait()
+	return
+}
+
 func QueryInParallel(backends []*Backend, req *http.Request, w http.ResponseWriter, decompress bool) (bodies [][]byte, inactive int, err error) {
+	reqs := make([]*http.Request, len(backends))
+	for i := range backends {
+		reqs[i] = req
+	}
+	return QueryRequestsInParallel(backends, reqs, w, decompress)
+}
+
+func QueryRequestsInParallel(backends []*Backend, reqs []*http.Request, w http.ResponseWriter, decompress bool) (bodies [][]byte, inactive int, err error) {
 	var wg sync.WaitGroup
 	var header http.Header
-	req.Header.Set(HeaderQueryOrigin, QueryParallel)
+	var span trace.Span
+	if len(reqs) > 0 {
+		_, span = tracing.Start(reqs[0].Context(), "QueryInParallel", attribute.Int("backends", len(backends)))
+		defer func() {
+			span.SetAttributes(attribute.Int("inactive", inactive))
+			tracing.End(span, err)
+		}()
+	}
 	ch := make(chan *QueryResult, len(backends))
-	for _, be := range backends {
+	for i, be := range backends {
 		if !be.IsActive() {
 			inactive++
 			continue
 		}
+		// the requests may be shared by the goroutines, so they are only modified after being cloned
+		cr := CloneQueryRequest(reqs[i].WithContext(trace.ContextWithSpan(reqs[i].Context(), span)))
+		cr.Header.Set(HeaderQueryOrigin, QueryParallel)
 		wg.Add(1)
-		go func(be *Backend) {
+		go func(be *Backend, cr *http.Request) {
 			defer wg.Done()
-			cr := CloneQueryRequest(req)
+			if decompress {
+				// bodies to be decoded are always requested as json, the client format is applied when re-encoding
+				cr.Header.Set("Accept", "application/json")
+			}
 			ch <- be.Query(cr, nil, decompress)
-		}(be)
+		}(be, cr)
 	}
 	go func() {
 		wg.Wait()
@@ -210,15 +437,12 @@ func QueryInParallel(backends []*Backend, req *http.Request, w http.ResponseWrit
 	return
 }
 
-func reduceByValues(bodies [][]byte) (rsp *Response, err error) {
+func reduceByValues(rsps []*Response) (rsp *Response, err error) {
 	var series models.Rows
 	var values [][]interface{}
 	valuesMap := make(map[string][]interface{})
-	for _, b := range bodies {
-		_series, err := SeriesFromResponseBytes(b)
-		if err != nil {
-			return nil, err
-		}
+	for _, r := range rsps {
+		_series := SeriesFromResponse(r)
 		if len(_series) == 1 {
 			series = _series
 			for _, value := range _series[0].Values {
@@ -240,15 +464,11 @@ func reduceByValues(bodies [][]byte) (rsp *Response, err error) {
 	return ResponseFromSeries(series), nil
 }
 
-func reduceBySeries(bodies [][]byte) (rsp *Response, err error) {
+func reduceBySeries(rsps []*Response) (rsp *Response, err error) {
 	var series models.Rows
 	seriesMap := make(map[string]*models.Row)
-	for _, b := range bodies {
-		_series, err := SeriesFromResponseBytes(b)
-		if err != nil {
-			return nil, err
-		}
-		for _, serie := range _series {
+	for _, r := range rsps {
+		for _, serie := range SeriesFromResponse(r) {
 			seriesMap[serie.Name] = serie
 		}
 	}
@@ -258,15 +478,12 @@ func reduceBySeries(bodies [][]byte) (rsp *Response, err error) {
 	return ResponseFromSeries(series), nil
 }
 
-func attachByValues(bodies [][]byte) (rsp *Response, err error) {
+func attachByValues(rsps []*Response) (rsp *Response, err error) {
 	var series models.Rows
 	valuesMap := make(map[string]bool)
 	isInitial := false
-	for _, b := range bodies {
-		_series, err := SeriesFromResponseBytes(b)
-		if err != nil {
-			return nil, err
-		}
+	for _, r := range rsps {
+		_series := SeriesFromResponse(r)
 		if len(_series) == 1 {
 			if series == nil {
 				series = _series
@@ -288,16 +505,130 @@ func attachByValues(bodies [][]byte) (rsp *Response, err error) {
 	return ResponseFromSeries(series), nil
 }
 
-func concatByResults(bodies [][]byte) (rsp *Response, err error) {
+func concatByResults(rsps []*Response) (rsp *Response, err error) {
 	var results []*Result
-	for _, b := range bodies {
-		_results, err := ResultsFromResponseBytes(b)
-		if err != nil {
-			return nil, err
-		}
-		if len(_results) == 1 {
-			results = append(results, _results[0])
+	for _, r := range rsps {
+		if len(r.Results) == 1 {
+			results = append(results, r.Results[0])
 		}
 	}
 	return ResponseFromResults(results), nil
 }
+
+func checkResponses(rsps []*Response) error {
+	for _, rsp := range rsps {
+		if err := responseError(rsp, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sumByValues(rsps []*Response) (rsp *Response, err error) {
+	if err = checkResponses(rsps); err != nil {
+		return
+	}
+	var series models.Rows
+	seriesMap := make(map[string]*models.Row)
+	bucketsMap := make(map[string][][][]interface{})
+	for _, r := range rsps {
+		for _, serie := range SeriesFromResponse(r) {
+			key := serie.Name + "\x00" + string(models.NewTags(serie.Tags).HashKey())
+			if _, ok := seriesMap[key]; !ok {
+				seriesMap[key] = serie
+				series = append(series, serie)
+			}
+			for i, value := range serie.Values {
+				if i == len(bucketsMap[key]) {
+					bucketsMap[key] = append(bucketsMap[key], nil)
+				}
+				bucketsMap[key][i] = append(bucketsMap[key][i], value)
+			}
+		}
+	}
+	for _, serie := range series {
+		key := serie.Name + "\x00" + string(models.NewTags(serie.Tags).HashKey())
+		values := make([][]interface{}, 0, len(bucketsMap[key]))
+		for _, bucket := range bucketsMap[key] {
+			value := make([]interface{}, len(serie.Columns))
+			for col := range value {
+				value[col] = sumValues(bucket, col)
+			}
+			values = append(values, value)
+		}
+		serie.Values = values
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		return series[i].Name < series[j].Name
+	})
+	return ResponseFromSeries(series), nil
+}
+
+func countByValues(rsps []*Response, head string) (rsp *Response, err error) {
+	if err = checkResponses(rsps); err != nil {
+		return
+	}
+	var names []string
+	valuesMap := make(map[string]map[string]bool)
+	for _, r := range rsps {
+		for _, serie := range SeriesFromResponse(r) {
+			for _, value := range serie.Values {
+				if len(value) == 0 {
+					continue
+				}
+				name, item := serie.Name, util.CastString(value[0])
+				switch head {
+				case "show series":
+					name, _ = models.ParseKey([]byte(item))
+				case "show measurement":
+					name = ""
+				case "show tag values":
+					if len(value) > 1 {
+						item += "\x00" + util.CastString(value[1])
+					}
+				}
+				if _, ok := valuesMap[name]; !ok {
+					valuesMap[name] = make(map[string]bool)
+					names = append(names, name)
+				}
+				valuesMap[name][item] = true
+			}
+		}
+	}
+	sort.Strings(names)
+	var series models.Rows
+	for _, name := range names {
+		series = append(series, &models.Row{
+			Name:    name,
+			Columns: []string{"count"},
+			Values:  [][]interface{}{{len(valuesMap[name])}},
+		})
+	}
+	if head == "show measurement" && len(series) == 0 {
+		series = append(series, &models.Row{Columns: []string{"count"}, Values: [][]interface{}{{0}}})
+	}
+	return ResponseFromSeries(series), nil
+}
+
+func concatBySeries(rsps []*Response) (rsp *Response, err error) {
+	var series models.Rows
+	var messages []*Message
+	for _, _rsp := range rsps {
+		if _rsp.Err != "" {
+			return nil, errors.New(_rsp.Err)
+		}
+		if len(_rsp.Results) > 0 {
+			if _rsp.Results[0].Err != "" {
+				return nil, errors.New(_rsp.Results[0].Err)
+			}
+			series = append(series, _rsp.Results[0].Series...)
+			messages = append(messages, _rsp.Results[0].Messages...)
+		}
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		return series[i].Name < series[j].Name
+	})
+	rsp = ResponseFromSeries(series)
+	rsp.Results[0].Messages = messages
+	return rsp, nil
+}
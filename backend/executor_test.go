@@ -0,0 +1,177 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+func TestSumByValues(t *testing.T) {
+	bodies := [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"columns":["cardinality estimation"],"values":[[10]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"columns":["cardinality estimation"],"values":[[5]]}]}]}`),
+	}
+	assertReduce(t, bodies, sumByValues, `{"results":[{"statement_id":0,"series":[{"columns":["cardinality estimation"],"values":[[15]]}]}]}`)
+
+	bodies = [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"mem","columns":["count"],"values":[[3]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["count"],"values":[[2]]},{"name":"mem","columns":["count"],"values":[[1]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0}]}`),
+	}
+	assertReduce(t, bodies, sumByValues, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["count"],"values":[[2]]},{"name":"mem","columns":["count"],"values":[[4]]}]}]}`)
+}
+
+func TestCountByValues(t *testing.T) {
+	bodies := [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"columns":["key"],"values":[["cpu,host=a"],["cpu,host=b"],["mem,host=a"]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"columns":["key"],"values":[["cpu,host=a"],["cpu,host=c"]]}]}]}`),
+	}
+	count := func(rsps []*Response) (*Response, error) { return countByValues(rsps, "show series") }
+	assertReduce(t, bodies, count, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["count"],"values":[[3]]},{"name":"mem","columns":["count"],"values":[[1]]}]}]}`)
+
+	bodies = [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"],["mem"]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["cpu"],["disk"]]}]}]}`),
+	}
+	count = func(rsps []*Response) (*Response, error) { return countByValues(rsps, "show measurement") }
+	assertReduce(t, bodies, count, `{"results":[{"statement_id":0,"series":[{"columns":["count"],"values":[[3]]}]}]}`)
+
+	bodies = [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["key","value"],"values":[["host","a"],["host","b"]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["key","value"],"values":[["host","b"],["region","b"]]}]}]}`),
+	}
+	count = func(rsps []*Response) (*Response, error) { return countByValues(rsps, "show tag values") }
+	assertReduce(t, bodies, count, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["count"],"values":[[3]]}]}]}`)
+
+	bodies = [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"error":"database not found: db"}]}`),
+	}
+	if _, err := countByValues(mustResponses(t, bodies), "show field key"); err == nil || err.Error() != "database not found: db" {
+		t.Errorf("error wrong: %v", err)
+	}
+}
+
+func mustResponses(t *testing.T, bodies [][]byte) []*Response {
+	rsps, err := ResponsesFromResponseBytes(bodies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsps
+}
+
+func assertReduce(t *testing.T, bodies [][]byte, fn func([]*Response) (*Response, error), want string) {
+	rsp, err := fn(mustResponses(t, bodies))
+	if err != nil {
+		t.Errorf("error: %s", err)
+		return
+	}
+	b := util.MarshalJSON(rsp, false)
+	if string(b[:len(b)-1]) != want {
+		t.Errorf("response wrong: %s != %s", b[:len(b)-1], want)
+	}
+}
+
+func TestUnionBySeries(t *testing.T) {
+	bodies := [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"db","columns":["name","query"],"values":[["cq1","q1"]]},{"name":"_internal","columns":["name","query"]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"name":"db","columns":["name","query"],"values":[["cq1","q1"],["cq2","q2"]]}]}]}`),
+	}
+	assertReduce(t, bodies, unionBySeries, `{"results":[{"statement_id":0,"series":[{"name":"_internal","columns":["name","query"]},{"name":"db","columns":["name","query"],"values":[["cq1","q1"],["cq2","q2"]]}]}]}`)
+}
+
+func TestConcatByBackend(t *testing.T) {
+	backends := []*Backend{
+		{HttpBackend: &HttpBackend{Name: "b1"}},
+		{HttpBackend: &HttpBackend{Name: "b2"}},
+	}
+	rsps := mustResponses(t, [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"columns":["qid","query"],"values":[[1,"select 1"],[2,"show queries"]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"columns":["qid","query"],"values":[[1,"show queries"]]}]}]}`),
+	})
+	rsp, err := concatByBackend(backends, rsps, make([]error, len(rsps)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := util.MarshalJSON(rsp, false)
+	want := `{"results":[{"statement_id":0,"series":[{"columns":["qid","query","backend"],"values":[[1,"select 1","b1"],[2,"show queries","b1"],[1,"show queries","b2"]]}]}]}`
+	if string(b[:len(b)-1]) != want {
+		t.Errorf("response wrong: %s != %s", b[:len(b)-1], want)
+	}
+	if _, err = concatByBackend(backends, rsps, []error{nil, errors.New("timeout")}); err == nil {
+		t.Errorf("error expected")
+	}
+}
+
+func TestQueryCardinalityQLV1(t *testing.T) {
+	dir, err := os.MkdirTemp("", "influx-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var v2Queries int32
+	v2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		atomic.AddInt32(&v2Queries, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer v2.Close()
+	v1 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"columns":["count"],"values":[[3]]}]}]}`))
+	}))
+	defer v1.Close()
+
+	cfg := &ProxyConfig{
+		Circles: []*CircleConfig{
+			{Name: "circle-1", Backends: []*BackendConfig{{Name: "v2", Url: v2.URL, Type: BackendTypeV2, Org: "org", Token: "token"}}},
+			{Name: "circle-2", Backends: []*BackendConfig{{Name: "v1", Url: v1.URL}}},
+		},
+		DataDir: dir,
+	}
+	cfg.setDefault()
+	ip := NewProxy(cfg)
+	defer ip.Close()
+
+	// the circle is picked at random, so the v2 circle would be picked in some of the queries
+	for i := 0; i < 20; i++ {
+		req := &http.Request{Method: "GET", Header: http.Header{}, URL: &url.URL{}, Form: url.Values{"db": {"db1"}, "q": {"show series cardinality"}}}
+		body, err := QueryCardinalityQL(httptest.NewRecorder(), req, ip, "show series", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(body), `[[3]]`) {
+			t.Fatalf("got %s, want the count of the v1 backend", body)
+		}
+	}
+	if n := atomic.LoadInt32(&v2Queries); n != 0 {
+		t.Errorf("got %d queries on the v2 backend, want 0", n)
+	}
+
+	// without a circle of v1 backends the statement is rejected
+	circles := ip.Circles
+	ip.Circles = circles[:1]
+	defer func() { ip.Circles = circles }()
+	req := &http.Request{Method: "GET", Header: http.Header{}, URL: &url.URL{}, Form: url.Values{"db": {"db1"}, "q": {"show series cardinality"}}}
+	if _, err := QueryCardinalityQL(httptest.NewRecorder(), req, ip, "show series", false); err != ErrCardinalityV2 {
+		t.Errorf("got error %v, want %v", err, ErrCardinalityV2)
+	}
+}
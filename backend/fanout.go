@@ -0,0 +1,328 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxql"
+)
+
+func ParseSelectStatement(q string) (*influxql.SelectStatement, bool) {
+	st, err := influxql.ParseStatement(q)
+	if err != nil {
+		return nil, false
+	}
+	stmt, ok := st.(*influxql.SelectStatement)
+	if !ok || stmt.Target != nil {
+		return nil, false
+	}
+	for _, src := range stmt.Sources {
+		if _, ok := src.(*influxql.Measurement); !ok {
+			return nil, false
+		}
+	}
+	return stmt, true
+}
+
+func QueryFanOutQL(w http.ResponseWriter, req *http.Request, ip *Proxy, stmt *influxql.SelectStatement, db string) (body []byte, err error) {
+	// all circles -> one circle -> backends by keys(db,meas) of all sources -> select in parallel
+	sources, err := ExpandSources(ip, stmt.Sources, db)
+	if err != nil {
+		return
+	}
+	if len(sources) == 0 {
+		return MarshalResponse(w, req, ResponseFromSeries(nil))
+	}
+	keys := make([]string, len(sources))
+	for i, m := range sources {
+		keys[i] = GetKey(getSourceDatabase(m, db), m.Name)
+	}
+	circle := ip.GetQueryCircle(keys)
+	if circle == nil {
+		return nil, ErrBackendsUnavailable
+	}
+
+	var backends []*Backend
+	var plan *QueryPlan
+	groups := make(map[*Backend]influxql.Sources)
+	add := func(be *Backend, m *influxql.Measurement) {
+		if _, ok := groups[be]; !ok {
+			backends = append(backends, be)
+		}
+		groups[be] = append(groups[be], m)
+	}
+	for i, m := range sources {
+		if !IsShardedKey(keys[i]) {
+			add(circle.GetBackend(keys[i]), m)
+			continue
+		}
+		// sharded measurement -> all backends of the circle -> partial aggregates
+		if plan == nil {
+			plan, err = NewQueryPlan(stmt)
+			if err != nil {
+				return
+			}
+			stmt = plan.Statement
+		}
+		for _, be := range circle.Backends {
+			add(be, m)
+		}
+	}
+	reqs := make([]*http.Request, len(backends))
+	for i, be := range backends {
+		sub := stmt.Clone()
+		sub.Sources = groups[be]
+		reqs[i] = CloneQueryRequest(req)
+		reqs[i].Form.Set("q", sub.String())
+		reqs[i].Form.Del("chunked")
+		if plan != nil {
+			// the partial results are merged by the times in nanoseconds, which are converted to the epoch of the client after merging
+			reqs[i].Form.Set("epoch", "ns")
+		}
+	}
+	bodies, inactive, err := QueryRequestsInParallel(backends, reqs, w, true)
+	if err != nil {
+		return
+	}
+	if inactive > 0 {
+		return nil, ErrBackendsUnavailable
+	}
+	rsps, err := ResponsesFromResponseBytes(bodies)
+	if err != nil {
+		return
+	}
+	rsp, err := concatBySeries(rsps)
+	if err != nil {
+		return
+	}
+	if plan != nil {
+		if conflicts := SelectorConflicts(plan, rsp.Results[0].Series); conflicts != nil {
+			if err = resolveSelectors(req, plan, conflicts, backends, groups); err != nil {
+				return
+			}
+		}
+		rsp.Results[0].Series, err = MergeSeries(plan, rsp.Results[0].Series)
+		if err != nil {
+			return
+		}
+		FormatSeriesTime(rsp.Results[0].Series, req.FormValue("epoch"))
+	}
+	return MarshalResponse(w, req, rsp)
+}
+
+// resolveSelectors queries the backends for the points of first() and last() within the conflicting intervals
+// by a selector statement per field and interval without group by time(), which returns the time of the selected point,
+// and keeps the earliest or latest point of each series in plan.Selected, the intervals are in nanoseconds
+// and at most MaxSelectorStatements statements are sent in one query per backend
+func resolveSelectors(req *http.Request, plan *QueryPlan, conflicts map[int][]int64, backends []*Backend, groups map[*Backend]influxql.Sources) error {
+	n := 0
+	for _, buckets := range conflicts {
+		n += len(buckets)
+	}
+	if n > MaxSelectorStatements {
+		return ErrMergeSelectors
+	}
+	var keys []selectedKey
+	var stmts []*influxql.SelectStatement
+	for i, buckets := range conflicts {
+		for _, bucket := range buckets {
+			sel := plan.Statement.Clone()
+			sel.Fields = influxql.Fields{sel.Fields[plan.Fields[i].Columns[0]-1]}
+			var dims influxql.Dimensions
+			for _, d := range sel.Dimensions {
+				if call, ok := d.Expr.(*influxql.Call); !ok || call.Name != "time" {
+					dims = append(dims, d)
+				}
+			}
+			sel.Dimensions = dims
+			if plan.GroupByTime {
+				tref := &influxql.VarRef{Val: "time"}
+				window := &influxql.BinaryExpr{
+					Op:  influxql.AND,
+					LHS: &influxql.BinaryExpr{Op: influxql.GTE, LHS: tref, RHS: &influxql.IntegerLiteral{Val: bucket}},
+					RHS: &influxql.BinaryExpr{Op: influxql.LT, LHS: tref, RHS: &influxql.IntegerLiteral{Val: bucket + plan.Interval}},
+				}
+				if sel.Condition == nil {
+					sel.Condition = window
+				} else {
+					sel.Condition = &influxql.BinaryExpr{Op: influxql.AND, LHS: &influxql.ParenExpr{Expr: sel.Condition}, RHS: window}
+				}
+			}
+			keys = append(keys, selectedKey{field: i, bucket: bucket})
+			stmts = append(stmts, sel)
+		}
+	}
+	reqs := make([]*http.Request, len(backends))
+	for i, be := range backends {
+		qs := make([]string, len(stmts))
+		for j, stmt := range stmts {
+			sub := stmt.Clone()
+			sub.Sources = groups[be]
+			qs[j] = sub.String()
+		}
+		reqs[i] = CloneQueryRequest(req)
+		reqs[i].Form.Set("q", strings.Join(qs, "; "))
+		reqs[i].Form.Del("chunked")
+		reqs[i].Form.Set("epoch", "ns")
+	}
+	bodies, inactive, err := QueryRequestsInParallel(backends, reqs, nil, true)
+	if err != nil {
+		return err
+	}
+	if inactive > 0 {
+		return ErrBackendsUnavailable
+	}
+	rsps, err := ResponsesFromResponseBytes(bodies)
+	if err != nil {
+		return err
+	}
+	points := make(map[selectedKey][]interface{})
+	for _, rsp := range rsps {
+		if err = responseError(rsp, nil); err != nil {
+			return err
+		}
+		for _, result := range rsp.Results {
+			if result.Err != "" {
+				return errors.New(result.Err)
+			}
+			if result.StatementID < 0 || result.StatementID >= len(keys) {
+				continue
+			}
+			k := keys[result.StatementID]
+			for _, serie := range result.Series {
+				if len(serie.Values) == 0 || serie.Values[0][1] == nil {
+					continue
+				}
+				k.series = serie.Name + "\x00" + string(models.NewTags(serie.Tags).HashKey())
+				row, t := serie.Values[0], parseTime(serie.Values[0][0])
+				if prev, ok := points[k]; ok {
+					pt := parseTime(prev[0])
+					if plan.Fields[k.field].Name == "first" && t >= pt || plan.Fields[k.field].Name == "last" && t <= pt {
+						continue
+					}
+				}
+				points[k] = row
+			}
+		}
+	}
+	plan.Selected = make(map[selectedKey]interface{}, len(points))
+	for k, row := range points {
+		plan.Selected[k] = row[1]
+	}
+	return nil
+}
+
+func QueryFanOutFlux(w http.ResponseWriter, req *http.Request, ip *Proxy, keys []string) (err error) {
+	// all circles -> one circle -> backends by keys(bucket,meas) -> query flux in parallel
+	circle := ip.GetQueryCircle(keys)
+	if circle == nil {
+		return ErrBackendsUnavailable
+	}
+	var backends []*Backend
+	set := make(map[*Backend]bool)
+	add := func(be *Backend) {
+		if !set[be] {
+			set[be] = true
+			backends = append(backends, be)
+		}
+	}
+	for _, key := range keys {
+		if !IsShardedKey(key) {
+			add(circle.GetBackend(key))
+			continue
+		}
+		// the series of a sharded measurement are spread over all backends of the circle
+		for _, be := range circle.Backends {
+			add(be)
+		}
+	}
+	rbody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return
+	}
+
+	qrs := make([]*QueryResult, len(backends))
+	var wg sync.WaitGroup
+	for i, be := range backends {
+		cr := req.Clone(req.Context())
+		cr.Body = ioutil.NopCloser(bytes.NewReader(rbody))
+		cr.ContentLength = int64(len(rbody))
+		// the bodies are concatenated as plain csv, the client encoding is left to the http service
+		cr.Header.Del("Accept-Encoding")
+		wg.Add(1)
+		go func(i int, be *Backend, cr *http.Request) {
+			defer wg.Done()
+			qrs[i] = be.QueryFluxBody(cr)
+		}(i, be, cr)
+	}
+	wg.Wait()
+	bodies := make([][]byte, len(qrs))
+	for i, qr := range qrs {
+		if qr.Err != nil {
+			return qr.Err
+		}
+		bodies[i] = qr.Body
+	}
+	p, err := ConcatFluxTables(bodies)
+	if err != nil {
+		return
+	}
+
+	CopyHeader(w.Header(), qrs[0].Header)
+	w.Header().Del("Content-Encoding")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(p)
+	return
+}
+
+// ExpandSources resolves regex measurements against the merged measurements of all backends,
+// and returns the deduplicated measurements without regex
+func ExpandSources(ip *Proxy, sources influxql.Sources, db string) (measurements []*influxql.Measurement, err error) {
+	set := make(map[string]bool)
+	add := func(m *influxql.Measurement) {
+		if s := m.String(); !set[s] {
+			set[s] = true
+			measurements = append(measurements, m)
+		}
+	}
+	for _, src := range sources {
+		m := src.(*influxql.Measurement)
+		mdb := getSourceDatabase(m, db)
+		if mdb == "" {
+			return nil, ErrDatabaseNotFound
+		}
+		if ip.IsForbiddenDB(mdb) {
+			return nil, fmt.Errorf("database forbidden: %s", mdb)
+		}
+		if m.Regex == nil {
+			add(m)
+			continue
+		}
+		names, err := ip.GetMeasurements(mdb, m.Regex)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			add(&influxql.Measurement{Database: m.Database, RetentionPolicy: m.RetentionPolicy, Name: name})
+		}
+	}
+	return
+}
+
+func getSourceDatabase(m *influxql.Measurement, db string) string {
+	if m.Database != "" {
+		return m.Database
+	}
+	return db
+}
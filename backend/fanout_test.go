@@ -0,0 +1,95 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestQueryFanOutEpoch(t *testing.T) {
+	dir, err := os.MkdirTemp("", "influx-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var queries []string
+	// the partial points carry the time of the interval, the selector points carry the time of the first point
+	mock := func(partial, selector string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/ping" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			q := r.FormValue("q")
+			if epoch := r.FormValue("epoch"); epoch != "ns" {
+				t.Errorf("epoch of %s: got %s, want ns", q, epoch)
+			}
+			mu.Lock()
+			queries = append(queries, q)
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			if strings.Contains(q, "GROUP BY time") {
+				w.Write([]byte(partial))
+			} else {
+				w.Write([]byte(selector))
+			}
+		}))
+	}
+	s1 := mock(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","first"],"values":[[0,1],[3600000000000,7]]}]}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","first"],"values":[[500000000,1]]}]}]}`)
+	defer s1.Close()
+	s2 := mock(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","first"],"values":[[0,2],[3600000000000,null]]}]}]}`,
+		`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","first"],"values":[[100000000,2]]}]}]}`)
+	defer s2.Close()
+
+	cfg := &ProxyConfig{
+		Circles:             []*CircleConfig{{Name: "circle-1", Backends: []*BackendConfig{{Name: "b1", Url: s1.URL}, {Name: "b2", Url: s2.URL}}}},
+		DataDir:             dir,
+		ShardedMeasurements: []string{"db1,cpu"},
+	}
+	cfg.setDefault()
+	ip := NewProxy(cfg)
+	defer ip.Close()
+	defer delete(ShardedKeySet, "db1,cpu")
+
+	q := "SELECT first(value) FROM cpu WHERE time >= 0 AND time < 2h GROUP BY time(1h)"
+	req := &http.Request{Method: "GET", Header: http.Header{}, URL: &url.URL{}, Form: url.Values{"db": {"db1"}, "q": {q}, "epoch": {"ms"}}}
+	body, err := ip.Query(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","first"],"values":[[0,2],[3600000,7]]}]}]}`
+	if got := strings.TrimSpace(string(body)); got != want {
+		t.Errorf("body: got %s, want %s", got, want)
+	}
+	var window bool
+	for _, q := range queries {
+		window = window || strings.Contains(q, "time >= 0 AND time < 3600000000000")
+	}
+	if !window {
+		t.Errorf("selector window in nanoseconds not found in %q", queries)
+	}
+}
+
+func TestResolveSelectorsLimit(t *testing.T) {
+	stmt, _ := ParseSelectStatement("SELECT first(value) FROM cpu WHERE time >= 0 GROUP BY time(1s)")
+	plan, _ := NewQueryPlan(stmt)
+	buckets := make([]int64, MaxSelectorStatements+1)
+	for i := range buckets {
+		buckets[i] = int64(i) * plan.Interval
+	}
+	// the conflicts are rejected before any backend is queried
+	if err := resolveSelectors(NewQueryRequest("GET", "db1", "", "ms"), plan, map[int][]int64{0: buckets}, nil, nil); err != ErrMergeSelectors {
+		t.Errorf("got error %v, want %v", err, ErrMergeSelectors)
+	}
+}
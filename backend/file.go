@@ -7,10 +7,12 @@ package backend
 import (
 	"encoding/binary"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
 	"sync"
+
+	"github.com/chengshiwen/influx-proxy/logging"
+	"go.uber.org/zap"
 )
 
 type FileBackend struct {
@@ -18,6 +20,8 @@ type FileBackend struct {
 	filename string
 	datadir  string
 	dataflag bool
+	offset   int64 // committed offset of consumer
+	records  int64 // records after offset
 	producer *os.File
 	consumer *os.File
 	meta     *os.File
@@ -32,19 +36,19 @@ func NewFileBackend(filename string, datadir string) (fb *FileBackend, err error
 	pathname := filepath.Join(datadir, filename)
 	fb.producer, err = os.OpenFile(pathname+".dat", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		log.Printf("open producer error: %s %s", fb.filename, err)
+		fb.logger().Error("open producer error", zap.Error(err))
 		return
 	}
 
 	fb.consumer, err = os.OpenFile(pathname+".dat", os.O_RDONLY, 0644)
 	if err != nil {
-		log.Printf("open consumer error: %s %s", fb.filename, err)
+		fb.logger().Error("open consumer error", zap.Error(err))
 		return
 	}
 
 	fb.meta, err = os.OpenFile(pathname+".rec", os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
-		log.Printf("open meta error: %s %s", fb.filename, err)
+		fb.logger().Error("open meta error", zap.Error(err))
 		return
 	}
 
@@ -52,6 +56,26 @@ func NewFileBackend(filename string, datadir string) (fb *FileBackend, err error
 	producerOffset, _ := fb.producer.Seek(0, io.SeekEnd)
 	offset, _ := fb.consumer.Seek(0, io.SeekCurrent)
 	fb.dataflag = producerOffset > offset
+	fb.records = fb.countRecords(offset, producerOffset)
+	return
+}
+
+func (fb *FileBackend) logger() *zap.Logger {
+	return logging.L().With(logging.Backend(fb.filename))
+}
+
+// countRecords counts the records between the offsets by their lengths
+func (fb *FileBackend) countRecords(offset, end int64) (records int64) {
+	length := make([]byte, 4)
+	for offset < end {
+		_, err := fb.consumer.ReadAt(length, offset)
+		if err != nil {
+			fb.logger().Error("count records error", zap.Error(err))
+			return
+		}
+		offset += 4 + int64(binary.BigEndian.Uint32(length))
+		records++
+	}
 	return
 }
 
@@ -62,13 +86,13 @@ func (fb *FileBackend) Write(p []byte) (err error) {
 	var length = uint32(len(p))
 	err = binary.Write(fb.producer, binary.BigEndian, length)
 	if err != nil {
-		log.Print("write length error: ", err)
+		fb.logger().Error("write length error", zap.Error(err))
 		return
 	}
 
 	n, err := fb.producer.Write(p)
 	if err != nil {
-		log.Print("write error: ", err)
+		fb.logger().Error("write error", zap.Error(err))
 		return
 	}
 	if n != len(p) {
@@ -77,14 +101,26 @@ func (fb *FileBackend) Write(p []byte) (err error) {
 
 	err = fb.producer.Sync()
 	if err != nil {
-		log.Print("sync meta error: ", err)
+		fb.logger().Error("sync meta error", zap.Error(err))
 		return
 	}
 
 	fb.dataflag = true
+	fb.records++
 	return
 }
 
+// Backlog returns the bytes and records written but not yet rewritten
+func (fb *FileBackend) Backlog() (size int64, records int64) {
+	fb.lock.Lock()
+	defer fb.lock.Unlock()
+	fi, err := fb.producer.Stat()
+	if err != nil {
+		return 0, fb.records
+	}
+	return fi.Size() - fb.offset, fb.records
+}
+
 func (fb *FileBackend) IsData() bool {
 	fb.lock.Lock()
 	defer fb.lock.Unlock()
@@ -99,14 +135,14 @@ func (fb *FileBackend) Read() (p []byte, err error) {
 
 	err = binary.Read(fb.consumer, binary.BigEndian, &length)
 	if err != nil {
-		log.Print("read length error: ", err)
+		fb.logger().Error("read length error", zap.Error(err))
 		return
 	}
 	p = make([]byte, length)
 
 	_, err = io.ReadFull(fb.consumer, p)
 	if err != nil {
-		log.Print("read error: ", err)
+		fb.logger().Error("read error", zap.Error(err))
 		return
 	}
 	return
@@ -118,7 +154,7 @@ func (fb *FileBackend) RollbackMeta() (err error) {
 
 	_, err = fb.meta.Seek(0, io.SeekStart)
 	if err != nil {
-		log.Printf("seek meta error: %s %s", fb.filename, err)
+		fb.logger().Error("seek meta error", zap.Error(err))
 		return
 	}
 
@@ -126,16 +162,17 @@ func (fb *FileBackend) RollbackMeta() (err error) {
 	err = binary.Read(fb.meta, binary.BigEndian, &offset)
 	if err != nil {
 		if err != io.EOF {
-			log.Printf("read meta error: %s %s", fb.filename, err)
+			fb.logger().Error("read meta error", zap.Error(err))
 		}
 		return
 	}
 
 	_, err = fb.consumer.Seek(offset, io.SeekStart)
 	if err != nil {
-		log.Printf("seek consumer error: %s %s", fb.filename, err)
+		fb.logger().Error("seek consumer error", zap.Error(err))
 		return
 	}
+	fb.offset = offset
 	return
 }
 
@@ -145,20 +182,20 @@ func (fb *FileBackend) UpdateMeta() (err error) {
 
 	producerOffset, err := fb.producer.Seek(0, io.SeekCurrent)
 	if err != nil {
-		log.Printf("seek producer error: %s %s", fb.filename, err)
+		fb.logger().Error("seek producer error", zap.Error(err))
 		return
 	}
 
 	offset, err := fb.consumer.Seek(0, io.SeekCurrent)
 	if err != nil {
-		log.Printf("seek consumer error: %s %s", fb.filename, err)
+		fb.logger().Error("seek consumer error", zap.Error(err))
 		return
 	}
 
 	if producerOffset == offset {
 		err = fb.CleanUp()
 		if err != nil {
-			log.Printf("cleanup error: %s %s", fb.filename, err)
+			fb.logger().Error("cleanup error", zap.Error(err))
 			return
 		}
 		offset = 0
@@ -166,46 +203,50 @@ func (fb *FileBackend) UpdateMeta() (err error) {
 
 	_, err = fb.meta.Seek(0, io.SeekStart)
 	if err != nil {
-		log.Printf("seek meta error: %s %s", fb.filename, err)
+		fb.logger().Error("seek meta error", zap.Error(err))
 		return
 	}
 
-	log.Printf("write meta: %s, %d", fb.filename, offset)
+	fb.logger().Debug("write meta", zap.Int64("offset", offset))
 	err = binary.Write(fb.meta, binary.BigEndian, &offset)
 	if err != nil {
-		log.Printf("write meta error: %s %s", fb.filename, err)
+		fb.logger().Error("write meta error", zap.Error(err))
 		return
 	}
 
 	err = fb.meta.Sync()
 	if err != nil {
-		log.Printf("sync meta error: %s %s", fb.filename, err)
+		fb.logger().Error("sync meta error", zap.Error(err))
 		return
 	}
 
+	fb.offset = offset
+	if fb.records--; offset == 0 || fb.records < 0 {
+		fb.records = 0
+	}
 	return
 }
 
 func (fb *FileBackend) CleanUp() (err error) {
 	_, err = fb.consumer.Seek(0, io.SeekStart)
 	if err != nil {
-		log.Print("seek consumer error: ", err)
+		fb.logger().Error("seek consumer error", zap.Error(err))
 		return
 	}
 	filename := filepath.Join(fb.datadir, fb.filename+".dat")
 	err = os.Truncate(filename, 0)
 	if err != nil {
-		log.Print("truncate error: ", err)
+		fb.logger().Error("truncate error", zap.Error(err))
 		return
 	}
 	err = fb.producer.Close()
 	if err != nil {
-		log.Print("close producer error: ", err)
+		fb.logger().Error("close producer error", zap.Error(err))
 		return
 	}
 	fb.producer, err = os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		log.Print("open producer error: ", err)
+		fb.logger().Error("open producer error", zap.Error(err))
 		return
 	}
 	fb.dataflag = false
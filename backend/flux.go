@@ -6,18 +6,24 @@ package backend
 
 import (
 	"bytes"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"strconv"
 	"strings"
 
-	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/flux/ast"
+	"github.com/influxdata/flux/parser"
 )
 
 var (
-	ErrGetBucket         = errors.New("can't get bucket")
-	ErrEqualMeasurement  = errors.New("measurement must use ==")
-	ErrMultiMeasurements = errors.New("illegal multi measurements")
-	ErrIllegalFluxQuery  = errors.New("illegal flux query")
+	ErrGetBucket           = errors.New("can't get bucket")
+	ErrEqualMeasurement    = errors.New("measurement must use ==")
+	ErrMultiMeasurements   = errors.New("illegal multi measurements")
+	ErrMultiBuckets        = errors.New("illegal multi buckets")
+	ErrIllegalFluxQuery    = errors.New("illegal flux query")
+	ErrIllegalFluxResponse = errors.New("illegal flux response")
 )
 
 type QueryRequest struct {
@@ -53,65 +59,357 @@ type Literal struct {
 	Property string `json:"property,omitempty"`
 }
 
-func ScanQuery(query string) (bucket string, measurement string, err error) {
-	bucket, err = ParseQueryBucket(query)
-	if err != nil {
-		return
+// FluxQuery lists the buckets read by the from() calls of a flux query and the measurements selected by its predicates
+type FluxQuery struct {
+	Buckets      []string
+	Measurements []string
+
+	bucketErr      error
+	measurementErr error
+	mergeErr       error
+	vars           map[string]ast.Expression
+}
+
+// fluxMergeableFunctions are the transformations applied to each table alone, so the tables returned
+// by several backends are merged by concatenation, aggregates, selectors and regrouping are not
+var fluxMergeableFunctions = map[string]bool{
+	"from": true, "range": true, "filter": true, "map": true, "keep": true, "drop": true, "rename": true,
+	"duplicate": true, "set": true, "fill": true, "limit": true, "tail": true, "sort": true, "union": true, "yield": true,
+	"toBool": true, "toFloat": true, "toInt": true, "toString": true, "toTime": true, "toUInt": true,
+}
+
+var fluxComparisonOperators = map[ast.OperatorKind]bool{
+	ast.EqualOperator: true, ast.NotEqualOperator: true, ast.LessThanOperator: true, ast.LessThanEqualOperator: true,
+	ast.GreaterThanOperator: true, ast.GreaterThanEqualOperator: true, ast.RegexpMatchOperator: true, ast.NotRegexpMatchOperator: true,
+}
+
+// ParseFluxQuery parses the flux query by the flux parser and walks its syntax tree for from() calls and _measurement predicates
+func ParseFluxQuery(query string) (fq *FluxQuery, err error) {
+	pkg := parser.ParseSource(query)
+	if err = ast.GetError(pkg); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrIllegalFluxQuery, err)
 	}
-	measurement, err = ParseQueryMeasurement(query)
+	fq = &FluxQuery{vars: make(map[string]ast.Expression)}
+	walkFlux(pkg, func(node ast.Node, negated bool) {
+		switch n := node.(type) {
+		case *ast.VariableAssignment:
+			fq.vars[n.ID.Name] = n.Init
+		case *ast.MemberAssignment:
+			if ident, ok := n.Member.Object.(*ast.Identifier); ok {
+				fq.vars[ident.Name+"."+n.Member.Property.Key()] = n.Init
+			}
+		}
+	})
+	walkFlux(pkg, fq.visit)
 	return
 }
 
-func ParseQueryBucket(query string) (bucket string, err error) {
-	i := strings.Index(query, "from")
-	if i == -1 || i >= len(query)-4 {
-		err = ErrGetBucket
-		return
+// Bucket returns the only bucket of the query
+func (fq *FluxQuery) Bucket() (string, error) {
+	if fq.bucketErr != nil {
+		return "", fq.bucketErr
+	}
+	switch len(fq.Buckets) {
+	case 0:
+		return "", ErrGetBucket
+	case 1:
+		return fq.Buckets[0], nil
+	}
+	return "", ErrMultiBuckets
+}
+
+// Measurement returns the only measurement of the query
+func (fq *FluxQuery) Measurement() (string, error) {
+	if fq.measurementErr != nil {
+		return "", fq.measurementErr
+	}
+	switch len(fq.Measurements) {
+	case 0:
+		return "", ErrGetMeasurement
+	case 1:
+		return fq.Measurements[0], nil
+	}
+	return "", ErrMultiMeasurements
+}
+
+// CheckMerge returns an error if the query calls a transformation whose tables cannot be merged across backends
+func (fq *FluxQuery) CheckMerge() error {
+	return fq.mergeErr
+}
+
+// Sources returns all buckets and measurements of the query
+func (fq *FluxQuery) Sources() (buckets []string, measurements []string, err error) {
+	if fq.bucketErr != nil {
+		return nil, nil, fq.bucketErr
+	}
+	if len(fq.Buckets) == 0 {
+		return nil, nil, ErrGetBucket
+	}
+	if fq.measurementErr != nil {
+		return nil, nil, fq.measurementErr
+	}
+	if len(fq.Measurements) == 0 {
+		return nil, nil, ErrGetMeasurement
+	}
+	return fq.Buckets, fq.Measurements, nil
+}
+
+func (fq *FluxQuery) visit(node ast.Node, negated bool) {
+	switch n := node.(type) {
+	case *ast.PipeExpression:
+		fq.checkMerge(n.Call)
+	case *ast.CallExpression:
+		for _, prop := range fluxCallArgs(n) {
+			// a call taking tables without pipe, such as join(tables: {a: a, b: b})
+			if prop.Key.Key() == "tables" {
+				fq.checkMerge(n)
+				break
+			}
+		}
+		callee, ok := n.Callee.(*ast.Identifier)
+		if !ok {
+			return
+		}
+		switch callee.Name {
+		case "from":
+			fq.visitFrom(n)
+		case "contains":
+			fq.visitContains(n, negated)
+		}
+	case *ast.BinaryExpression:
+		if !fluxComparisonOperators[n.Operator] {
+			return
+		}
+		value := n.Right
+		if !isFluxMeasurement(n.Left) {
+			if !isFluxMeasurement(n.Right) {
+				return
+			}
+			value = n.Left
+		}
+		op := n.Operator.String()
+		if negated {
+			op = "not " + op
+		}
+		if op != "==" {
+			fq.setMeasurementErr(fmt.Errorf("%w, got %s", ErrEqualMeasurement, op))
+			return
+		}
+		fq.addMeasurement(value)
 	}
-	str := query[i+4:]
-	j := strings.Index(str, ")")
-	if j == -1 {
-		err = ErrIllegalFluxQuery
+}
+
+// checkMerge rejects a transformation unless it is mergeable or a function defined in the query, whose body is checked
+func (fq *FluxQuery) checkMerge(call *ast.CallExpression) {
+	if call == nil {
 		return
 	}
-	items := strings.Split(strings.Trim(str[:j+1], " ()"), ",")
-	for _, item := range items {
-		entries := strings.Split(strings.TrimSpace(item), ":")
-		if len(entries) == 2 && entries[0] == "bucket" {
-			bucket = strings.Trim(entries[1], " \"'")
+	var name string
+	switch callee := call.Callee.(type) {
+	case *ast.Identifier:
+		if _, ok := fq.vars[callee.Name].(*ast.FunctionExpression); ok || fluxMergeableFunctions[callee.Name] {
 			return
 		}
+		name = callee.Name
+	case *ast.MemberExpression:
+		if ident, ok := callee.Object.(*ast.Identifier); ok {
+			name = ident.Name + "."
+		}
+		name += callee.Property.Key()
+	default:
+		name = "anonymous"
+	}
+	if fq.mergeErr == nil {
+		fq.mergeErr = fmt.Errorf("%w: function %s() cannot be merged across backends", ErrIllegalFluxQuery, name)
 	}
-	return "", ErrGetBucket
 }
 
-func ParseQueryMeasurement(query string) (measurement string, err error) {
-	items := strings.Split(query, "._measurement")
-	if len(items) < 2 {
-		items = strings.Split(query, `["_measurement"]`)
-		if len(items) < 2 {
-			err = ErrGetMeasurement
+func (fq *FluxQuery) visitFrom(call *ast.CallExpression) {
+	for _, prop := range fluxCallArgs(call) {
+		switch prop.Key.Key() {
+		case "bucket":
+			bucket, ok := fq.stringValue(prop.Value, 0)
+			if !ok {
+				fq.setBucketErr(fmt.Errorf("%w: bucket of from() must be a string", ErrGetBucket))
+				return
+			}
+			fq.Buckets = appendUnique(fq.Buckets, bucket)
 			return
+		case "bucketID":
+			fq.setBucketErr(fmt.Errorf("%w: from() by bucketID is unsupported, use bucket", ErrGetBucket))
+			return
+		}
+	}
+	fq.setBucketErr(fmt.Errorf("%w: from() requires bucket", ErrGetBucket))
+}
+
+// visitContains handles contains(value: r._measurement, set: [...])
+func (fq *FluxQuery) visitContains(call *ast.CallExpression, negated bool) {
+	var value, set ast.Expression
+	for _, prop := range fluxCallArgs(call) {
+		switch prop.Key.Key() {
+		case "value":
+			value = prop.Value
+		case "set":
+			set = prop.Value
 		}
 	}
-	if len(items) > 2 {
-		err = ErrMultiMeasurements
+	if !isFluxMeasurement(value) {
 		return
 	}
-	str := strings.TrimSpace(items[1])
-	if !strings.HasPrefix(str, "==") {
-		err = ErrEqualMeasurement
+	if negated {
+		fq.setMeasurementErr(fmt.Errorf("%w, got not contains", ErrEqualMeasurement))
 		return
 	}
-	str = strings.TrimLeft(str, "= ")
-	if str[0] == '"' {
-		advance, _, err := FindEndWithQuote([]byte(str), 0, '"')
-		if err != nil {
-			return "", err
+	if ident, ok := set.(*ast.Identifier); ok {
+		set = fq.vars[ident.Name]
+	}
+	arr, ok := set.(*ast.ArrayExpression)
+	if !ok {
+		fq.setMeasurementErr(fmt.Errorf("%w: set of contains() must be an array", ErrGetMeasurement))
+		return
+	}
+	for _, elem := range arr.Elements {
+		fq.addMeasurement(elem)
+	}
+}
+
+func (fq *FluxQuery) addMeasurement(node ast.Expression) {
+	measurement, ok := fq.stringValue(node, 0)
+	if !ok {
+		fq.setMeasurementErr(fmt.Errorf("%w: measurement must be compared with a string", ErrGetMeasurement))
+		return
+	}
+	fq.Measurements = appendUnique(fq.Measurements, measurement)
+}
+
+// stringValue resolves a string literal, a variable or an object property assigned with a string literal
+func (fq *FluxQuery) stringValue(node ast.Expression, depth int) (string, bool) {
+	if depth > 8 {
+		return "", false
+	}
+	switch n := node.(type) {
+	case *ast.StringLiteral:
+		return n.Value, true
+	case *ast.ParenExpression:
+		return fq.stringValue(n.Expression, depth+1)
+	case *ast.Identifier:
+		if init, ok := fq.vars[n.Name]; ok {
+			return fq.stringValue(init, depth+1)
+		}
+	case *ast.MemberExpression:
+		if ident, ok := n.Object.(*ast.Identifier); ok {
+			if init, ok := fq.vars[ident.Name+"."+n.Property.Key()]; ok {
+				return fq.stringValue(init, depth+1)
+			}
+			if obj, ok := fq.vars[ident.Name].(*ast.ObjectExpression); ok {
+				for _, prop := range obj.Properties {
+					if prop.Key.Key() == n.Property.Key() {
+						return fq.stringValue(prop.Value, depth+1)
+					}
+				}
+			}
 		}
-		return util.UnescapeIdentifier(str[1 : advance-1]), nil
 	}
-	return "", ErrGetMeasurement
+	return "", false
+}
+
+func (fq *FluxQuery) setBucketErr(err error) {
+	if fq.bucketErr == nil {
+		fq.bucketErr = err
+	}
+}
+
+func (fq *FluxQuery) setMeasurementErr(err error) {
+	if fq.measurementErr == nil {
+		fq.measurementErr = err
+	}
+}
+
+// fluxCallArgs returns the properties of the object argument of a call
+func fluxCallArgs(call *ast.CallExpression) []*ast.Property {
+	if len(call.Arguments) == 0 {
+		return nil
+	}
+	if obj, ok := call.Arguments[0].(*ast.ObjectExpression); ok {
+		return obj.Properties
+	}
+	return nil
+}
+
+// isFluxMeasurement reports whether the node is r._measurement or r["_measurement"]
+func isFluxMeasurement(node ast.Expression) bool {
+	m, ok := node.(*ast.MemberExpression)
+	return ok && m.Property.Key() == "_measurement"
+}
+
+// fluxVisitor calls fn for every node, negated tells whether the node is under an odd number of not
+type fluxVisitor struct {
+	negated bool
+	fn      func(node ast.Node, negated bool)
+}
+
+func (v *fluxVisitor) Visit(node ast.Node) ast.Visitor {
+	v.fn(node, v.negated)
+	if n, ok := node.(*ast.UnaryExpression); ok && n.Operator == ast.NotOperator {
+		return &fluxVisitor{negated: !v.negated, fn: v.fn}
+	}
+	return v
+}
+
+func (v *fluxVisitor) Done(node ast.Node) {
+}
+
+func walkFlux(node ast.Node, fn func(ast.Node, bool)) {
+	ast.Walk(&fluxVisitor{fn: fn}, node)
+}
+
+func appendUnique(items []string, item string) []string {
+	for _, v := range items {
+		if v == item {
+			return items
+		}
+	}
+	return append(items, item)
+}
+
+func ScanQuery(query string) (bucket string, measurement string, err error) {
+	fq, err := ParseFluxQuery(query)
+	if err != nil {
+		return
+	}
+	bucket, err = fq.Bucket()
+	if err != nil {
+		return
+	}
+	measurement, err = fq.Measurement()
+	return
+}
+
+func ParseQueryBucket(query string) (bucket string, err error) {
+	fq, err := ParseFluxQuery(query)
+	if err != nil {
+		return
+	}
+	return fq.Bucket()
+}
+
+func ParseQueryMeasurement(query string) (measurement string, err error) {
+	fq, err := ParseFluxQuery(query)
+	if err != nil {
+		return
+	}
+	return fq.Measurement()
+}
+
+// CheckMerge returns an error if an operation of the spec cannot be merged across backends like FluxQuery.CheckMerge
+func (s *Spec) CheckMerge() error {
+	for _, op := range s.Operations {
+		if op.Kind != "influxDBFrom" && !fluxMergeableFunctions[op.Kind] {
+			return fmt.Errorf("%w: operation %s cannot be merged across backends", ErrIllegalFluxQuery, op.Kind)
+		}
+	}
+	return nil
 }
 
 func ScanSpec(spec *Spec) (bucket string, measurement string, err error) {
@@ -186,3 +484,89 @@ func ParseSpecMeasurement(spec []byte) (measurement string, err error) {
 	}
 	return "", ErrGetMeasurement
 }
+
+// ConcatFluxTables concatenates the annotated csv of several backends into one response,
+// tables are renumbered per result so that the tables of different backends never share an id
+func ConcatFluxTables(bodies [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.UseCRLF = true
+	next := make(map[string]int)
+	for _, body := range bodies {
+		ids := make(map[[2]string]string)
+		for _, block := range splitFluxBlocks(body) {
+			r := csv.NewReader(bytes.NewReader(block))
+			r.FieldsPerRecord = -1
+			records, err := r.ReadAll()
+			if err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrIllegalFluxResponse, err)
+			}
+			var defaults []string
+			header, resultCol, tableCol := true, -1, -1
+			for _, record := range records {
+				if strings.HasPrefix(record[0], "#") {
+					if record[0] == "#default" {
+						defaults = record
+					}
+				} else if header {
+					header = false
+					for i, col := range record {
+						switch col {
+						case "result":
+							resultCol = i
+						case "table":
+							tableCol = i
+						}
+					}
+				} else if tableCol >= 0 && tableCol < len(record) {
+					var result string
+					if resultCol >= 0 && resultCol < len(record) {
+						result = record[resultCol]
+						if result == "" && resultCol < len(defaults) {
+							result = defaults[resultCol]
+						}
+					}
+					id := [2]string{result, record[tableCol]}
+					if _, ok := ids[id]; !ok {
+						ids[id] = strconv.Itoa(next[result])
+						next[result]++
+					}
+					record[tableCol] = ids[id]
+				}
+				if err = w.Write(record); err != nil {
+					return nil, err
+				}
+			}
+			w.Flush()
+			buf.WriteString("\r\n")
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// splitFluxBlocks splits annotated csv by the empty lines outside quoted values
+func splitFluxBlocks(body []byte) (blocks [][]byte) {
+	blockStart, lineStart, quoted := 0, 0, false
+	for i := 0; i <= len(body); i++ {
+		if i < len(body) {
+			if body[i] == '"' {
+				quoted = !quoted
+			}
+			if body[i] != '\n' || quoted {
+				continue
+			}
+		}
+		if len(bytes.TrimSpace(body[lineStart:i])) == 0 {
+			if block := body[blockStart:lineStart]; len(bytes.TrimSpace(block)) > 0 {
+				blocks = append(blocks, block)
+			}
+			blockStart = i + 1
+		}
+		lineStart = i + 1
+	}
+	if blockStart < len(body) {
+		blocks = append(blocks, body[blockStart:])
+	}
+	return
+}
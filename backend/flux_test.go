@@ -4,7 +4,12 @@
 
 package backend
 
-import "testing"
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestParseQueryBucket(t *testing.T) {
 	tests := []struct {
@@ -21,7 +26,8 @@ func TestParseQueryBucket(t *testing.T) {
 		{
 			name: "test2",
 			have: ` from ( bucket: 'example-bucket'' ) `,
-			want: "example-bucket",
+			want: "",
+			werr: ErrIllegalFluxQuery,
 		},
 		{
 			name: "test3",
@@ -33,7 +39,7 @@ func TestParseQueryBucket(t *testing.T) {
 			name: "test4",
 			have: ` from  `,
 			want: "",
-			werr: ErrIllegalFluxQuery,
+			werr: ErrGetBucket,
 		},
 		{
 			name: "test5",
@@ -51,10 +57,40 @@ func TestParseQueryBucket(t *testing.T) {
 )`,
 			want: "example-bucket",
 		},
+		{
+			name: "test7",
+			have: `// from(bucket: "commented")
+from(bucket: "example-bucket") |> filter(fn: (r) => r.text == "from(bucket: other)")`,
+			want: "example-bucket",
+		},
+		{
+			name: "test8",
+			have: `b = "example-bucket"
+from(bucket: b) |> range(start: -1h)`,
+			want: "example-bucket",
+		},
+		{
+			name: "test9",
+			have: `option v = {bucket: "example-bucket", timeRangeStart: -1h}
+from(bucket: v.bucket) |> range(start: v.timeRangeStart)`,
+			want: "example-bucket",
+		},
+		{
+			name: "test10",
+			have: `union(tables: [from(bucket: "b0"), from(bucket: "b1")])`,
+			want: "",
+			werr: ErrMultiBuckets,
+		},
+		{
+			name: "test11",
+			have: `from(bucket: "example-bucket") |> range(start: -1h`,
+			want: "",
+			werr: ErrIllegalFluxQuery,
+		},
 	}
 	for _, tt := range tests {
 		got, err := ParseQueryBucket(tt.have)
-		if err != tt.werr || got != tt.want {
+		if !errors.Is(err, tt.werr) || got != tt.want {
 			t.Errorf("%v: got %v, %v, want %v, %v", tt.name, got, err, tt.want, tt.werr)
 			continue
 		}
@@ -141,10 +177,49 @@ data() |> filter(fn: (r) => r._measurement == "m1")`,
 |> filter(fn: (r) => r["_measurement"] == "example-measurement")`,
 			want: "example-measurement",
 		},
+		{
+			name: "test13",
+			have: `import "strings"
+from(bucket: "example-bucket")
+    |> range(start: -1h)
+    // |> filter(fn: (r) => r._measurement == "commented")
+    |> filter(fn: (r) => r._field == "f0" and r._measurement == "example-measurement" and r.host =~ /^web\/[0-9]+$/)
+    |> map(fn: (r) => ({r with label: "${r.host}: _measurement"}))`,
+			want: "example-measurement",
+		},
+		{
+			name: "test14",
+			have: `m = "example-measurement"
+from(bucket: "example-bucket") |> filter(fn: (r) => m == r._measurement)`,
+			want: "example-measurement",
+		},
+		{
+			name: "test15",
+			have: `from(bucket: "example-bucket") |> filter(fn: (r) => r._measurement == "m0" or r._measurement == "m1")`,
+			want: "",
+			werr: ErrMultiMeasurements,
+		},
+		{
+			name: "test16",
+			have: `from(bucket: "example-bucket") |> filter(fn: (r) => not r._measurement == "m0")`,
+			want: "",
+			werr: ErrEqualMeasurement,
+		},
+		{
+			name: "test17",
+			have: `from(bucket: "example-bucket") |> filter(fn: (r) => contains(value: r._measurement, set: ["m0"]))`,
+			want: "m0",
+		},
+		{
+			name: "test18",
+			have: `from(bucket: "example-bucket") |> filter(fn: (r) => r._measurement =~ /m.*/)`,
+			want: "",
+			werr: ErrEqualMeasurement,
+		},
 	}
 	for _, tt := range tests {
 		got, err := ParseQueryMeasurement(tt.have)
-		if err != tt.werr || got != tt.want {
+		if !errors.Is(err, tt.werr) || got != tt.want {
 			t.Errorf("%v: got %v, %v, want %v, %v", tt.name, got, err, tt.want, tt.werr)
 			continue
 		}
@@ -255,3 +330,147 @@ func TestParseSpecMeasurement(t *testing.T) {
 		}
 	}
 }
+
+func TestParseFluxError(t *testing.T) {
+	tests := map[string]string{
+		`from(bucket: "b") |> range(start: -1h`:                              "illegal flux query: loc 1:22-1:38: expected RPAREN, got EOF",
+		"from(bucket: \"b\")\n  |> filter(fn: (r) => r._measurement == \"m)": "illegal flux query: loc 2:6-2:45: expected RPAREN, got EOF",
+		"from(bucket: \"b\")\n  |> 1h":                                       "illegal flux query: loc 2:6-2:8: pipe destination must be a function call",
+	}
+	for query, want := range tests {
+		if _, err := ParseFluxQuery(query); err == nil || err.Error() != want {
+			t.Errorf("error wrong: %q, %v != %s", query, err, want)
+		}
+	}
+}
+
+func TestFluxQuerySources(t *testing.T) {
+	tests := []struct {
+		name     string
+		have     string
+		buckets  []string
+		measures []string
+		werr     error
+	}{
+		{
+			name:     "test1",
+			have:     `from(bucket: "b0") |> range(start: -1h) |> filter(fn: (r) => r._measurement == "cpu" or r._measurement == "mem")`,
+			buckets:  []string{"b0"},
+			measures: []string{"cpu", "mem"},
+		},
+		{
+			name: "test2",
+			have: `union(tables: [
+    from(bucket: "b0") |> range(start: -1h) |> filter(fn: (r) => r._measurement == "cpu"),
+    from(bucket: "b1") |> range(start: -1h) |> filter(fn: (r) => r._measurement == "mem"),
+])`,
+			buckets:  []string{"b0", "b1"},
+			measures: []string{"cpu", "mem"},
+		},
+		{
+			name: "test3",
+			have: `from(bucket: "b0") |> range(start: -1h)`,
+			werr: ErrGetMeasurement,
+		},
+		{
+			name: "test4",
+			have: `from(bucket: "b0") |> filter(fn: (r) => r._measurement == "cpu" or r._measurement != "mem")`,
+			werr: ErrEqualMeasurement,
+		},
+	}
+	for _, tt := range tests {
+		fq, err := ParseFluxQuery(tt.have)
+		if err != nil {
+			t.Errorf("%v: parse error %v", tt.name, err)
+			continue
+		}
+		buckets, measures, err := fq.Sources()
+		if !errors.Is(err, tt.werr) || !reflect.DeepEqual(buckets, tt.buckets) || !reflect.DeepEqual(measures, tt.measures) {
+			t.Errorf("%v: got %v, %v, %v, want %v, %v, %v", tt.name, buckets, measures, err, tt.buckets, tt.measures, tt.werr)
+		}
+	}
+}
+
+func TestFluxQueryCheckMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		have string
+		want string
+	}{
+		{
+			name: "filter",
+			have: `from(bucket: "b0") |> range(start: -1h) |> filter(fn: (r) => r._measurement == "cpu" and strings.hasPrefix(v: r.host, prefix: "h")) |> keep(columns: ["_time", "_value"])`,
+		},
+		{
+			name: "union",
+			have: `union(tables: [from(bucket: "b0") |> range(start: -1h), from(bucket: "b1") |> range(start: -1h)]) |> yield(name: "u")`,
+		},
+		{
+			name: "defined function",
+			have: `f = (tables=<-) => tables |> limit(n: 10)
+from(bucket: "b0") |> range(start: -1h) |> f()`,
+		},
+		{
+			name: "aggregate",
+			have: `from(bucket: "b0") |> range(start: -1h) |> sum()`,
+			want: "sum",
+		},
+		{
+			name: "group",
+			have: `from(bucket: "b0") |> range(start: -1h) |> group(columns: ["host"]) |> limit(n: 1)`,
+			want: "group",
+		},
+		{
+			name: "join",
+			have: `a = from(bucket: "b0") |> range(start: -1h)
+b = from(bucket: "b1") |> range(start: -1h)
+join(tables: {a: a, b: b}, on: ["_time"])`,
+			want: "join",
+		},
+		{
+			name: "aggregate in defined function",
+			have: `f = (tables=<-) => tables |> mean()
+from(bucket: "b0") |> range(start: -1h) |> f()`,
+			want: "mean",
+		},
+		{
+			name: "package function",
+			have: `from(bucket: "b0") |> range(start: -1h) |> v1.fieldsAsCols()`,
+			want: "v1.fieldsAsCols",
+		},
+	}
+	for _, tt := range tests {
+		fq, err := ParseFluxQuery(tt.have)
+		if err != nil {
+			t.Errorf("%v: parse error %v", tt.name, err)
+			continue
+		}
+		err = fq.CheckMerge()
+		if tt.want == "" && err != nil || tt.want != "" && (!errors.Is(err, ErrIllegalFluxQuery) || !strings.Contains(err.Error(), " "+tt.want+"()")) {
+			t.Errorf("%v: got %v, want function %q rejected", tt.name, err, tt.want)
+		}
+	}
+
+	spec := &Spec{Operations: []*Operation{{Kind: "influxDBFrom"}, {Kind: "range"}, {Kind: "filter"}}}
+	if err := spec.CheckMerge(); err != nil {
+		t.Errorf("spec rejected: %v", err)
+	}
+	spec.Operations = append(spec.Operations, &Operation{Kind: "sum"})
+	if err := spec.CheckMerge(); err == nil {
+		t.Error("spec with sum should be rejected")
+	}
+}
+
+func TestConcatFluxTables(t *testing.T) {
+	b0 := "#datatype,string,long,string,double\r\n#group,false,false,true,false\r\n#default,_result,,,\r\n,result,table,_measurement,_value\r\n,,0,cpu,1\r\n,,1,cpu,2\r\n\r\n"
+	b1 := ",result,table,_measurement,_value\r\n,_result,0,mem,3\r\n,_result,0,mem,4\r\n\r\n,result,table,_measurement,_field\r\n,_result,1,mem,\"a\r\n\r\nb\"\r\n\r\n"
+	want := "#datatype,string,long,string,double\r\n#group,false,false,true,false\r\n#default,_result,,,\r\n,result,table,_measurement,_value\r\n,,0,cpu,1\r\n,,1,cpu,2\r\n\r\n" +
+		",result,table,_measurement,_value\r\n,_result,2,mem,3\r\n,_result,2,mem,4\r\n\r\n,result,table,_measurement,_field\r\n,_result,3,mem,\"a\r\n\r\nb\"\r\n\r\n"
+	got, err := ConcatFluxTables([][]byte{[]byte(b0), []byte(b1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
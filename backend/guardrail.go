@@ -0,0 +1,129 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/influxdata/influxql"
+)
+
+// GuardrailAll is the database key of the guardrail applied to databases without their own guardrail
+const GuardrailAll = "*"
+
+type GuardrailConfig struct {
+	Database         string `mapstructure:"database"`
+	RequireTimeRange bool   `mapstructure:"require_time_range"`
+	MaxTimeRange     int    `mapstructure:"max_time_range"`
+	MaxSelectFields  int    `mapstructure:"max_select_fields"`
+	// MaxPointsPerSeries and MaxSeries truncate the results by rewriting limit and slimit rather than reject the query,
+	// so a query over many series may still return up to MaxPointsPerSeries * MaxSeries points
+	MaxPointsPerSeries int `mapstructure:"max_points_per_series"`
+	MaxSeries          int `mapstructure:"max_series"`
+}
+
+// GetGuardrail returns the guardrail of the database, or nil if there is none
+func (ip *Proxy) GetGuardrail(db string) *GuardrailConfig {
+	if g, ok := ip.guardrails[db]; ok {
+		return g
+	}
+	return ip.guardrails[GuardrailAll]
+}
+
+// CheckGuardrail rejects a select statement violating the guardrail of the database,
+// or returns a request rewritten to cap the points per series and the series by limit and slimit
+func CheckGuardrail(req *http.Request, ip *Proxy, stmt *influxql.SelectStatement, db string) (*http.Request, error) {
+	g := ip.GetGuardrail(db)
+	if g == nil {
+		return req, nil
+	}
+	if err := g.checkStatement(ip, stmt, db, influxql.TimeRange{}, time.Now()); err != nil {
+		return nil, err
+	}
+	rewritten := false
+	if g.MaxPointsPerSeries > 0 && (stmt.Limit == 0 || stmt.Limit > g.MaxPointsPerSeries) {
+		stmt.Limit = g.MaxPointsPerSeries
+		rewritten = true
+	}
+	if g.MaxSeries > 0 && (stmt.SLimit == 0 || stmt.SLimit > g.MaxSeries) {
+		stmt.SLimit = g.MaxSeries
+		rewritten = true
+	}
+	if !rewritten {
+		return req, nil
+	}
+	cr := CloneQueryRequest(req)
+	cr.Form.Set("q", stmt.String())
+	return cr, nil
+}
+
+// CheckGuardrailQuery checks a select statement against the guardrail of the database like CheckGuardrail,
+// and rejects the statement which cannot be parsed and so cannot be checked
+func CheckGuardrailQuery(req *http.Request, ip *Proxy, db string) (*http.Request, error) {
+	if ip.GetGuardrail(db) == nil {
+		return req, nil
+	}
+	st, err := influxql.ParseStatement(req.FormValue("q"))
+	if err != nil {
+		return nil, fmt.Errorf("query rejected by guardrail of database %s: statement cannot be checked: %s", db, err)
+	}
+	stmt, ok := st.(*influxql.SelectStatement)
+	if !ok {
+		return req, nil
+	}
+	return CheckGuardrail(req, ip, stmt, db)
+}
+
+// checkStatement checks the time range and the wildcard width of a statement and its subqueries recursively,
+// outer is the time range of the enclosing statement, which also bounds the subqueries in influxdb
+func (g *GuardrailConfig) checkStatement(ip *Proxy, stmt *influxql.SelectStatement, db string, outer influxql.TimeRange, now time.Time) error {
+	_, tr, err := influxql.ConditionExpr(stmt.Condition, &influxql.NowValuer{Now: now})
+	if err != nil {
+		return err
+	}
+	tr = tr.Intersect(outer)
+	var sources influxql.Sources
+	for _, src := range stmt.Sources {
+		switch src := src.(type) {
+		case *influxql.Measurement:
+			sources = append(sources, src)
+		case *influxql.SubQuery:
+			if err = g.checkStatement(ip, src.Statement, db, tr, now); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("query rejected by guardrail of database %s: source %s cannot be checked", db, src)
+		}
+	}
+	if len(sources) == 0 {
+		return nil
+	}
+	if g.RequireTimeRange || g.MaxTimeRange > 0 {
+		if tr.Min.IsZero() {
+			return fmt.Errorf("query rejected by guardrail of database %s: a lower time bound is required", db)
+		}
+		max := tr.Max
+		if max.IsZero() {
+			max = now
+		}
+		if limit := time.Duration(g.MaxTimeRange) * time.Second; limit > 0 && max.Sub(tr.Min) > limit {
+			return fmt.Errorf("query rejected by guardrail of database %s: time range %s exceeds %s", db, max.Sub(tr.Min), limit)
+		}
+	}
+	if g.MaxSelectFields > 0 && stmt.HasFieldWildcard() {
+		measurements, err := ExpandSources(ip, sources, db)
+		if err != nil {
+			return err
+		}
+		for _, m := range measurements {
+			if n := len(ip.getFieldTypes(getSourceDatabase(m, db), m.RetentionPolicy, m.Name)); n > g.MaxSelectFields {
+				return fmt.Errorf("query rejected by guardrail of database %s: select * on measurement %s with %d fields exceeds %d", db, m.Name, n, g.MaxSelectFields)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+)
+
+func TestCheckGuardrail(t *testing.T) {
+	ip := &Proxy{guardrails: map[string]*GuardrailConfig{
+		"db":         {Database: "db", RequireTimeRange: true, MaxTimeRange: 86400, MaxPointsPerSeries: 1000, MaxSeries: 10},
+		GuardrailAll: {Database: GuardrailAll, MaxSeries: 100},
+	}}
+	tests := []struct {
+		name string
+		db   string
+		q    string
+		err  bool
+		want string
+	}{
+		{"no time", "db", "select value from cpu", true, ""},
+		{"upper bound only", "db", "select value from cpu where time < now()", true, ""},
+		{"too long", "db", "select value from cpu where time > now() - 2d", true, ""},
+		{"too long past", "db", "select value from cpu where time > '2021-01-01T00:00:00Z' and time < '2021-01-03T00:00:00Z'", true, ""},
+		{"rewrite", "db", "select value from cpu where time > now() - 1h", false, "SELECT value FROM cpu WHERE time > now() - 1h LIMIT 1000 SLIMIT 10"},
+		{"smaller limit", "db", "select value from cpu where time > now() - 1h limit 10 slimit 5", false, "select value from cpu where time > now() - 1h limit 10 slimit 5"},
+		{"default", "db2", "select value from cpu", false, "SELECT value FROM cpu SLIMIT 100"},
+		{"subquery no time", "db", "select max(value) from (select value from cpu)", true, ""},
+		{"subquery too long", "db", "select max(value) from (select value from cpu where time > now() - 2d)", true, ""},
+		{"subquery inner time", "db", "select max(value) from (select value from cpu where time > now() - 1h)", false, "SELECT max(value) FROM (SELECT value FROM cpu WHERE time > now() - 1h) LIMIT 1000 SLIMIT 10"},
+		{"subquery outer time", "db", "select max(value) from (select value from cpu where time > now() - 2d) where time > now() - 1h", false, "SELECT max(value) FROM (SELECT value FROM cpu WHERE time > now() - 2d) WHERE time > now() - 1h LIMIT 1000 SLIMIT 10"},
+		{"nested subquery", "db", "select max(v) from (select value as v from (select value from cpu)) where time > now() - 2d", true, ""},
+		{"unparsable", "db", "select value from", true, ""},
+		{"show", "db", "show tag keys from cpu", false, "show tag keys from cpu"},
+	}
+	for _, tt := range tests {
+		req, err := CheckGuardrailQuery(NewQueryRequest("GET", tt.db, tt.q, ""), ip, tt.db)
+		if (err != nil) != tt.err {
+			t.Errorf("%v: error %v, expected error %v", tt.name, err, tt.err)
+			continue
+		}
+		if err == nil && req.FormValue("q") != tt.want {
+			t.Errorf("%v: query %q, expected %q", tt.name, req.FormValue("q"), tt.want)
+		}
+	}
+
+	ip = &Proxy{guardrails: map[string]*GuardrailConfig{"db": {Database: "db", RequireTimeRange: true}}}
+	q := "select value from cpu"
+	stmt, _ := ParseSelectStatement(q)
+	if _, err := CheckGuardrail(NewQueryRequest("GET", "db2", q, ""), ip, stmt, "db2"); err != nil {
+		t.Errorf("database without guardrail rejected: %v", err)
+	}
+}
@@ -7,12 +7,13 @@ package backend
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
@@ -20,20 +21,28 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/chengshiwen/influx-proxy/logging"
+	"github.com/chengshiwen/influx-proxy/tracing"
 	"github.com/chengshiwen/influx-proxy/util"
+	"go.uber.org/zap"
 )
 
 var (
-	ErrBadRequest   = errors.New("bad request")
-	ErrUnauthorized = errors.New("unauthorized")
-	ErrNotFound     = errors.New("not found")
-	ErrInternal     = errors.New("internal error")
-	ErrUnknown      = errors.New("unknown error")
+	ErrBadRequest    = errors.New("bad request")
+	ErrUnauthorized  = errors.New("unauthorized")
+	ErrNotFound      = errors.New("not found")
+	ErrInternal      = errors.New("internal error")
+	ErrUnknown       = errors.New("unknown error")
+	ErrUnsupportedV2 = errors.New("unsupported by influxdb v2 backend")
 )
 
 const (
 	HeaderQueryOrigin = "Query-Origin"
 	QueryParallel     = "Parallel"
+	QueryStatements   = "Statements"
+	QueryCached       = "Cached"
+	QuerySelectInto   = "SelectInto"
+	DefaultChunkSize  = 10000
 )
 
 type QueryResult struct {
@@ -57,6 +66,10 @@ type HttpBackend struct { // nolint:golint
 	rewriting   atomic.Value
 	transferIn  atomic.Value
 	writeOnly   bool
+	v2          bool
+	org         string
+	token       string
+	buckets     map[string]string
 }
 
 func NewHttpBackend(cfg *BackendConfig, pxcfg *ProxyConfig) (hb *HttpBackend) { // nolint:golint
@@ -76,6 +89,13 @@ func NewSimpleHttpBackend(cfg *BackendConfig) (hb *HttpBackend) { // nolint:goli
 		password:    cfg.Password,
 		authEncrypt: cfg.AuthEncrypt,
 		writeOnly:   cfg.WriteOnly,
+		v2:          cfg.Type == BackendTypeV2,
+		org:         cfg.Org,
+		token:       cfg.Token,
+		buckets:     make(map[string]string),
+	}
+	for _, m := range cfg.DBRPMappings {
+		hb.buckets[m.Database+"/"+m.RetentionPolicy] = m.Bucket
 	}
 	hb.running.Store(true)
 	hb.active.Store(true)
@@ -136,6 +156,29 @@ func Compress(buf *bytes.Buffer, p []byte) (err error) {
 	return
 }
 
+// CopyFlush copies src to w and flushes each chunk to the client immediately
+func CopyFlush(w http.ResponseWriter, src io.Reader) (err error) {
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			if _, err = w.Write(buf[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
 func CopyHeader(dst, src http.Header) {
 	for k, vv := range src {
 		for _, v := range vv {
@@ -158,7 +201,12 @@ func (hb *HttpBackend) SetBasicAuth(req *http.Request) {
 
 func (hb *HttpBackend) SetTokenAuth(req *http.Request) {
 	var auth string
-	if hb.authEncrypt {
+	if hb.v2 {
+		auth = "Token " + hb.token
+		if hb.authEncrypt {
+			auth = "Token " + util.AesDecrypt(hb.token)
+		}
+	} else if hb.authEncrypt {
 		auth = fmt.Sprintf("Token %s:%s", util.AesDecrypt(hb.username), util.AesDecrypt(hb.password))
 	} else {
 		auth = fmt.Sprintf("Token %s:%s", hb.username, hb.password)
@@ -166,13 +214,66 @@ func (hb *HttpBackend) SetTokenAuth(req *http.Request) {
 	req.Header.Set("Authorization", auth)
 }
 
+// setAuth authorizes the requests of influxql and line protocol, v2 backends accept the token by their v1 compatibility api
+func (hb *HttpBackend) setAuth(req *http.Request) {
+	if hb.v2 {
+		hb.SetTokenAuth(req)
+	} else if hb.username != "" || hb.password != "" {
+		hb.SetBasicAuth(req)
+	}
+}
+
+// Bucket returns the bucket of a v2 backend mapped from db and rp, which is named db/rp, or db without rp, by default
+func (hb *HttpBackend) Bucket(db, rp string) string {
+	if bucket, ok := hb.buckets[db+"/"+rp]; ok {
+		return bucket
+	}
+	if rp == "" {
+		return db
+	}
+	return db + "/" + rp
+}
+
+// DBRP returns the db and rp of the bucket mapped from db and rp, which influxdb 2.x resolves by the virtual dbrp mapping
+// of the bucket, so that influxql reads the bucket of the writes, a bucket db/rp is db and rp, and another bucket
+// is a db with the default rp
+func (hb *HttpBackend) DBRP(db, rp string) (string, string) {
+	bucket := hb.Bucket(db, rp)
+	if i := strings.IndexByte(bucket, '/'); i >= 0 {
+		return bucket[:i], bucket[i+1:]
+	}
+	return bucket, ""
+}
+
+func (hb *HttpBackend) IsV2() bool {
+	return hb.v2
+}
+
 func (hb *HttpBackend) CheckActive() {
 	for hb.running.Load().(bool) {
-		hb.active.Store(hb.Ping())
+		active := hb.Ping()
+		hb.active.Store(active)
+		if active {
+			backendUp.WithLabelValues(hb.Name).Set(1)
+			healthChecks.WithLabelValues(hb.Name, "pass").Inc()
+		} else {
+			backendUp.WithLabelValues(hb.Name).Set(0)
+			healthChecks.WithLabelValues(hb.Name, "fail").Inc()
+		}
 		time.Sleep(time.Duration(hb.interval) * time.Second)
 	}
 }
 
+// logger returns the logger with the fields of the backend
+func (hb *HttpBackend) logger() *zap.Logger {
+	return logging.L().With(logging.Backend(hb.Name), logging.URL(hb.Url))
+}
+
+// reqLogger returns the logger with the fields of the backend and the request id of req
+func (hb *HttpBackend) reqLogger(req *http.Request) *zap.Logger {
+	return logging.FromContext(req.Context()).With(logging.Backend(hb.Name), logging.URL(hb.Url))
+}
+
 func (hb *HttpBackend) IsActive() (b bool) {
 	return hb.active.Load().(bool)
 }
@@ -196,12 +297,12 @@ func (hb *HttpBackend) IsWriteOnly() (b bool) {
 func (hb *HttpBackend) Ping() bool {
 	resp, err := hb.client.Get(hb.Url + "/ping")
 	if err != nil {
-		log.Print("http error: ", err)
+		hb.logger().Warn("ping http error", zap.Error(err))
 		return false
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 204 {
-		log.Printf("ping status code: %d, the backend is %s", resp.StatusCode, hb.Url)
+		hb.logger().Warn("ping status code error", zap.Int("status", resp.StatusCode))
 		return false
 	}
 	return true
@@ -211,32 +312,42 @@ func (hb *HttpBackend) Write(db, rp string, p []byte) (err error) {
 	var buf bytes.Buffer
 	err = Compress(&buf, p)
 	if err != nil {
-		log.Print("compress error: ", err)
+		hb.logger().Error("compress error", zap.Error(err), logging.DB(db), logging.RP(rp))
 		return
 	}
-	return hb.WriteStream(db, rp, &buf, true)
+	return hb.WriteStream(context.Background(), db, rp, &buf, true)
 }
 
-func (hb *HttpBackend) WriteCompressed(db, rp string, p []byte) (err error) {
+func (hb *HttpBackend) WriteCompressed(ctx context.Context, db, rp string, p []byte) (err error) {
 	buf := bytes.NewBuffer(p)
-	return hb.WriteStream(db, rp, buf, true)
+	return hb.WriteStream(ctx, db, rp, buf, true)
 }
 
-func (hb *HttpBackend) WriteStream(db, rp string, stream io.Reader, compressed bool) (err error) {
+func (hb *HttpBackend) WriteStream(ctx context.Context, db, rp string, stream io.Reader, compressed bool) (err error) {
 	q := url.Values{}
-	q.Set("db", db)
-	q.Set("rp", rp)
-	req, err := http.NewRequest("POST", hb.Url+"/write?"+q.Encode(), stream)
-	if hb.username != "" || hb.password != "" {
-		hb.SetBasicAuth(req)
+	path := "/write?"
+	if hb.v2 {
+		q.Set("org", hb.org)
+		q.Set("bucket", hb.Bucket(db, rp))
+		q.Set("precision", "ns")
+		path = "/api/v2/write?"
+	} else {
+		q.Set("db", db)
+		q.Set("rp", rp)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", hb.Url+path+q.Encode(), stream)
+	if err != nil {
+		hb.logger().Error("internal request error", zap.Error(err), logging.DB(db), logging.RP(rp))
+		return
 	}
+	hb.setAuth(req)
 	if compressed {
 		req.Header.Add("Content-Encoding", "gzip")
 	}
 
-	resp, err := hb.client.Do(req)
+	resp, err := tracing.RoundTrip(hb.client.Do, req, "HttpBackend.Write", tracing.Backend(hb.Name), tracing.URL(hb.Url), tracing.DB(db), tracing.RP(rp))
 	if err != nil {
-		log.Print("http error: ", err)
+		hb.logger().Warn("write http error", zap.Error(err), logging.DB(db), logging.RP(rp))
 		hb.active.Store(false)
 		return
 	}
@@ -245,14 +356,12 @@ func (hb *HttpBackend) WriteStream(db, rp string, stream io.Reader, compressed b
 	if resp.StatusCode == 204 {
 		return
 	}
-	log.Printf("write status code: %d, from: %s", resp.StatusCode, hb.Url)
-
 	respbuf, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Print("readall error: ", err)
+		hb.logger().Warn("write read body error", zap.Error(err), zap.Int("status", resp.StatusCode), logging.DB(db), logging.RP(rp))
 		return
 	}
-	log.Printf("error response: %s", respbuf)
+	hb.logger().Warn("write status code error", zap.Int("status", resp.StatusCode), zap.ByteString("response", bytes.TrimSpace(respbuf)), logging.DB(db), logging.RP(rp))
 
 	switch resp.StatusCode {
 	case 400:
@@ -272,25 +381,33 @@ func (hb *HttpBackend) WriteStream(db, rp string, stream io.Reader, compressed b
 	return
 }
 
-func (hb *HttpBackend) ReadProm(req *http.Request, w http.ResponseWriter) (err error) {
-	if len(req.Form) == 0 {
-		req.Form = url.Values{}
-	}
-	req.Form.Del("u")
-	req.Form.Del("p")
-	if hb.username != "" || hb.password != "" {
-		hb.SetBasicAuth(req)
+func (hb *HttpBackend) roundTripFlux(req *http.Request) (resp *http.Response, err error) {
+	if hb.v2 || hb.username != "" || hb.password != "" {
+		hb.SetTokenAuth(req)
 	}
 
-	req.URL, err = url.Parse(hb.Url + "/api/v1/prom/read?" + req.Form.Encode())
+	path := "/api/v2/query"
+	if hb.v2 {
+		path += "?" + url.Values{"org": []string{hb.org}}.Encode()
+	}
+	req.URL, err = url.Parse(hb.Url + path)
 	if err != nil {
-		log.Print("internal url parse error: ", err)
+		hb.reqLogger(req).Error("internal url parse error", zap.Error(err))
 		return
 	}
 
-	resp, err := hb.transport.RoundTrip(req)
+	start := time.Now()
+	resp, err = tracing.RoundTrip(hb.transport.RoundTrip, req, "HttpBackend.QueryFlux", tracing.Backend(hb.Name), tracing.URL(hb.Url))
+	observeQuery("flux", hb.Name, start)
+	if err != nil {
+		hb.reqLogger(req).Warn("flux query error", zap.Error(err))
+	}
+	return
+}
+
+func (hb *HttpBackend) QueryFlux(req *http.Request, w http.ResponseWriter) (err error) {
+	resp, err := hb.roundTripFlux(req)
 	if err != nil {
-		log.Printf("prometheus read error: %s", err)
 		return
 	}
 	defer resp.Body.Close()
@@ -299,72 +416,133 @@ func (hb *HttpBackend) ReadProm(req *http.Request, w http.ResponseWriter) (err e
 
 	p, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("prometheus read body error: %s", err)
+		hb.reqLogger(req).Warn("flux read body error", zap.Error(err))
 		return
 	}
-
 	w.WriteHeader(resp.StatusCode)
 	_, err = w.Write(p)
 	return
 }
 
-func (hb *HttpBackend) QueryFlux(req *http.Request, w http.ResponseWriter) (err error) {
-	if hb.username != "" || hb.password != "" {
-		hb.SetTokenAuth(req)
-	}
-
-	req.URL, err = url.Parse(hb.Url + "/api/v2/query")
-	if err != nil {
-		log.Print("internal url parse error: ", err)
-		return
-	}
-
-	resp, err := hb.transport.RoundTrip(req)
+// QueryFluxBody returns the decompressed annotated csv of a flux query instead of writing it to the client,
+// an error status of the backend is returned as error
+func (hb *HttpBackend) QueryFluxBody(req *http.Request) (qr *QueryResult) {
+	qr = &QueryResult{}
+	resp, err := hb.roundTripFlux(req)
 	if err != nil {
-		log.Printf("flux query error: %s", err)
+		qr.Err = err
 		return
 	}
 	defer resp.Body.Close()
 
-	CopyHeader(w.Header(), resp.Header)
+	respBody := resp.Body
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		b, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			qr.Err = err
+			hb.reqLogger(req).Warn("unable to decode gzip body", zap.Error(err))
+			return
+		}
+		defer b.Close()
+		respBody = b
+	}
 
-	p, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("flux read body error: %s", err)
+	qr.Body, qr.Err = ioutil.ReadAll(respBody)
+	if qr.Err != nil {
+		hb.reqLogger(req).Warn("flux read body error", zap.Error(qr.Err))
 		return
 	}
-	w.WriteHeader(resp.StatusCode)
-	_, err = w.Write(p)
+	if resp.StatusCode >= 400 {
+		var fe struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(qr.Body, &fe) != nil || fe.Message == "" {
+			fe.Message = fmt.Sprintf("flux query status code: %d", resp.StatusCode)
+		}
+		qr.Err = errors.New(fe.Message)
+	}
+	qr.Header = resp.Header
+	qr.Status = resp.StatusCode
 	return
 }
 
-func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompress bool) (qr *QueryResult) {
-	qr = &QueryResult{}
+func (hb *HttpBackend) roundTripQuery(req *http.Request) (resp *http.Response, err error) {
 	if len(req.Form) == 0 {
 		req.Form = url.Values{}
 	}
 	req.Form.Del("u")
 	req.Form.Del("p")
-	req.ContentLength = 0
-	if hb.username != "" || hb.password != "" {
-		hb.SetBasicAuth(req)
+	if db := req.Form.Get("db"); hb.v2 && db != "" {
+		db, rp := hb.DBRP(db, req.Form.Get("rp"))
+		req.Form.Set("db", db)
+		if rp != "" {
+			req.Form.Set("rp", rp)
+		} else {
+			req.Form.Del("rp")
+		}
 	}
+	req.ContentLength = 0
+	hb.setAuth(req)
 
-	req.URL, qr.Err = url.Parse(hb.Url + "/query?" + req.Form.Encode())
-	if qr.Err != nil {
-		log.Print("internal url parse error: ", qr.Err)
+	req.URL, err = url.Parse(hb.Url + "/query?" + req.Form.Encode())
+	if err != nil {
+		hb.reqLogger(req).Error("internal url parse error", zap.Error(err))
 		return
 	}
 
-	q := strings.TrimSpace(req.FormValue("q"))
-	resp, err := hb.transport.RoundTrip(req)
+	start := time.Now()
+	resp, err = tracing.RoundTrip(hb.transport.RoundTrip, req, "HttpBackend.Query", tracing.Backend(hb.Name), tracing.URL(hb.Url),
+		tracing.Query(req.Form.Get("q")), tracing.DB(req.Form.Get("db")))
+	observeQuery(StatementType(req.Form.Get("q")), hb.Name, start)
 	if err != nil {
 		if req.Header.Get(HeaderQueryOrigin) != QueryParallel || err.Error() != "context canceled" {
-			qr.Err = err
-			log.Printf("query error: %s, the query is %s", err, q)
+			hb.reqLogger(req).Warn("query error", zap.Error(err), logging.Query(strings.TrimSpace(req.FormValue("q"))), logging.DB(req.FormValue("db")))
+		} else {
+			err = nil
+		}
+	}
+	return
+}
+
+// QueryStream relays the response body to w as it arrives instead of buffering it,
+// unless the backend responds with an error status which allows the caller to fail over
+func (hb *HttpBackend) QueryStream(req *http.Request, w http.ResponseWriter) (qr *QueryResult) {
+	qr = &QueryResult{}
+	resp, err := hb.roundTripQuery(req)
+	if err != nil || resp == nil {
+		qr.Err = err
+		return
+	}
+	defer resp.Body.Close()
+	qr.Header = resp.Header
+	qr.Status = resp.StatusCode
+	if resp.StatusCode >= 400 {
+		var p []byte
+		p, qr.Err = ioutil.ReadAll(resp.Body)
+		if qr.Err == nil {
+			rsp, _ := ResponseFromResponseBytes(p)
+			qr.Err = errors.New(rsp.Err)
 		}
 		return
 	}
+
+	CopyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	// the header has been sent, so a broken stream cannot fail over to another backend
+	if err = CopyFlush(w, resp.Body); err != nil {
+		hb.reqLogger(req).Warn("stream body error", zap.Error(err), logging.Query(strings.TrimSpace(req.FormValue("q"))), logging.DB(req.FormValue("db")))
+	}
+	return
+}
+
+func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompress bool) (qr *QueryResult) {
+	qr = &QueryResult{}
+	q := strings.TrimSpace(req.FormValue("q"))
+	resp, err := hb.roundTripQuery(req)
+	if err != nil || resp == nil {
+		qr.Err = err
+		return
+	}
 	defer resp.Body.Close()
 	if w != nil {
 		CopyHeader(w.Header(), resp.Header)
@@ -375,7 +553,7 @@ func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompres
 		b, err := gzip.NewReader(resp.Body)
 		if err != nil {
 			qr.Err = err
-			log.Printf("unable to decode gzip body: %s", err)
+			hb.reqLogger(req).Warn("unable to decode gzip body", zap.Error(err), logging.Query(q))
 			return
 		}
 		defer b.Close()
@@ -384,7 +562,7 @@ func (hb *HttpBackend) Query(req *http.Request, w http.ResponseWriter, decompres
 
 	qr.Body, qr.Err = ioutil.ReadAll(respBody)
 	if qr.Err != nil {
-		log.Printf("read body error: %s, the query is %s", qr.Err, q)
+		hb.reqLogger(req).Warn("read body error", zap.Error(qr.Err), logging.Query(q), logging.DB(req.FormValue("db")))
 		return
 	}
 	if resp.StatusCode >= 400 {
@@ -0,0 +1,97 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHttpBackendBucket(t *testing.T) {
+	hb := NewSimpleHttpBackend(&BackendConfig{
+		Name:  "v2",
+		Type:  BackendTypeV2,
+		Org:   "org",
+		Token: "token",
+		DBRPMappings: []*DBRPMapping{
+			{Database: "db", Bucket: "db-default"},
+			{Database: "db", RetentionPolicy: "week", Bucket: "db-week"},
+		},
+	})
+	tests := [][3]string{
+		{"db", "", "db-default"},
+		{"db", "week", "db-week"},
+		{"db", "autogen", "db/autogen"},
+		{"other", "", "other"},
+	}
+	for _, tt := range tests {
+		if got := hb.Bucket(tt[0], tt[1]); got != tt[2] {
+			t.Errorf("bucket of %s/%s: got %s, want %s", tt[0], tt[1], got, tt[2])
+		}
+	}
+}
+
+func TestHttpBackendQueryV2(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer server.Close()
+
+	hb := NewSimpleHttpBackend(&BackendConfig{
+		Name:  "v2",
+		Url:   server.URL,
+		Type:  BackendTypeV2,
+		Token: "token",
+		DBRPMappings: []*DBRPMapping{
+			{Database: "db", Bucket: "db-default"},
+			{Database: "db", RetentionPolicy: "week", Bucket: "metrics/week"},
+		},
+	})
+	// the influxql reads the bucket of the writes by its virtual dbrp mapping
+	tests := [][4]string{
+		{"db", "", "db-default", ""},
+		{"db", "week", "metrics", "week"},
+		{"db", "autogen", "db", "autogen"},
+		{"other", "", "other", ""},
+	}
+	for _, tt := range tests {
+		req := NewQueryRequest("GET", tt[0], "select value from cpu", "")
+		if tt[1] != "" {
+			req.Form.Set("rp", tt[1])
+		}
+		if qr := hb.Query(req, nil, true); qr.Err != nil {
+			t.Fatal(qr.Err)
+		}
+		if q := got.URL.Query(); q.Get("db") != tt[2] || q.Get("rp") != tt[3] {
+			t.Errorf("dbrp of %s/%s: got %s/%s, want %s/%s", tt[0], tt[1], q.Get("db"), q.Get("rp"), tt[2], tt[3])
+		}
+	}
+}
+
+func TestHttpBackendWriteV2(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	hb := NewSimpleHttpBackend(&BackendConfig{Name: "v2", Url: server.URL, Type: BackendTypeV2, Org: "org", Token: "token"})
+	hb.client = server.Client()
+	if err := hb.Write("db", "rp", []byte("cpu value=1 1\n")); err != nil {
+		t.Fatal(err)
+	}
+	q := got.URL.Query()
+	if got.URL.Path != "/api/v2/write" || q.Get("org") != "org" || q.Get("bucket") != "db/rp" || q.Get("precision") != "ns" {
+		t.Errorf("write url wrong: %s", got.URL)
+	}
+	if auth := got.Header.Get("Authorization"); auth != "Token token" {
+		t.Errorf("write auth wrong: %s", auth)
+	}
+}
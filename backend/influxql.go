@@ -8,10 +8,12 @@ import (
 	"bufio"
 	"bytes"
 	"errors"
-	"log"
+	"regexp"
 	"strings"
 
+	"github.com/chengshiwen/influx-proxy/logging"
 	"github.com/chengshiwen/influx-proxy/util"
+	"go.uber.org/zap"
 )
 
 var SupportCmds = util.NewSet(
@@ -33,6 +35,16 @@ var SupportCmds = util.NewSet(
 	"drop measurement",
 )
 
+// CardinalityCmds maps each cardinality statement to the statement listing the values counted by its exact variant
+var CardinalityCmds = map[string]string{
+	"show series":      "show series",
+	"show measurement": "show measurements",
+	"show tag values":  "show tag values",
+	"show field key":   "show field keys",
+}
+
+var exactCardinalityRe = regexp.MustCompile(`(?i)^\s*show\s+(series|measurement|tag\s+values|field\s+key)\s+exact\s+cardinality\b`)
+
 var (
 	ErrWrongBackslash = errors.New("wrong backslash")
 	ErrUnmatchedQuote = errors.New("unmatched quote")
@@ -147,13 +159,13 @@ func ScanToken(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	case '"':
 		advance, token, err = FindEndWithQuote(data, start, '"')
 		if err != nil {
-			log.Printf("scan token error: %s", err)
+			logging.L().Debug("scan token error", zap.Error(err))
 		}
 		return
 	case '\'':
 		advance, token, err = FindEndWithQuote(data, start, '\'')
 		if err != nil {
-			log.Printf("scan token error: %s", err)
+			logging.L().Debug("scan token error", zap.Error(err))
 		}
 		return
 	case '(':
@@ -201,7 +213,7 @@ func ScanToken(data []byte, atEOF bool) (advance int, token []byte, err error) {
 		}
 	}
 	if err != nil {
-		log.Printf("scan token error: %s", err)
+		logging.L().Debug("scan token error", zap.Error(err))
 		return
 	}
 
@@ -225,6 +237,56 @@ func ScanTokens(q string, n int) (tokens []string) {
 	return
 }
 
+func SplitStatements(q string) (stmts []string) {
+	var quote byte
+	start := 0
+	for i := 0; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '/' && isRegexStart(q, i):
+			quote = c
+		case c == ';':
+			if stmt := strings.TrimSpace(q[start:i]); stmt != "" {
+				stmts = append(stmts, stmt)
+			}
+			start = i + 1
+		}
+	}
+	if stmt := strings.TrimSpace(q[start:]); stmt != "" {
+		stmts = append(stmts, stmt)
+	}
+	return
+}
+
+// isRegexStart reports whether the slash at q[i] opens a regex literal rather than a division
+func isRegexStart(q string, i int) bool {
+	j := i - 1
+	for j >= 0 && (q[j] == ' ' || q[j] == '\t' || q[j] == '\n') {
+		j--
+	}
+	if j < 0 {
+		return false
+	}
+	switch q[j] {
+	case '~', ',', '(':
+		return true
+	}
+	k := j
+	for k >= 0 && (q[k] >= 'a' && q[k] <= 'z' || q[k] >= 'A' && q[k] <= 'Z') {
+		k--
+	}
+	word := strings.ToLower(q[k+1 : j+1])
+	return word == "from" || word == "select" || word == "measurement"
+}
+
 func GetHeadStmtFromTokens(tokens []string, n int) string {
 	if n <= 0 || n > len(tokens) {
 		n = len(tokens)
@@ -367,12 +429,12 @@ func getMeasurement(tokens []string, keyword string) (mm string) {
 func CheckQuery(q string) (tokens []string, check bool, from bool) {
 	tokens = ScanTokens(q, 0)
 	stmt := strings.ToLower(tokens[0])
+	if user, _ := CheckUserFromTokens(tokens); user || CheckContinuousQueryFromTokens(tokens) != "" || CheckQueriesFromTokens(tokens) != "" {
+		return tokens, true, false
+	}
 	if stmt == "select" {
 		for i := 2; i < len(tokens); i++ {
 			stmt := strings.ToLower(tokens[i])
-			if stmt == "into" {
-				return tokens, false, false
-			}
 			if stmt == "from" {
 				return tokens, true, true
 			}
@@ -380,6 +442,9 @@ func CheckQuery(q string) (tokens []string, check bool, from bool) {
 		return tokens, false, false
 	}
 	if stmt == "show" {
+		if head, _ := CheckCardinalityFromTokens(tokens); head != "" {
+			return tokens, true, false
+		}
 		for i := 2; i < len(tokens); i++ {
 			stmt := strings.ToLower(tokens[i])
 			if stmt == "from" {
@@ -399,6 +464,91 @@ func CheckQuery(q string) (tokens []string, check bool, from bool) {
 	return tokens, false, false
 }
 
+func CheckFanOutFromTokens(tokens []string) bool {
+	if strings.ToLower(tokens[0]) != "select" {
+		return false
+	}
+	for i := 1; i < len(tokens)-1; i++ {
+		if strings.ToLower(tokens[i]) != "from" {
+			continue
+		}
+		j := i + 1
+		for ; j < len(tokens) && (j == i+1 || tokens[j] == "." || tokens[j-1] == "."); j++ {
+			if tokens[j][0] == '/' || tokens[j][0] != '"' && tokens[j][0] != '(' && strings.Contains(tokens[j], ",") {
+				return true
+			}
+		}
+		return j < len(tokens) && tokens[j] == ","
+	}
+	return false
+}
+
+// CheckUserFromTokens checks user and privilege statements, and whether it is show users or show grants
+func CheckUserFromTokens(tokens []string) (check bool, show bool) {
+	stmt := strings.ToLower(tokens[0])
+	stmt2 := GetHeadStmtFromTokens(tokens, 2)
+	show = stmt2 == "show users" || stmt2 == "show grants"
+	check = show || stmt == "grant" || stmt == "revoke" || stmt2 == "create user" || stmt2 == "drop user" || stmt2 == "set password"
+	return
+}
+
+func CheckSelectIntoFromTokens(tokens []string) bool {
+	if strings.ToLower(tokens[0]) != "select" {
+		return false
+	}
+	for i := 2; i < len(tokens); i++ {
+		stmt := strings.ToLower(tokens[i])
+		if stmt == "into" {
+			return true
+		}
+		if stmt == "from" {
+			return false
+		}
+	}
+	return false
+}
+
+// CheckQueriesFromTokens returns the head of a show queries or kill query statement
+func CheckQueriesFromTokens(tokens []string) string {
+	stmt := GetHeadStmtFromTokens(tokens, 2)
+	if stmt == "show queries" || stmt == "kill query" {
+		return stmt
+	}
+	return ""
+}
+
+// CheckContinuousQueryFromTokens returns the head of a continuous query statement
+func CheckContinuousQueryFromTokens(tokens []string) string {
+	stmt := GetHeadStmtFromTokens(tokens, 3)
+	if stmt == "create continuous query" || stmt == "drop continuous query" || stmt == "show continuous queries" {
+		return stmt
+	}
+	return ""
+}
+
+// CheckCardinalityFromTokens returns the head of a cardinality statement, such as show series, and whether it is exact
+func CheckCardinalityFromTokens(tokens []string) (head string, exact bool) {
+	for n := 2; n <= 3 && n < len(tokens); n++ {
+		stmt := GetHeadStmtFromTokens(tokens, n)
+		if _, ok := CardinalityCmds[stmt]; !ok {
+			continue
+		}
+		next := strings.ToLower(tokens[n])
+		if next == "cardinality" {
+			return stmt, false
+		}
+		if next == "exact" && n+1 < len(tokens) && strings.ToLower(tokens[n+1]) == "cardinality" {
+			return stmt, true
+		}
+	}
+	return "", false
+}
+
+// ExactCardinalityToList rewrites an exact cardinality statement into the statement listing the values to count
+func ExactCardinalityToList(q string, head string) string {
+	return exactCardinalityRe.ReplaceAllLiteralString(q, CardinalityCmds[head])
+}
+
 func CheckDatabaseFromTokens(tokens []string) (check bool, show bool, alter bool, db string) {
 	stmt := GetHeadStmtFromTokens(tokens, 2)
 	show = stmt == "show databases"
@@ -424,6 +574,10 @@ func CheckSelectOrShowFromTokens(tokens []string) (check bool) {
 	return
 }
 
+func CheckShowFromTokens(tokens []string) (check bool) {
+	return strings.ToLower(tokens[0]) == "show"
+}
+
 func CheckDeleteOrDropMeasurementFromTokens(tokens []string) (check bool) {
 	if len(tokens) >= 3 {
 		stmt := GetHeadStmtFromTokens(tokens, 2)
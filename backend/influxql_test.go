@@ -426,6 +426,57 @@ func assertMeasurement(t *testing.T, q string, m string) {
 	}
 }
 
+func TestSplitStatements(t *testing.T) {
+	assertStatements(t, `SELECT * FROM cpu`, []string{`SELECT * FROM cpu`})
+	assertStatements(t, `SELECT * FROM cpu;`, []string{`SELECT * FROM cpu`})
+	assertStatements(t, ` ; SELECT * FROM cpu ;; `, []string{`SELECT * FROM cpu`})
+	assertStatements(t, `SELECT * FROM cpu; SELECT * FROM mem`, []string{`SELECT * FROM cpu`, `SELECT * FROM mem`})
+	assertStatements(t, `SHOW DATABASES;SHOW MEASUREMENTS ON "db"`, []string{`SHOW DATABASES`, `SHOW MEASUREMENTS ON "db"`})
+	assertStatements(t, `SELECT * FROM "c;pu"; SELECT * FROM mem`, []string{`SELECT * FROM "c;pu"`, `SELECT * FROM mem`})
+	assertStatements(t, `SELECT * FROM cpu WHERE host = 'a;b'; SELECT * FROM mem`, []string{`SELECT * FROM cpu WHERE host = 'a;b'`, `SELECT * FROM mem`})
+	assertStatements(t, `SELECT * FROM cpu WHERE host = 'a\';b'; SELECT * FROM mem`, []string{`SELECT * FROM cpu WHERE host = 'a\';b'`, `SELECT * FROM mem`})
+	assertStatements(t, `SELECT * FROM /c;pu/; SELECT * FROM mem`, []string{`SELECT * FROM /c;pu/`, `SELECT * FROM mem`})
+	assertStatements(t, `SELECT * FROM cpu WHERE host =~ /a;b/; SELECT * FROM mem`, []string{`SELECT * FROM cpu WHERE host =~ /a;b/`, `SELECT * FROM mem`})
+	assertStatements(t, `SELECT a / 2 FROM cpu; SELECT b / 2 FROM mem`, []string{`SELECT a / 2 FROM cpu`, `SELECT b / 2 FROM mem`})
+}
+
+func assertStatements(t *testing.T, q string, s []string) {
+	qs := SplitStatements(q)
+	if len(qs) != len(s) {
+		t.Errorf("statements wrong: %s, %q != %q", q, qs, s)
+		return
+	}
+	for i := range qs {
+		if qs[i] != s[i] {
+			t.Errorf("statements wrong: %s, %q != %q", q, qs, s)
+			return
+		}
+	}
+}
+
+func TestCheckFanOutFromTokens(t *testing.T) {
+	assertFanOut(t, `SELECT * FROM cpu`, false)
+	assertFanOut(t, `SELECT * FROM "db"."rp"."cpu" WHERE time > now() - 1h`, false)
+	assertFanOut(t, `SELECT * FROM db..cpu GROUP BY *`, false)
+	assertFanOut(t, `SELECT mean(value) FROM (SELECT * FROM cpu, mem)`, false)
+	assertFanOut(t, `SHOW TAG KEYS FROM cpu, mem`, false)
+	assertFanOut(t, `SELECT * FROM cpu, mem`, true)
+	assertFanOut(t, `SELECT * FROM cpu ,mem`, true)
+	assertFanOut(t, `SELECT * FROM db..cpu,mem`, true)
+	assertFanOut(t, `SELECT * FROM "cpu","mem"`, true)
+	assertFanOut(t, `SELECT * FROM "db"."rp"."cpu", "db".."mem" WHERE time > now() - 1h`, true)
+	assertFanOut(t, `SELECT * FROM /cpu.*/`, true)
+	assertFanOut(t, `SELECT * FROM "db"."rp"./cpu.*/`, true)
+	assertFanOut(t, `SELECT * FROM db../cpu.*/ WHERE time > now() - 1h`, true)
+}
+
+func assertFanOut(t *testing.T, q string, f bool) {
+	qf := CheckFanOutFromTokens(ScanTokens(q, 0))
+	if qf != f {
+		t.Errorf("fan out wrong: %s, %t != %t", q, qf, f)
+	}
+}
+
 func BenchmarkGetDatabaseFromInfluxQL(b *testing.B) {
 	q := `CREATE SUBSCRIPTION "sub0" ON "mydb"."autogen" DESTINATIONS ALL 'udp://example.com:9090'`
 	for i := 0; i < b.N; i++ {
@@ -470,3 +521,107 @@ func BenchmarkGetMeasurementFromInfluxQL(b *testing.B) {
 		}
 	}
 }
+
+func TestCheckCardinalityFromTokens(t *testing.T) {
+	assertCardinality(t, `SHOW SERIES CARDINALITY`, "show series", false)
+	assertCardinality(t, `show series exact cardinality on db from cpu where host = 'a'`, "show series", true)
+	assertCardinality(t, `SHOW MEASUREMENT CARDINALITY ON db`, "show measurement", false)
+	assertCardinality(t, `SHOW MEASUREMENT EXACT CARDINALITY`, "show measurement", true)
+	assertCardinality(t, `SHOW TAG VALUES CARDINALITY WITH KEY = "host"`, "show tag values", false)
+	assertCardinality(t, `SHOW TAG VALUES EXACT CARDINALITY FROM cpu WITH KEY = "host"`, "show tag values", true)
+	assertCardinality(t, `SHOW FIELD KEY CARDINALITY`, "show field key", false)
+	assertCardinality(t, `SHOW FIELD KEY EXACT CARDINALITY FROM cpu`, "show field key", true)
+	assertCardinality(t, `SHOW SERIES FROM cpu`, "", false)
+	assertCardinality(t, `SHOW TAG VALUES WITH KEY = "cardinality"`, "", false)
+	assertCardinality(t, `SHOW MEASUREMENTS`, "", false)
+
+	q := ExactCardinalityToList(`SHOW TAG VALUES  EXACT CARDINALITY ON db FROM cpu WITH KEY = "host"`, "show tag values")
+	if q != `show tag values ON db FROM cpu WITH KEY = "host"` {
+		t.Errorf("exact cardinality rewrite wrong: %s", q)
+	}
+	q = ExactCardinalityToList(`show measurement exact cardinality`, "show measurement")
+	if q != `show measurements` {
+		t.Errorf("exact cardinality rewrite wrong: %s", q)
+	}
+}
+
+func assertCardinality(t *testing.T, q string, head string, exact bool) {
+	tokens, check, from := CheckQuery(q)
+	if head != "" && (!check || from) {
+		t.Errorf("check query wrong: %s, %v %v", q, check, from)
+	}
+	h, e := CheckCardinalityFromTokens(tokens)
+	if h != head || e != exact {
+		t.Errorf("cardinality wrong: %s, %s %v != %s %v", q, h, e, head, exact)
+	}
+}
+
+func TestCheckUserFromTokens(t *testing.T) {
+	assertUser(t, `CREATE USER "jdoe" WITH PASSWORD '1337password'`, true, false)
+	assertUser(t, `DROP USER "jdoe"`, true, false)
+	assertUser(t, `SET PASSWORD FOR "jdoe" = '1337password'`, true, false)
+	assertUser(t, `GRANT READ ON "mydb" TO "jdoe"`, true, false)
+	assertUser(t, `REVOKE ALL PRIVILEGES FROM "jdoe"`, true, false)
+	assertUser(t, `SHOW USERS`, true, true)
+	assertUser(t, `SHOW GRANTS FOR "jdoe"`, true, true)
+	assertUser(t, `SHOW DATABASES`, false, false)
+	assertUser(t, `DROP MEASUREMENT "cpu"`, false, false)
+}
+
+func assertUser(t *testing.T, q string, check bool, show bool) {
+	tokens, c, from := CheckQuery(q)
+	if check && (!c || from) {
+		t.Errorf("check query wrong: %s, %v %v", q, c, from)
+	}
+	ck, sh := CheckUserFromTokens(tokens)
+	if ck != check || sh != show {
+		t.Errorf("user wrong: %s, %v %v != %v %v", q, ck, sh, check, show)
+	}
+}
+
+func TestCheckContinuousQueryFromTokens(t *testing.T) {
+	tests := map[string]string{
+		`CREATE CONTINUOUS QUERY "cq" ON "db" BEGIN SELECT mean("v") INTO "cpu_1h" FROM "cpu" GROUP BY time(1h) END`: "create continuous query",
+		`DROP CONTINUOUS QUERY "cq" ON "db"`: "drop continuous query",
+		`SHOW CONTINUOUS QUERIES`:            "show continuous queries",
+		`SELECT * INTO cpu_copy FROM cpu`:    "",
+	}
+	for q, stmt := range tests {
+		tokens, check, _ := CheckQuery(q)
+		if s := CheckContinuousQueryFromTokens(tokens); s != stmt || stmt != "" && !check {
+			t.Errorf("continuous query wrong: %s, %s %v != %s", q, s, check, stmt)
+		}
+	}
+}
+
+func TestCheckSelectIntoFromTokens(t *testing.T) {
+	tests := map[string]bool{
+		`SELECT * INTO cpu_copy FROM cpu`:                                 true,
+		`SELECT mean(v) INTO "db"."rp".:MEASUREMENT FROM /.*/ GROUP BY *`: true,
+		`SELECT * FROM cpu`: false,
+		`SELECT * FROM (SELECT * INTO cpu_copy FROM cpu)`: false,
+		`SHOW TAG VALUES WITH KEY = "into"`:               false,
+	}
+	for q, into := range tests {
+		tokens, check, from := CheckQuery(q)
+		if CheckSelectIntoFromTokens(tokens) != into || into && !(check && from) {
+			t.Errorf("select into wrong: %s, %v", q, !into)
+		}
+	}
+}
+
+func TestCheckQueriesFromTokens(t *testing.T) {
+	tests := map[string]string{
+		`SHOW QUERIES`:            "show queries",
+		`KILL QUERY 36 ON "b1"`:   "kill query",
+		`kill query 36`:           "kill query",
+		`SHOW CONTINUOUS QUERIES`: "",
+		`SHOW MEASUREMENTS`:       "",
+	}
+	for q, stmt := range tests {
+		tokens, check, _ := CheckQuery(q)
+		if s := CheckQueriesFromTokens(tokens); s != stmt || stmt != "" && !check {
+			t.Errorf("queries wrong: %s, %s %v != %s", q, s, check, stmt)
+		}
+	}
+}
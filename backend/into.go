@@ -0,0 +1,344 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxql"
+	jsoniter "github.com/json-iterator/go"
+)
+
+var ErrSelectInto = errors.New("select into requires measurement sources")
+
+func QuerySelectIntoQL(w http.ResponseWriter, req *http.Request, ip *Proxy, db string) (body []byte, err error) {
+	q := strings.TrimSpace(req.FormValue("q"))
+	st, err := influxql.ParseStatement(q)
+	if err != nil {
+		return
+	}
+	stmt, ok := st.(*influxql.SelectStatement)
+	if !ok || stmt.Target == nil {
+		return nil, ErrSelectInto
+	}
+	for _, src := range stmt.Sources {
+		if _, ok := src.(*influxql.Measurement); !ok {
+			return nil, ErrSelectInto
+		}
+	}
+	target := stmt.Target.Measurement
+	tdb := getSourceDatabase(target, db)
+	if ip.IsForbiddenDB(tdb) {
+		return nil, errors.New("database forbidden: " + tdb)
+	}
+	measurements, err := ExpandSources(ip, stmt.Sources, db)
+	if err != nil {
+		return
+	}
+	if req, err = CheckGuardrail(req, ip, stmt, db); err != nil {
+		return
+	}
+
+	// all circles -> the only backend owning both sources and target -> select into
+	if owners := ip.getSelectIntoOwners(measurements, target, db, tdb); owners != nil {
+		return QueryBackends(owners, req, w)
+	}
+
+	// source owners -> select in chunks, then proxy -> target owners of all circles -> write each chunk
+	sel := stmt.Clone()
+	sel.Target = nil
+	sq := sel.String()
+	cr := CloneQueryRequest(req)
+	cr.Form.Set("q", sq)
+	cr.Form.Set("epoch", "ns")
+	cr.Form.Set("chunked", "true")
+	cr.Form.Set("chunk_size", strconv.Itoa(DefaultChunkSize))
+	cr.Header.Del("Accept-Encoding")
+	cr.Header.Set("Accept", "application/json")
+	cr.Header.Set(HeaderQueryOrigin, QuerySelectInto)
+	sw := &seriesWriter{ip: ip, target: target, tdb: tdb, types: ip.selectFieldTypes(sel, measurements, db), fieldTypes: make(map[string]map[string]string)}
+	dw := newDecodeWriter(func(r io.Reader) error {
+		return decodeResponses(r, func(rsp *Response) error {
+			return sw.write(req.Context(), SeriesFromResponse(rsp))
+		})
+	})
+	b, err := ip.queryStatement(dw, cr, sq)
+	if err == nil && b != nil {
+		// merged responses of several backends are not streamed
+		_, err = dw.Write(b)
+	}
+	if werr := dw.Close(); err == nil {
+		err = werr
+	}
+	if err != nil {
+		return
+	}
+	written := sw.written
+	var epoch interface{} = time.Unix(0, 0).UTC().Format(time.RFC3339Nano)
+	if req.FormValue("epoch") != "" {
+		epoch = 0
+	}
+	series := models.Rows{&models.Row{Name: "result", Columns: []string{"time", "written"}, Values: [][]interface{}{{epoch, written}}}}
+	return MarshalResponse(w, req, ResponseFromSeries(series))
+}
+
+// getSelectIntoOwners returns the backend of each circle owning all sources and the target, or nil if there is none
+func (ip *Proxy) getSelectIntoOwners(measurements []*influxql.Measurement, target *influxql.Measurement, db, tdb string) (owners []*Backend) {
+	for _, circle := range ip.Circles {
+		var owner *Backend
+		for _, m := range measurements {
+			skey := GetKey(getSourceDatabase(m, db), m.Name)
+			tmeas := target.Name
+			if tmeas == "" {
+				// target of :MEASUREMENT backreference is the source measurement
+				tmeas = m.Name
+			}
+			tkey := GetKey(tdb, tmeas)
+			if IsShardedKey(skey) || IsShardedKey(tkey) {
+				return nil
+			}
+			sbe := circle.GetBackend(skey)
+			if sbe.Url != circle.GetBackend(tkey).Url || owner != nil && owner.Url != sbe.Url {
+				return nil
+			}
+			owner = sbe
+		}
+		if owner == nil {
+			return nil
+		}
+		owners = append(owners, owner)
+	}
+	return
+}
+
+// decodeWriter is the response writer of a query forwarded in chunks, which passes the response
+// to decode as it arrives, so that the result is not buffered
+type decodeWriter struct {
+	header http.Header
+	pw     *io.PipeWriter
+	done   chan error
+}
+
+func newDecodeWriter(decode func(r io.Reader) error) *decodeWriter {
+	pr, pw := io.Pipe()
+	dw := &decodeWriter{header: make(http.Header), pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := decode(pr)
+		// the query is aborted by the error of the pipe if the response is not decoded
+		pr.CloseWithError(err)
+		dw.done <- err
+	}()
+	return dw
+}
+
+func (dw *decodeWriter) Header() http.Header {
+	return dw.header
+}
+
+func (dw *decodeWriter) Write(p []byte) (int, error) {
+	return dw.pw.Write(p)
+}
+
+func (dw *decodeWriter) WriteHeader(int) {
+}
+
+func (dw *decodeWriter) Flush() {
+}
+
+// Close ends the response and returns the error of decoding it
+func (dw *decodeWriter) Close() error {
+	dw.pw.Close()
+	return <-dw.done
+}
+
+// decodeResponses calls fn with each response decoded from r, a chunked response consists of several json objects
+func decodeResponses(r io.Reader, fn func(rsp *Response) error) error {
+	dec := jsoniter.NewDecoder(r)
+	dec.UseNumber()
+	for dec.More() {
+		rsp := &Response{}
+		if err := dec.Decode(rsp); err != nil {
+			return err
+		}
+		if err := checkResponses([]*Response{rsp}); err != nil {
+			return err
+		}
+		if err := fn(rsp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seriesWriter writes the selected series into the target measurement like select into of influxdb,
+// the tags of group by are kept and null fields are skipped
+type seriesWriter struct {
+	ip         *Proxy
+	target     *influxql.Measurement
+	tdb        string
+	types      map[string]string            // types of the selected columns evaluated from the sources
+	fieldTypes map[string]map[string]string // types of the existing fields of each target measurement
+	written    int64
+}
+
+func (sw *seriesWriter) write(ctx context.Context, series models.Rows) (err error) {
+	var buf bytes.Buffer
+	for _, serie := range series {
+		tmeas := sw.target.Name
+		if tmeas == "" {
+			tmeas = serie.Name
+		}
+		types, ok := sw.fieldTypes[tmeas]
+		if !ok {
+			types = sw.ip.getFieldTypes(sw.tdb, sw.target.RetentionPolicy, tmeas)
+			sw.fieldTypes[tmeas] = types
+		}
+		tags := models.Tags{}
+		for k, v := range serie.Tags {
+			if v != "" {
+				tags = append(tags, models.NewTag([]byte(k), []byte(v)))
+			}
+		}
+		for _, value := range serie.Values {
+			fields := make(models.Fields)
+			var ts int64
+			for i, column := range serie.Columns {
+				if i >= len(value) || value[i] == nil {
+					continue
+				}
+				if column == "time" {
+					ts = parseTime(value[i])
+					continue
+				}
+				// the type of an existing field is kept, and a new field takes the type selected from the sources
+				fieldType, ok := types[column]
+				if !ok {
+					fieldType = sw.types[column]
+				}
+				fields[column] = fieldValue(value[i], fieldType)
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			point, err := models.NewPoint(tmeas, tags, fields, time.Unix(0, ts))
+			if err != nil {
+				return err
+			}
+			buf.WriteString(point.String())
+			buf.WriteByte('\n')
+			sw.written++
+		}
+	}
+	if buf.Len() > 0 {
+		err = sw.ip.Write(ctx, buf.Bytes(), sw.tdb, sw.target.RetentionPolicy, "ns")
+	}
+	return
+}
+
+// selectFieldTypes returns the types of the columns selected by stmt, which are evaluated from the field types
+// of the source measurements as influxdb does, the columns of a wildcard take the types of the source fields
+func (ip *Proxy) selectFieldTypes(stmt *influxql.SelectStatement, measurements []*influxql.Measurement, db string) map[string]string {
+	mapper := make(fieldTypeMapper)
+	for _, m := range measurements {
+		for field, typ := range ip.getFieldTypes(getSourceDatabase(m, db), m.RetentionPolicy, m.Name) {
+			if _, ok := mapper[m.Name]; !ok {
+				mapper[m.Name] = make(map[string]influxql.DataType)
+			}
+			mapper[m.Name][field] = influxql.DataTypeFromString(typ)
+		}
+	}
+	types := make(map[string]string)
+	for _, fields := range mapper {
+		for field, typ := range fields {
+			// a field of several types is selected as the type that occurs first in float, integer, string and boolean
+			if prev, ok := types[field]; !ok || typ.LessThan(influxql.DataTypeFromString(prev)) {
+				types[field] = typ.String()
+			}
+		}
+	}
+	sources := make(influxql.Sources, len(measurements))
+	for i, m := range measurements {
+		sources[i] = m
+	}
+	names := stmt.ColumnNames()
+	if len(names) != len(stmt.Fields)+1 {
+		return types
+	}
+	for i, field := range stmt.Fields {
+		if typ := influxql.EvalType(field.Expr, sources, mapper); typ != influxql.Unknown {
+			types[names[i+1]] = typ.String()
+		}
+	}
+	return types
+}
+
+// fieldTypeMapper maps the fields of measurements to their types and the calls to their result types as influxdb does
+type fieldTypeMapper map[string]map[string]influxql.DataType
+
+func (m fieldTypeMapper) MapType(measurement *influxql.Measurement, field string) influxql.DataType {
+	return m[measurement.Name][field]
+}
+
+func (m fieldTypeMapper) CallType(name string, args []influxql.DataType) (influxql.DataType, error) {
+	switch name {
+	case "mean", "median", "integral", "stddev", "derivative", "non_negative_derivative", "moving_average",
+		"exponential_moving_average", "double_exponential_moving_average", "triple_exponential_moving_average",
+		"relative_strength_index", "triple_exponential_derivative", "kaufmans_efficiency_ratio",
+		"kaufmans_adaptive_moving_average", "chande_momentum_oscillator", "holt_winters", "holt_winters_with_fit":
+		return influxql.Float, nil
+	case "count", "elapsed":
+		return influxql.Integer, nil
+	}
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	return influxql.Unknown, nil
+}
+
+func (ip *Proxy) getFieldTypes(db, rp, meas string) map[string]string {
+	types := make(map[string]string)
+	for _, be := range ip.GetBackends(GetKey(db, meas)) {
+		if !be.IsActive() {
+			continue
+		}
+		q := "show field keys from " + influxql.QuoteIdent(meas)
+		if rp != "" {
+			q = "show field keys from " + influxql.QuoteIdent(rp, meas)
+		}
+		for _, value := range rowValues(ResponseFromQueryResult(be.Query(NewQueryRequest("GET", db, q, ""), nil, true))) {
+			if len(value) > 1 {
+				types[util.CastString(value[0])] = util.CastString(value[1])
+			}
+		}
+		break
+	}
+	return types
+}
+
+// fieldValue converts a decoded json value, json numbers are written as float unless the field is known as integer
+func fieldValue(v interface{}, fieldType string) interface{} {
+	switch tv := v.(type) {
+	case number:
+		if fieldType == "integer" {
+			if i, err := tv.Int64(); err == nil {
+				return i
+			}
+		}
+		f, _ := tv.Float64()
+		return f
+	case string, bool:
+		return tv
+	}
+	return util.CastString(v)
+}
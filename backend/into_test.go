@@ -0,0 +1,39 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"testing"
+
+	"github.com/influxdata/influxql"
+)
+
+func TestFieldTypeMapper(t *testing.T) {
+	mapper := fieldTypeMapper{"cpu": {"value": influxql.Integer, "idle": influxql.Float}}
+	sources := influxql.Sources{&influxql.Measurement{Name: "cpu"}}
+	tests := []struct {
+		expr string
+		typ  influxql.DataType
+	}{
+		{"value", influxql.Integer},
+		{"max(value)", influxql.Integer},
+		{"sum(value)", influxql.Integer},
+		{"count(idle)", influxql.Integer},
+		{"mean(value)", influxql.Float},
+		{"value::float", influxql.Float},
+		{"value * 2", influxql.Integer},
+		{"value * idle", influxql.Float},
+		{"unknown", influxql.Unknown},
+	}
+	for _, tt := range tests {
+		expr, err := influxql.ParseExpr(tt.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if typ := influxql.EvalType(expr, sources, mapper); typ != tt.typ {
+			t.Errorf("%s: got %s, want %s", tt.expr, typ, tt.typ)
+		}
+	}
+}
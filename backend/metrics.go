@@ -0,0 +1,158 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const MetricsNamespace = "influx_proxy"
+
+// MetricsRegistry holds the self-metrics of the process exposed by /metrics, the metrics of a proxy instance
+// are collected by the registry of the proxy
+var MetricsRegistry = prometheus.NewRegistry()
+
+// maxMetricsDatabases caps the databases labeled in the write metrics without db_list
+const maxMetricsDatabases = 100
+
+// MetricsOtherDatabase is the db label of the write metrics of the databases beyond the cap or out of db_list
+const MetricsOtherDatabase = "other"
+
+var (
+	writeRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace, Name: "write_requests_total", Help: "Write requests per database.",
+	}, []string{"db"})
+	writePoints = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace, Name: "write_points_total", Help: "Points written per database.",
+	}, []string{"db"})
+	writeBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace, Name: "write_bytes_total", Help: "Bytes of line protocol of the points routed to backends per database.",
+	}, []string{"db"})
+	backendPoints = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace, Name: "backend_points_total", Help: "Points routed to each backend.",
+	}, []string{"backend"})
+	flushBatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace, Name: "flush_batches_total", Help: "Buffered batches flushed to each backend.",
+	}, []string{"backend"})
+	flushFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace, Name: "flush_failures_total", Help: "Flushed batches not delivered to each backend, which are kept in the backlog file or dropped.",
+	}, []string{"backend"})
+	flushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace, Name: "flush_duration_seconds", Help: "Latency of the batches written to each backend.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend"})
+	rewriteRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace, Name: "rewrite_records_total", Help: "Backlog records rewritten to each backend.",
+	}, []string{"backend"})
+	rewriteBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace, Name: "rewrite_bytes_total", Help: "Compressed backlog bytes rewritten to each backend.",
+	}, []string{"backend"})
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace, Name: "query_duration_seconds", Help: "Latency until the response header of the queries to each backend per statement type.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"type", "backend"})
+	backendUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: MetricsNamespace, Name: "backend_up", Help: "Whether the last health check of each backend passed.",
+	}, []string{"backend"})
+	healthChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace, Name: "health_checks_total", Help: "Health checks of each backend per result.",
+	}, []string{"backend", "result"})
+
+	backlogBytesDesc = prometheus.NewDesc(prometheus.BuildFQName(MetricsNamespace, "", "backlog_bytes"),
+		"Bytes of the backlog file of each backend not yet rewritten.", []string{"backend"}, nil)
+	backlogRecordsDesc = prometheus.NewDesc(prometheus.BuildFQName(MetricsNamespace, "", "backlog_records"),
+		"Records of the backlog file of each backend not yet rewritten.", []string{"backend"}, nil)
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		writeRequests, writePoints, writeBytes, backendPoints,
+		flushBatches, flushFailures, flushDuration, rewriteRecords, rewriteBytes,
+		queryDuration, backendUp, healthChecks,
+	)
+}
+
+// ProxyCollector collects the metrics read from the backends of the proxy when scraped
+type ProxyCollector struct {
+	ip *Proxy
+}
+
+func NewProxyCollector(ip *Proxy) *ProxyCollector {
+	return &ProxyCollector{ip: ip}
+}
+
+func (pc *ProxyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backlogBytesDesc
+	ch <- backlogRecordsDesc
+}
+
+func (pc *ProxyCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, be := range pc.ip.GetAllBackends() {
+		if be.fb == nil {
+			continue
+		}
+		size, records := be.fb.Backlog()
+		ch <- prometheus.MustNewConstMetric(backlogBytesDesc, prometheus.GaugeValue, float64(size), be.Name)
+		ch <- prometheus.MustNewConstMetric(backlogRecordsDesc, prometheus.GaugeValue, float64(records), be.Name)
+	}
+}
+
+// statementTypes bounds the type label of the query metrics
+var statementTypes = map[string]bool{
+	"select": true, "show": true, "create": true, "drop": true, "delete": true,
+	"alter": true, "grant": true, "revoke": true, "kill": true, "explain": true,
+}
+
+// StatementType returns the lowercase leading keyword of the first statement of q, or other if it is not a known one
+func StatementType(q string) string {
+	fields := strings.Fields(q)
+	if len(fields) == 0 {
+		return "other"
+	}
+	typ := strings.ToLower(strings.TrimRight(fields[0], ";"))
+	if !statementTypes[typ] {
+		return "other"
+	}
+	return typ
+}
+
+func observeQuery(typ, backend string, start time.Time) {
+	queryDuration.WithLabelValues(typ, backend).Observe(time.Since(start).Seconds())
+}
+
+// RegisterCollector registers a collector of the proxy instance, which is gathered with the process metrics
+func (ip *Proxy) RegisterCollector(c prometheus.Collector) error {
+	return ip.metrics.Register(c)
+}
+
+// Gatherer returns the gatherer of the process metrics and the metrics of the proxy instance
+func (ip *Proxy) Gatherer() prometheus.Gatherer {
+	return prometheus.Gatherers{MetricsRegistry, ip.metrics}
+}
+
+// dbLabel returns the db label of the write metrics, the databases of writes come from clients, so the label is
+// bounded by db_list, or by the first maxMetricsDatabases databases without db_list
+func (ip *Proxy) dbLabel(db string) string {
+	if len(ip.dbSet) > 0 {
+		if ip.dbSet[db] {
+			return db
+		}
+		return MetricsOtherDatabase
+	}
+	ip.metricsMu.Lock()
+	defer ip.metricsMu.Unlock()
+	if !ip.metricsDBs[db] {
+		if len(ip.metricsDBs) >= maxMetricsDatabases {
+			return MetricsOtherDatabase
+		}
+		ip.metricsDBs.Add(db)
+	}
+	return db
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStatementType(t *testing.T) {
+	tests := map[string]string{
+		"select * from cpu":          "select",
+		"  SHOW MEASUREMENTS":        "show",
+		"drop measurement cpu; show": "drop",
+		"select;":                    "select",
+		"foo bar":                    "other",
+		"":                           "other",
+	}
+	for q, want := range tests {
+		if got := StatementType(q); got != want {
+			t.Errorf("StatementType(%q) = %s, want %s", q, got, want)
+		}
+	}
+}
+
+func TestDBLabel(t *testing.T) {
+	ip := &Proxy{dbSet: util.NewSet(), metricsDBs: util.NewSet()}
+	for i := 0; i < maxMetricsDatabases; i++ {
+		if db := fmt.Sprintf("db%d", i); ip.dbLabel(db) != db {
+			t.Fatalf("database %s not labeled", db)
+		}
+	}
+	if got := ip.dbLabel("db100"); got != MetricsOtherDatabase {
+		t.Errorf("got label %s beyond the cap, want %s", got, MetricsOtherDatabase)
+	}
+	if got := ip.dbLabel("db0"); got != "db0" {
+		t.Errorf("got label %s of a labeled database, want db0", got)
+	}
+
+	ip = &Proxy{dbSet: util.NewSet(), metricsDBs: util.NewSet()}
+	ip.dbSet.Add("db0")
+	if got := ip.dbLabel("db1"); got != MetricsOtherDatabase {
+		t.Errorf("got label %s out of db_list, want %s", got, MetricsOtherDatabase)
+	}
+	if got := ip.dbLabel("db0"); got != "db0" {
+		t.Errorf("got label %s in db_list, want db0", got)
+	}
+}
+
+func TestProxyGatherer(t *testing.T) {
+	// the collectors of several proxies in a process are registered without conflict
+	for i := 0; i < 2; i++ {
+		ip := &Proxy{metrics: prometheus.NewRegistry()}
+		if err := ip.RegisterCollector(NewProxyCollector(ip)); err != nil {
+			t.Fatalf("register collector of proxy %d: %v", i, err)
+		}
+		if _, err := ip.Gatherer().Gather(); err != nil {
+			t.Fatalf("gather metrics of proxy %d: %v", i, err)
+		}
+	}
+}
+
+func TestFileBackendBacklog(t *testing.T) {
+	dir, err := os.MkdirTemp("", "influx-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fb, err := NewFileBackend("backlog", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"one", "two", "three"} {
+		if err = fb.Write([]byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size, records := fb.Backlog(); size != 3*4+11 || records != 3 {
+		t.Errorf("got backlog %d bytes %d records, want 23 bytes 3 records", size, records)
+	}
+	if _, err = fb.Read(); err != nil {
+		t.Fatal(err)
+	}
+	if err = fb.UpdateMeta(); err != nil {
+		t.Fatal(err)
+	}
+	fb.Close()
+
+	// the records are counted again from the committed offset
+	fb, err = NewFileBackend("backlog", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fb.Close()
+	if size, records := fb.Backlog(); size != 2*4+8 || records != 2 {
+		t.Errorf("got backlog %d bytes %d records, want 16 bytes 2 records", size, records)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = fb.Read(); err != nil {
+			t.Fatal(err)
+		}
+		if err = fb.UpdateMeta(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if size, records := fb.Backlog(); size != 0 || records != 0 || fb.IsData() {
+		t.Errorf("got backlog %d bytes %d records, want empty", size, records)
+	}
+}
+
+func TestWriteBytes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "influx-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &ProxyConfig{
+		Circles: []*CircleConfig{{Name: "circle-1", Backends: []*BackendConfig{{Name: "b1", Url: "http://127.0.0.1:1"}}}},
+		DBList:  []string{"bytes_write", "bytes_points"},
+		DataDir: dir,
+	}
+	cfg.setDefault()
+	ip := NewProxy(cfg)
+	defer ip.Close()
+
+	// the line protocol and the parsed points of the same data count the same bytes, comments and blank lines are not counted
+	line := "cpu,host=a value=1 1000000000"
+	if err = ip.Write(context.Background(), []byte("# comment\n\n"+line+"\n"), "bytes_write", "", "ns"); err != nil {
+		t.Fatal(err)
+	}
+	points, err := models.ParsePointsString(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ip.WritePoints(context.Background(), points, "bytes_points", ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, db := range []string{"bytes_write", "bytes_points"} {
+		if got := testutil.ToFloat64(writeBytes.WithLabelValues(db)); got != float64(len(line)) {
+			t.Errorf("got %v bytes written to %s, want %d", got, db, len(line))
+		}
+	}
+}
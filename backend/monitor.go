@@ -0,0 +1,201 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/logging"
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxql"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+// Statistic is a module of the proxy stats, as the statistics of the InfluxDB monitor
+type Statistic struct {
+	Name   string
+	Tags   map[string]string
+	Values map[string]interface{}
+}
+
+// Statistics converts the self-metrics of the proxy into stats sorted by name and tags,
+// the module is the first word of a metric name after the namespace, and the rest is the field,
+// series of a module with the same labels are merged into one statistic, histograms and summaries
+// are reduced to their count and sum
+func Statistics(g prometheus.Gatherer) (stats []*Statistic, err error) {
+	mfs, err := g.Gather()
+	if err != nil {
+		return
+	}
+	index := make(map[string]*Statistic)
+	for _, mf := range mfs {
+		name := strings.TrimPrefix(mf.GetName(), MetricsNamespace+"_")
+		module, field := name, "value"
+		if i := strings.IndexByte(name, '_'); i > 0 {
+			module, field = name[:i], name[i+1:]
+		}
+		for _, m := range mf.GetMetric() {
+			tags := make(map[string]string, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				tags[l.GetName()] = l.GetValue()
+			}
+			key := module + "," + string(models.NewTags(tags).HashKey())
+			st, ok := index[key]
+			if !ok {
+				st = &Statistic{Name: module, Tags: tags, Values: make(map[string]interface{})}
+				index[key] = st
+				stats = append(stats, st)
+			}
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				st.Values[field] = m.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				st.Values[field] = m.GetGauge().GetValue()
+			case dto.MetricType_UNTYPED:
+				st.Values[field] = m.GetUntyped().GetValue()
+			case dto.MetricType_HISTOGRAM:
+				st.Values[field+"_count"] = float64(m.GetHistogram().GetSampleCount())
+				st.Values[field+"_sum"] = m.GetHistogram().GetSampleSum()
+			case dto.MetricType_SUMMARY:
+				st.Values[field+"_count"] = float64(m.GetSummary().GetSampleCount())
+				st.Values[field+"_sum"] = m.GetSummary().GetSampleSum()
+			}
+		}
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		if stats[i].Name != stats[j].Name {
+			return stats[i].Name < stats[j].Name
+		}
+		return bytes.Compare(models.NewTags(stats[i].Tags).HashKey(), models.NewTags(stats[j].Tags).HashKey()) < 0
+	})
+	return
+}
+
+// StatisticsResult returns the proxy stats of the show stats statement q as a result with a series per statistic
+func StatisticsResult(g prometheus.Gatherer, q string) *Result {
+	var module string
+	if stmt, err := influxql.ParseStatement(q); err == nil {
+		if ss, ok := stmt.(*influxql.ShowStatsStatement); ok {
+			module = ss.Module
+		}
+	}
+	stats, err := Statistics(g)
+	if err != nil {
+		return &Result{Err: err.Error()}
+	}
+	result := &Result{}
+	for _, st := range stats {
+		if module != "" && st.Name != module {
+			continue
+		}
+		row := &models.Row{Name: st.Name, Tags: st.Tags}
+		values := make([]interface{}, 0, len(st.Values))
+		for _, field := range sortedFields(st.Values) {
+			row.Columns = append(row.Columns, field)
+			values = append(values, st.Values[field])
+		}
+		row.Values = [][]interface{}{values}
+		result.Series = append(result.Series, row)
+	}
+	return result
+}
+
+// StatisticsLines returns the proxy stats as line protocol at time t, with the hostname tag of the proxy
+func StatisticsLines(g prometheus.Gatherer, t time.Time) ([]byte, error) {
+	stats, err := Statistics(g)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	var buf bytes.Buffer
+	for _, st := range stats {
+		tags := models.NewTags(st.Tags)
+		tags.SetString("hostname", hostname)
+		fields := make(models.Fields, len(st.Values))
+		for k, v := range st.Values {
+			// line protocol cannot represent NaN and Inf
+			if f, ok := v.(float64); !ok || (!math.IsNaN(f) && !math.IsInf(f, 0)) {
+				fields[k] = v
+			}
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		pt, err := models.NewPoint(st.Name, tags, fields, t)
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(pt.String())
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// Monitor writes the proxy stats into db through Write every interval until the proxy is closed,
+// the database is created on all backends before the first write
+func (ip *Proxy) Monitor(db string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	created := false
+	for {
+		select {
+		case <-ip.done:
+			return
+		case t := <-ticker.C:
+			if !created {
+				if err := ip.createMonitorDatabase(db); err != nil {
+					logging.L().Warn("create monitor database error", zap.Error(err), logging.DB(db))
+					continue
+				}
+				created = true
+			}
+			p, err := StatisticsLines(ip.Gatherer(), t)
+			if err != nil {
+				logging.L().Warn("gather statistics error", zap.Error(err))
+				continue
+			}
+			if err = ip.Write(context.Background(), p, db, "", "ns"); err != nil {
+				logging.L().Warn("write statistics error", zap.Error(err), logging.DB(db))
+			}
+		}
+	}
+}
+
+func (ip *Proxy) createMonitorDatabase(db string) error {
+	var backends []*Backend
+	for _, be := range ip.GetAllBackends() {
+		// databases of v2 backends are mapped to existing buckets
+		if !be.IsV2() {
+			backends = append(backends, be)
+		}
+	}
+	q := fmt.Sprintf("create database \"%s\"", util.EscapeIdentifier(db))
+	rsps, errs := QueryBackendsInOrder(backends, NewQueryRequest("POST", "", q, ""))
+	for i, rsp := range rsps {
+		if err := responseError(rsp, errs[i]); err != nil {
+			return fmt.Errorf("backend %s(%s): %s", backends[i].Name, backends[i].Url, err)
+		}
+	}
+	return nil
+}
+
+func sortedFields(values map[string]interface{}) []string {
+	fields := make([]string, 0, len(values))
+	for k := range values {
+		fields = append(fields, k)
+	}
+	sort.Strings(fields)
+	return fields
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestStatistics(t *testing.T) {
+	writeRequests.WithLabelValues("monitor_test").Add(2)
+	writePoints.WithLabelValues("monitor_test").Add(5)
+	flushDuration.WithLabelValues("monitor_test").Observe(0.5)
+
+	result := StatisticsResult(MetricsRegistry, "show stats for 'write'")
+	var found bool
+	for _, row := range result.Series {
+		if row.Name != "write" {
+			t.Fatalf("got module %s, want write only", row.Name)
+		}
+		if row.Tags["db"] != "monitor_test" {
+			continue
+		}
+		found = true
+		got := make(map[string]interface{})
+		for i, column := range row.Columns {
+			got[column] = row.Values[0][i]
+		}
+		if got["requests_total"] != float64(2) || got["points_total"] != float64(5) {
+			t.Errorf("got write stats %v", got)
+		}
+	}
+	if !found {
+		t.Errorf("write stats of monitor_test not found in %v", result.Series)
+	}
+
+	lines, err := StatisticsLines(MetricsRegistry, time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var flush []byte
+	for _, line := range bytes.Split(lines, []byte("\n")) {
+		if bytes.HasPrefix(line, []byte("flush,backend=monitor_test,")) {
+			flush = line
+		}
+	}
+	if !bytes.Contains(flush, []byte("duration_seconds_count=1,duration_seconds_sum=0.5")) || !bytes.HasSuffix(flush, []byte(" 1000000000")) {
+		t.Errorf("got flush stats line %q", flush)
+	}
+}
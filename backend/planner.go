@@ -0,0 +1,140 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/influxdata/influxql"
+)
+
+var (
+	ErrShardedQuery   = errors.New("query on sharded measurement requires a plain select statement")
+	ErrMergeWildcard  = errors.New("wildcard cannot be merged with aggregates across backends")
+	ErrMergeFill      = errors.New("fill(linear) cannot be merged across backends")
+	ErrMergeSelectors = fmt.Errorf("first() and last() cannot be merged across backends within more than %d intervals", MaxSelectorStatements)
+)
+
+// MaxSelectorStatements limits the selector statements sent to each backend to resolve first() and last()
+// within the intervals in which several backends return a point
+const MaxSelectorStatements = 1000
+
+// partialCalls maps each mergeable function to the partial aggregates executed on every backend
+var partialCalls = map[string][]string{
+	"count": {"count"},
+	"sum":   {"sum"},
+	"min":   {"min"},
+	"max":   {"max"},
+	"mean":  {"sum", "count"},
+	"first": {"first"},
+	"last":  {"last"},
+}
+
+type PlanField struct {
+	Name    string
+	Columns []int
+}
+
+// selectedKey identifies the point of a first() or last() field within an interval of a series
+type selectedKey struct {
+	field  int
+	bucket int64
+	series string
+}
+
+// QueryPlan describes how a select statement is executed on several backends and how the partial results are merged
+type QueryPlan struct {
+	Statement    *influxql.SelectStatement
+	Columns      []string
+	Fields       []*PlanField
+	Aggregate    bool
+	GroupByTime  bool
+	SelectorTime bool
+	Ascending    bool
+	Fill         influxql.FillOption
+	FillValue    interface{}
+	Limit        int
+	Offset       int
+	SLimit       int
+	SOffset      int
+	Interval     int64
+	// Selected holds the values of first() and last() resolved by selector queries within the intervals
+	// in which several backends return a point, since the partial values carry the time of the interval
+	Selected map[selectedKey]interface{}
+}
+
+func NewQueryPlan(stmt *influxql.SelectStatement) (plan *QueryPlan, err error) {
+	interval, err := stmt.GroupByInterval()
+	if err != nil {
+		return
+	}
+	plan = &QueryPlan{
+		Statement:   stmt.Clone(),
+		Columns:     stmt.ColumnNames(),
+		GroupByTime: interval > 0,
+		Ascending:   stmt.TimeAscending(),
+		Fill:        stmt.Fill,
+		FillValue:   stmt.FillValue,
+		Limit:       stmt.Limit,
+		Offset:      stmt.Offset,
+		SLimit:      stmt.SLimit,
+		SOffset:     stmt.SOffset,
+		Interval:    int64(interval),
+	}
+	partial := plan.Statement
+	partial.Offset, partial.SLimit, partial.SOffset = 0, 0, 0
+	// a call nested in an expression also makes an aggregate, which is rejected below unless it is a bare call
+	influxql.WalkFunc(stmt.Fields, func(n influxql.Node) {
+		switch n.(type) {
+		case *influxql.Call, *influxql.Distinct:
+			plan.Aggregate = true
+		}
+	})
+	if !plan.Aggregate {
+		// raw rows of the same series are merged by time, so each backend must return the rows skipped by offset
+		if stmt.Limit > 0 {
+			partial.Limit = stmt.Limit + stmt.Offset
+		}
+		return
+	}
+
+	if stmt.Fill == influxql.LinearFill {
+		return nil, ErrMergeFill
+	}
+	partial.Limit = 0
+	partial.Fill, partial.FillValue = influxql.NullFill, nil
+	partial.Fields = make(influxql.Fields, 0, len(stmt.Fields))
+	for _, field := range stmt.Fields {
+		call, ok := field.Expr.(*influxql.Call)
+		if !ok {
+			return nil, fmt.Errorf("field %s cannot be merged with aggregates across backends", field.Expr)
+		}
+		calls, ok := partialCalls[call.Name]
+		if !ok {
+			return nil, fmt.Errorf("function %s() cannot be merged across backends", call.Name)
+		}
+		if len(call.Args) != 1 {
+			return nil, fmt.Errorf("function %s() with %d arguments cannot be merged across backends", call.Name, len(call.Args))
+		}
+		switch arg := call.Args[0].(type) {
+		case *influxql.VarRef:
+		case *influxql.Wildcard, *influxql.RegexLiteral:
+			return nil, ErrMergeWildcard
+		default:
+			return nil, fmt.Errorf("function %s() on %s cannot be merged across backends", call.Name, arg)
+		}
+		pf := &PlanField{Name: call.Name}
+		for _, name := range calls {
+			// the first column is time, and partial columns are referenced by position
+			pf.Columns = append(pf.Columns, len(partial.Fields)+1)
+			partial.Fields = append(partial.Fields, &influxql.Field{Expr: &influxql.Call{Name: name, Args: call.Args}})
+		}
+		plan.Fields = append(plan.Fields, pf)
+	}
+	// a single selector without group by time() returns the timestamp of the selected point
+	plan.SelectorTime = !plan.GroupByTime && len(partial.Fields) == 1 && plan.Fields[0].Name != "count" && plan.Fields[0].Name != "sum"
+	return
+}
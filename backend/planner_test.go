@@ -0,0 +1,174 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+func TestNewQueryPlan(t *testing.T) {
+	assertPlan(t, `SELECT * FROM cpu WHERE time > 0 LIMIT 10 OFFSET 5`, `SELECT * FROM cpu WHERE time > 0 LIMIT 15`)
+	assertPlan(t, `SELECT count(value) FROM cpu WHERE time > 0 GROUP BY time(1m) LIMIT 10 SLIMIT 2`, `SELECT count(value) FROM cpu WHERE time > 0 GROUP BY time(1m)`)
+	assertPlan(t, `SELECT mean(value), max(value) AS m FROM cpu WHERE time > 0 GROUP BY time(1m), host fill(0)`, `SELECT sum(value), count(value), max(value) FROM cpu WHERE time > 0 GROUP BY time(1m), host`)
+	assertPlan(t, `SELECT first(value), last(value) FROM cpu WHERE time > 0 GROUP BY *`, `SELECT first(value), last(value) FROM cpu WHERE time > 0 GROUP BY *`)
+
+	assertPlanError(t, `SELECT percentile(value, 90) FROM cpu GROUP BY time(1m)`, "function percentile() cannot be merged across backends")
+	assertPlanError(t, `SELECT mean(*) FROM cpu`, ErrMergeWildcard.Error())
+	assertPlanError(t, `SELECT mean(value), host FROM cpu`, "field host cannot be merged with aggregates across backends")
+	assertPlanError(t, `SELECT value, max(value) FROM cpu`, "field value cannot be merged with aggregates across backends")
+	assertPlanError(t, `SELECT mean(value) * 2 FROM cpu`, "field mean(value) * 2 cannot be merged with aggregates across backends")
+	assertPlanError(t, `SELECT abs(value) FROM cpu`, "function abs() cannot be merged across backends")
+	assertPlanError(t, `SELECT mean(value) FROM cpu WHERE time > 0 GROUP BY time(1m) fill(linear)`, ErrMergeFill.Error())
+}
+
+func assertPlan(t *testing.T, q string, partial string) {
+	stmt, ok := ParseSelectStatement(q)
+	if !ok {
+		t.Errorf("parse error: %s", q)
+		return
+	}
+	plan, err := NewQueryPlan(stmt)
+	if err != nil {
+		t.Errorf("error: %s, %s", q, err)
+		return
+	}
+	if plan.Statement.String() != partial {
+		t.Errorf("partial statement wrong: %s, %s != %s", q, plan.Statement, partial)
+	}
+}
+
+func assertPlanError(t *testing.T, q string, e string) {
+	stmt, _ := ParseSelectStatement(q)
+	_, err := NewQueryPlan(stmt)
+	if err == nil || err.Error() != e {
+		t.Errorf("error wrong: %s, %v != %s", q, err, e)
+	}
+}
+
+func TestMergeSeries(t *testing.T) {
+	bodies := [][]byte{
+		[]byte(`{"results":[{"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","sum","count","max"],"values":[[0,10,4,5],[60,null,null,null],[120,3,1,3]]}]}]}`),
+		[]byte(`{"results":[{"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","sum","count","max"],"values":[[0,2.5,1,2.5],[60,null,null,null],[120,1,1,9]]}]}]}`),
+		[]byte(`{"results":[{"series":[{"name":"cpu","tags":{"host":"b"},"columns":["time","sum","count","max"],"values":[[0,1,1,1],[60,null,null,null],[120,null,null,null]]}]}]}`),
+	}
+	assertMerge(t, `SELECT mean(value), max(value) FROM cpu WHERE time >= 0 AND time < 3m GROUP BY time(1m), host fill(none)`, bodies,
+		`[{"name":"cpu","tags":{"host":"a"},"columns":["time","mean","max"],"values":[[0,2.5,5],[120,2,9]]},{"name":"cpu","tags":{"host":"b"},"columns":["time","mean","max"],"values":[[0,1,1]]}]`)
+	assertMerge(t, `SELECT mean(value), max(value) FROM cpu WHERE time >= 0 AND time < 3m GROUP BY time(1m), host fill(-1) ORDER BY time DESC LIMIT 2 SLIMIT 1`, bodies,
+		`[{"name":"cpu","tags":{"host":"a"},"columns":["time","mean","max"],"values":[[120,2,9],[60,-1,-1]]}]`)
+	assertMerge(t, `SELECT mean(value), max(value) FROM cpu WHERE time >= 0 AND time < 3m GROUP BY time(1m), host fill(previous) SOFFSET 1`, bodies,
+		`[{"name":"cpu","tags":{"host":"b"},"columns":["time","mean","max"],"values":[[0,1,1],[60,1,1],[120,1,1]]}]`)
+
+	bodies = [][]byte{
+		[]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","count"],"values":[[0,4]]}]}]}`),
+		[]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","count"],"values":[[0,6]]}]}]}`),
+	}
+	assertMerge(t, `SELECT count(value) FROM cpu`, bodies, `[{"name":"cpu","columns":["time","count"],"values":[[0,10]]}]`)
+
+	bodies = [][]byte{
+		[]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","first"],"values":[["2021-01-01T00:00:01.5Z",1]]}]}]}`),
+		[]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","first"],"values":[["2021-01-01T00:00:01Z",2]]}]}]}`),
+	}
+	assertMerge(t, `SELECT first(value) FROM cpu`, bodies, `[{"name":"cpu","columns":["time","first"],"values":[["2021-01-01T00:00:01Z",2]]}]`)
+	assertMerge(t, `SELECT last(value) FROM cpu`, bodies, `[{"name":"cpu","columns":["time","last"],"values":[["2021-01-01T00:00:01.5Z",1]]}]`)
+
+	bodies = [][]byte{
+		[]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","first"],"values":[["2021-01-01T00:00:00Z",1]]}]}]}`),
+		[]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","first"],"values":[["2021-01-01T00:00:00Z",2]]}]}]}`),
+	}
+	assertMergeError(t, `SELECT first(value) FROM cpu WHERE time >= 0 GROUP BY time(1h)`, bodies, "function first() cannot be merged across backends within the same interval")
+	assertSelectorConflicts(t, `SELECT first(value) FROM cpu WHERE time >= 0 GROUP BY time(1h)`, bodies, "map[0:[1609459200000000000]]")
+	assertSelectorConflicts(t, `SELECT first(value) FROM cpu`, bodies, "map[]")
+
+	bodies = [][]byte{
+		[]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1],[3,3],[5,5]]}]}]}`),
+		[]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","value"],"values":[[2,2],[4,4]]}]}]}`),
+	}
+	assertMerge(t, `SELECT value FROM cpu LIMIT 3 OFFSET 1`, bodies, `[{"name":"cpu","columns":["time","value"],"values":[[2,2],[3,3],[4,4]]}]`)
+}
+
+func TestMergeSelected(t *testing.T) {
+	bodies := [][]byte{
+		[]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","first","count"],"values":[[0,1,2],[3600,5,1]]}]}]}`),
+		[]byte(`{"results":[{"series":[{"name":"cpu","columns":["time","first","count"],"values":[[0,2,1],[3600,null,0]]}]}]}`),
+	}
+	stmt, _ := ParseSelectStatement(`SELECT first(value), count(value) FROM cpu WHERE time >= 0 GROUP BY time(1h)`)
+	plan, _ := NewQueryPlan(stmt)
+	rsps, _ := ResponsesFromResponseBytes(bodies)
+	rsp, _ := concatBySeries(rsps)
+	series := rsp.Results[0].Series
+	conflicts := SelectorConflicts(plan, series)
+	if len(conflicts) != 1 || len(conflicts[0]) != 1 || conflicts[0][0] != 0 {
+		t.Fatalf("conflicts wrong: %v", conflicts)
+	}
+	// the point of the second backend is resolved as the earliest within the first interval
+	plan.Selected = map[selectedKey]interface{}{{field: 0, bucket: 0, series: "cpu\x00"}: 2}
+	rows, err := MergeSeries(plan, series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := util.MarshalJSON(rows, false)
+	if want := `[{"name":"cpu","columns":["time","first","count"],"values":[[0,2,3],[3600,5,1]]}]`; string(b[:len(b)-1]) != want {
+		t.Errorf("series wrong: %s != %s", b[:len(b)-1], want)
+	}
+}
+
+func mergeBodies(q string, bodies [][]byte) (models.Rows, error) {
+	plan, series, err := planBodies(q, bodies)
+	if err != nil {
+		return nil, err
+	}
+	return MergeSeries(plan, series)
+}
+
+func planBodies(q string, bodies [][]byte) (*QueryPlan, models.Rows, error) {
+	stmt, _ := ParseSelectStatement(q)
+	plan, err := NewQueryPlan(stmt)
+	if err != nil {
+		return nil, nil, err
+	}
+	rsps, err := ResponsesFromResponseBytes(bodies)
+	if err != nil {
+		return nil, nil, err
+	}
+	rsp, err := concatBySeries(rsps)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plan, rsp.Results[0].Series, nil
+}
+
+func assertSelectorConflicts(t *testing.T, q string, bodies [][]byte, conflicts string) {
+	plan, series, err := planBodies(q, bodies)
+	if err != nil {
+		t.Errorf("error: %s, %s", q, err)
+		return
+	}
+	if c := fmt.Sprint(SelectorConflicts(plan, series)); c != conflicts {
+		t.Errorf("conflicts wrong: %s, %s != %s", q, c, conflicts)
+	}
+}
+
+func assertMerge(t *testing.T, q string, bodies [][]byte, series string) {
+	rows, err := mergeBodies(q, bodies)
+	if err != nil {
+		t.Errorf("error: %s, %s", q, err)
+		return
+	}
+	b := util.MarshalJSON(rows, false)
+	if string(b[:len(b)-1]) != series {
+		t.Errorf("series wrong: %s, %s != %s", q, b[:len(b)-1], series)
+	}
+}
+
+func assertMergeError(t *testing.T, q string, bodies [][]byte, e string) {
+	_, err := mergeBodies(q, bodies)
+	if err == nil || err.Error() != e {
+		t.Errorf("error wrong: %s, %v != %s", q, err, e)
+	}
+}
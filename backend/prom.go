@@ -0,0 +1,419 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/prometheus"
+	"github.com/chengshiwen/influx-proxy/prometheus/remote"
+	"github.com/influxdata/influxql"
+)
+
+// PromNameLabel is the label of prometheus metric names
+const PromNameLabel = "__name__"
+
+// ReadProm resolves the metrics of each query of the read request, reads every metric from its owning backends
+// and merges the time series into one response whose results are in the order of the queries,
+// the metrics are read in the layout of schema they are written in
+func (ip *Proxy) ReadProm(req *http.Request, db string, readReq *remote.ReadRequest, schema *prometheus.Schema) (rsp *remote.ReadResponse, err error) {
+	metrics, err := ip.matchPromQueries(db, readReq, schema)
+	if err != nil {
+		return
+	}
+	series := make([][][]*remote.TimeSeries, len(readReq.Queries))
+	for i := range readReq.Queries {
+		series[i] = make([][]*remote.TimeSeries, len(metrics[i]))
+	}
+
+	// the metrics are read by at most conn_pool_size goroutines, and no more metric is read after an error
+	var wg sync.WaitGroup
+	errs := make(chan error, 1)
+	concurrency := ip.readConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+read:
+	for i, q := range readReq.Queries {
+		for j, metric := range metrics[i] {
+			sem <- struct{}{}
+			if len(errs) > 0 {
+				<-sem
+				break read
+			}
+			wg.Add(1)
+			go func(i, j int, q *remote.Query, metric string) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				err := readPromSeries(req, ip, db, metric, q, schema, func(labels []*remote.LabelPair, samples []*remote.Sample) error {
+					ts := series[i][j]
+					if n := len(ts); n > 0 && equalLabels(ts[n-1].Labels, labels) {
+						ts[n-1].Samples = append(ts[n-1].Samples, samples...)
+						return nil
+					}
+					series[i][j] = append(ts, &remote.TimeSeries{Labels: labels, Samples: samples})
+					return nil
+				})
+				if err != nil {
+					select {
+					case errs <- fmt.Errorf("read metric %s error: %s", metric, err):
+					default:
+					}
+				}
+			}(i, j, q, metric)
+		}
+	}
+	wg.Wait()
+	select {
+	case err = <-errs:
+		return nil, err
+	default:
+	}
+
+	rsp = &remote.ReadResponse{Results: make([]*remote.QueryResult, len(readReq.Queries))}
+	for i := range series {
+		rsp.Results[i] = &remote.QueryResult{}
+		for _, ts := range series[i] {
+			rsp.Results[i].Timeseries = append(rsp.Results[i].Timeseries, ts...)
+		}
+	}
+	return
+}
+
+// StreamProm reads the metrics of each query one by one and writes every time series as xor chunks
+// in ChunkedReadResponse messages to w, the samples are encoded as the chunks of the selects arrive,
+// so at most a frame of chunks is held in memory
+func (ip *Proxy) StreamProm(req *http.Request, w io.Writer, db string, readReq *remote.ReadRequest, schema *prometheus.Schema) (err error) {
+	metrics, err := ip.matchPromQueries(db, readReq, schema)
+	if err != nil {
+		return
+	}
+	for i, q := range readReq.Queries {
+		for _, metric := range metrics[i] {
+			cw := &chunkedSeriesWriter{w: w, index: int64(i)}
+			err = readPromSeries(req, ip, db, metric, q, schema, cw.Append)
+			if err == nil {
+				err = cw.Flush()
+			}
+			if err != nil {
+				return fmt.Errorf("read metric %s error: %s", metric, err)
+			}
+		}
+	}
+	return
+}
+
+// readPromSeries selects the samples of the metric matched by q from its owning backends in chunks, and calls fn
+// with the samples of each chunk as they arrive, the series are ordered by labels and a series may span several calls
+func readPromSeries(req *http.Request, ip *Proxy, db, metric string, q *remote.Query, schema *prometheus.Schema, fn func(labels []*remote.LabelPair, samples []*remote.Sample) error) (err error) {
+	measurement, _ := schema.ReadSource(metric)
+	stmt, err := PromSelectStatement(q, metric, schema)
+	if err != nil {
+		return
+	}
+	cr := CloneQueryRequest(req)
+	cr.Form = url.Values{}
+	cr.Form.Set("db", db)
+	cr.Form.Set("q", stmt.String())
+	cr.Form.Set("epoch", "ms")
+	cr.Form.Set("chunked", "true")
+	cr.Form.Set("chunk_size", strconv.Itoa(DefaultChunkSize))
+	cr.Header.Del("Content-Encoding")
+	cr.Header.Del("Content-Type")
+	cr.Header.Del("Accept-Encoding")
+	cr.Header.Set("Accept", "application/json")
+
+	dw := newDecodeWriter(func(r io.Reader) error {
+		return decodeResponses(r, func(rsp *Response) error {
+			for _, serie := range SeriesFromResponse(rsp) {
+				if err := fn(promLabels(metric, serie.Tags), promSamples(serie.Values)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	var b []byte
+	if key := GetKey(db, measurement); IsShardedKey(key) {
+		// the series of a sharded metric are merged from all backends, so the response is not streamed
+		b, err = QueryFanOutQL(dw, cr, ip, stmt, db)
+	} else {
+		_, err = query(dw, cr, ip, key, func(be *Backend, req *http.Request, w http.ResponseWriter) ([]byte, error) {
+			if be.IsV2() {
+				return nil, ErrUnsupportedV2
+			}
+			qr := be.QueryStream(req, w)
+			return nil, qr.Err
+		})
+	}
+	if err == nil && b != nil {
+		_, err = dw.Write(b)
+	}
+	if derr := dw.Close(); err == nil {
+		err = derr
+	}
+	return
+}
+
+// PromSelectStatement returns the select of the samples of metric matched by q from the measurement and field
+// of the metric in schema, the labels are stored as tags
+func PromSelectStatement(q *remote.Query, metric string, schema *prometheus.Schema) (*influxql.SelectStatement, error) {
+	measurement, field := schema.ReadSource(metric)
+	timeRef := &influxql.VarRef{Val: "time"}
+	var cond influxql.Expr = &influxql.BinaryExpr{
+		Op:  influxql.AND,
+		LHS: &influxql.BinaryExpr{Op: influxql.GTE, LHS: timeRef, RHS: &influxql.TimeLiteral{Val: time.Unix(0, q.StartTimestampMs*int64(time.Millisecond)).UTC()}},
+		RHS: &influxql.BinaryExpr{Op: influxql.LTE, LHS: timeRef, RHS: &influxql.TimeLiteral{Val: time.Unix(0, q.EndTimestampMs*int64(time.Millisecond)).UTC()}},
+	}
+	for _, m := range q.Matchers {
+		if m.Name == PromNameLabel {
+			continue
+		}
+		expr := &influxql.BinaryExpr{LHS: &influxql.VarRef{Val: m.Name, Type: influxql.Tag}}
+		switch m.Type {
+		case remote.MatchType_EQUAL:
+			expr.Op, expr.RHS = influxql.EQ, &influxql.StringLiteral{Val: m.Value}
+		case remote.MatchType_NOT_EQUAL:
+			expr.Op, expr.RHS = influxql.NEQ, &influxql.StringLiteral{Val: m.Value}
+		case remote.MatchType_REGEX_MATCH, remote.MatchType_REGEX_NO_MATCH:
+			// prometheus regexes are fully anchored
+			re, err := regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex matcher %s: %s", m.Value, err)
+			}
+			expr.Op, expr.RHS = influxql.EQREGEX, &influxql.RegexLiteral{Val: re}
+			if m.Type == remote.MatchType_REGEX_NO_MATCH {
+				expr.Op = influxql.NEQREGEX
+			}
+		default:
+			continue
+		}
+		cond = &influxql.BinaryExpr{Op: influxql.AND, LHS: cond, RHS: expr}
+	}
+	return &influxql.SelectStatement{
+		Fields:     influxql.Fields{{Expr: &influxql.VarRef{Val: field}}},
+		Sources:    influxql.Sources{&influxql.Measurement{Name: measurement}},
+		Condition:  cond,
+		Dimensions: influxql.Dimensions{{Expr: &influxql.Wildcard{}}},
+	}, nil
+}
+
+// promLabels returns the labels of a series sorted by name, tags of empty values are absent labels,
+// and the name label is the metric even if it is stored as a tag
+func promLabels(metric string, tags map[string]string) []*remote.LabelPair {
+	labels := []*remote.LabelPair{{Name: PromNameLabel, Value: metric}}
+	for k, v := range tags {
+		if v != "" && k != PromNameLabel {
+			labels = append(labels, &remote.LabelPair{Name: k, Value: v})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+// promSamples returns the samples of the rows of time in milliseconds and value, rows of null values are skipped
+func promSamples(values [][]interface{}) []*remote.Sample {
+	samples := make([]*remote.Sample, 0, len(values))
+	for _, value := range values {
+		if len(value) < 2 {
+			continue
+		}
+		v, ok := value[1].(number)
+		if !ok {
+			continue
+		}
+		f, err := v.Float64()
+		if err != nil {
+			continue
+		}
+		samples = append(samples, &remote.Sample{TimestampMs: parseTime(value[0]), Value: f})
+	}
+	return samples
+}
+
+func equalLabels(a, b []*remote.LabelPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Name != b[i].Name || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+// chunkedSeriesWriter encodes the samples of the series of a query into xor chunks as they are appended, and writes
+// the chunks of each series in ChunkedReadResponse messages to w, which are split over prometheus.MaxBytesPerFrame
+type chunkedSeriesWriter struct {
+	w       io.Writer
+	index   int64
+	labels  []*remote.LabelPair
+	chunks  []*remote.Chunk
+	size    int
+	chunk   *prometheus.XORChunk
+	minTime int64
+	maxTime int64
+}
+
+// Append appends the samples sorted by time of the series with sorted labels, other labels end the previous series
+func (cw *chunkedSeriesWriter) Append(labels []*remote.LabelPair, samples []*remote.Sample) error {
+	if cw.labels != nil && !equalLabels(cw.labels, labels) {
+		if err := cw.Flush(); err != nil {
+			return err
+		}
+	}
+	cw.labels = labels
+	for _, s := range samples {
+		if cw.chunk == nil {
+			cw.chunk, cw.minTime = prometheus.NewXORChunk(), s.TimestampMs
+		}
+		cw.chunk.Append(s.TimestampMs, s.Value)
+		cw.maxTime = s.TimestampMs
+		if cw.chunk.NumSamples() == prometheus.MaxSamplesPerChunk {
+			if err := cw.cut(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Flush writes the remaining chunks of the current series
+func (cw *chunkedSeriesWriter) Flush() error {
+	if cw.chunk != nil {
+		if err := cw.cut(); err != nil {
+			return err
+		}
+	}
+	err := cw.writeFrame()
+	cw.labels = nil
+	return err
+}
+
+// cut ends the current chunk, the previous chunks are written in a frame first if the chunk exceeds the frame
+func (cw *chunkedSeriesWriter) cut() error {
+	data := cw.chunk.Bytes()
+	if len(cw.chunks) > 0 && cw.size+len(data) > prometheus.MaxBytesPerFrame {
+		if err := cw.writeFrame(); err != nil {
+			return err
+		}
+	}
+	cw.chunks = append(cw.chunks, &remote.Chunk{MinTimeMs: cw.minTime, MaxTimeMs: cw.maxTime, Type: remote.Chunk_XOR, Data: data})
+	cw.size += len(data)
+	cw.chunk = nil
+	return nil
+}
+
+func (cw *chunkedSeriesWriter) writeFrame() error {
+	if len(cw.chunks) == 0 {
+		return nil
+	}
+	msg := &remote.ChunkedReadResponse{
+		ChunkedSeries: []*remote.ChunkedSeries{{Labels: cw.labels, Chunks: cw.chunks}},
+		QueryIndex:    cw.index,
+	}
+	data, err := msg.Marshal()
+	if err != nil {
+		return err
+	}
+	cw.chunks, cw.size = nil, 0
+	_, err = cw.w.Write(data)
+	return err
+}
+
+// matchPromQueries returns the metrics matched by each query, the merged metrics are listed once,
+// and only when a query does not name its metric, the metrics are the measurements in SchemaV1
+// and the field keys of the measurement of all metrics in SchemaV2
+func (ip *Proxy) matchPromQueries(db string, readReq *remote.ReadRequest, schema *prometheus.Schema) (metrics [][]string, err error) {
+	if err = schema.CheckRead(); err != nil {
+		return
+	}
+	var names []string
+	list := func() ([]string, error) {
+		if names == nil {
+			if measurement, ok := schema.MetricsMeasurement(); ok {
+				names, err = ip.GetFieldKeys(db, measurement)
+			} else {
+				names, err = ip.GetMeasurements(db, nil)
+			}
+		}
+		return names, err
+	}
+	metrics = make([][]string, len(readReq.Queries))
+	for i, q := range readReq.Queries {
+		if metrics[i], err = MatchPromMetrics(q.Matchers, list); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// MatchPromMetrics returns the metrics matched by all name matchers, the candidates are listed by list
+// unless a name is matched by equality, prometheus regexes are fully anchored
+func MatchPromMetrics(matchers []*remote.LabelMatcher, list func() ([]string, error)) (metrics []string, err error) {
+	var names []func(string) bool
+	var candidates []string
+	for _, m := range matchers {
+		if m.Name != PromNameLabel {
+			continue
+		}
+		match, err := compilePromMatcher(m)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, match)
+		if m.Type == remote.MatchType_EQUAL && candidates == nil {
+			candidates = []string{m.Value}
+		}
+	}
+	if candidates == nil {
+		if candidates, err = list(); err != nil {
+			return
+		}
+	}
+	for _, metric := range candidates {
+		matched := true
+		for _, match := range names {
+			if matched = match(metric); !matched {
+				break
+			}
+		}
+		if matched {
+			metrics = append(metrics, metric)
+		}
+	}
+	return
+}
+
+func compilePromMatcher(m *remote.LabelMatcher) (func(string) bool, error) {
+	switch m.Type {
+	case remote.MatchType_EQUAL:
+		return func(v string) bool { return v == m.Value }, nil
+	case remote.MatchType_NOT_EQUAL:
+		return func(v string) bool { return v != m.Value }, nil
+	case remote.MatchType_REGEX_MATCH, remote.MatchType_REGEX_NO_MATCH:
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex matcher %s: %s", m.Value, err)
+		}
+		want := m.Type == remote.MatchType_REGEX_MATCH
+		return func(v string) bool { return re.MatchString(v) == want }, nil
+	}
+	return nil, fmt.Errorf("unknown matcher type %s", m.Type)
+}
@@ -0,0 +1,340 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/prometheus"
+	"github.com/chengshiwen/influx-proxy/prometheus/remote"
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxql"
+)
+
+func TestMatchPromMetrics(t *testing.T) {
+	all := []string{"cpu_idle", "cpu_user", "mem_free", "up"}
+	matcher := func(typ remote.MatchType, value string) *remote.LabelMatcher {
+		return &remote.LabelMatcher{Type: typ, Name: PromNameLabel, Value: value}
+	}
+	tests := []struct {
+		name     string
+		matchers []*remote.LabelMatcher
+		want     []string
+		listed   bool
+	}{
+		{
+			name:     "equal",
+			matchers: []*remote.LabelMatcher{matcher(remote.MatchType_EQUAL, "cpu_idle")},
+			want:     []string{"cpu_idle"},
+		},
+		{
+			name:     "regex",
+			matchers: []*remote.LabelMatcher{matcher(remote.MatchType_REGEX_MATCH, "cpu_.*")},
+			want:     []string{"cpu_idle", "cpu_user"},
+			listed:   true,
+		},
+		{
+			name:     "anchored regex",
+			matchers: []*remote.LabelMatcher{matcher(remote.MatchType_REGEX_MATCH, "cpu")},
+			listed:   true,
+		},
+		{
+			name:     "not equal and regex no match",
+			matchers: []*remote.LabelMatcher{matcher(remote.MatchType_NOT_EQUAL, "up"), matcher(remote.MatchType_REGEX_NO_MATCH, "cpu_.+")},
+			want:     []string{"mem_free"},
+			listed:   true,
+		},
+		{
+			name:     "no name",
+			matchers: []*remote.LabelMatcher{{Type: remote.MatchType_EQUAL, Name: "job", Value: "node"}},
+			want:     all,
+			listed:   true,
+		},
+	}
+	for _, tt := range tests {
+		listed := false
+		got, err := MatchPromMetrics(tt.matchers, func() ([]string, error) {
+			listed = true
+			return all, nil
+		})
+		if err != nil || !reflect.DeepEqual(got, tt.want) || listed != tt.listed {
+			t.Errorf("%v: got %v, %v, listed %v, want %v, listed %v", tt.name, got, err, listed, tt.want, tt.listed)
+		}
+	}
+	if _, err := MatchPromMetrics([]*remote.LabelMatcher{matcher(remote.MatchType_REGEX_MATCH, "(")}, nil); err == nil {
+		t.Error("invalid regex should be rejected")
+	}
+}
+
+func TestPromSelectStatement(t *testing.T) {
+	q := &remote.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers: []*remote.LabelMatcher{
+			{Type: remote.MatchType_REGEX_MATCH, Name: PromNameLabel, Value: "cpu_.*"},
+			{Type: remote.MatchType_EQUAL, Name: "job", Value: "node"},
+			{Type: remote.MatchType_NOT_EQUAL, Name: "mode", Value: ""},
+			{Type: remote.MatchType_REGEX_NO_MATCH, Name: "path", Value: "/var/.*"},
+		},
+	}
+	cond := `time >= '1970-01-01T00:00:01Z' AND time <= '1970-01-01T00:00:02Z' AND job::tag = 'node' AND mode::tag != '' AND path::tag !~ /^(?:\/var\/.*)$/`
+	tests := []struct {
+		schema *prometheus.Schema
+		want   string
+	}{
+		{prometheus.NewSchema(prometheus.SchemaV1, "", nil), `SELECT value FROM cpu_idle WHERE ` + cond + ` GROUP BY *`},
+		{prometheus.NewSchema(prometheus.SchemaV2, "", nil), `SELECT cpu_idle FROM prometheus WHERE ` + cond + ` GROUP BY *`},
+	}
+	for _, tt := range tests {
+		stmt, err := PromSelectStatement(q, "cpu_idle", tt.schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := stmt.String(); got != tt.want {
+			t.Errorf("schema %s: got %s, want %s", tt.schema.Version, got, tt.want)
+		}
+		if _, err = influxql.ParseStatement(stmt.String()); err != nil {
+			t.Errorf("statement cannot be parsed: %s", err)
+		}
+	}
+
+	q.Matchers = append(q.Matchers, &remote.LabelMatcher{Type: remote.MatchType_REGEX_MATCH, Name: "job", Value: "("})
+	if _, err := PromSelectStatement(q, "cpu_idle", prometheus.NewSchema(prometheus.SchemaV1, "", nil)); err == nil {
+		t.Error("invalid regex should be rejected")
+	}
+}
+
+func TestXORChunk(t *testing.T) {
+	c := prometheus.NewXORChunk()
+	c.Append(1000, 1)
+	c.Append(2000, 2)
+	c.Append(3000, 2)
+	c.Append(4500, 3.5)
+	// encoded by the xor chunk of the prometheus tsdb
+	want := []byte{0x0, 0x4, 0xd0, 0xf, 0x3f, 0xf0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0xe8, 0x7, 0xc2, 0x5f, 0xff, 0x20, 0x7d, 0x36, 0x5, 0x80}
+	if !bytes.Equal(c.Bytes(), want) {
+		t.Errorf("got %#v, want %#v", c.Bytes(), want)
+	}
+}
+
+func TestWriteChunkedSeries(t *testing.T) {
+	labels := promLabels("cpu", map[string]string{"host": "h1", "mode": ""})
+	var buf bytes.Buffer
+	cw := &chunkedSeriesWriter{w: prometheus.NewChunkedWriter(&buf, nil), index: 1}
+	// the samples of a series arrive in several chunks of the select
+	next := 0
+	for _, n := range []int{100, 150} {
+		var samples []*remote.Sample
+		for ; n > 0; n-- {
+			samples = append(samples, &remote.Sample{TimestampMs: int64(next) * 1000, Value: float64(next)})
+			next++
+		}
+		if err := cw.Append(labels, samples); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(&buf)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, 4+size)
+	if _, err = io.ReadFull(r, frame); err != nil {
+		t.Fatal(err)
+	}
+	if sum := crc32.Checksum(frame[4:], crc32.MakeTable(crc32.Castagnoli)); sum != binary.BigEndian.Uint32(frame) {
+		t.Errorf("checksum mismatch: %x", sum)
+	}
+	if _, err = r.ReadByte(); err != io.EOF {
+		t.Errorf("got more than one frame")
+	}
+
+	var rsp remote.ChunkedReadResponse
+	if err = rsp.Unmarshal(frame[4:]); err != nil {
+		t.Fatal(err)
+	}
+	if rsp.QueryIndex != 1 || len(rsp.ChunkedSeries) != 1 {
+		t.Fatalf("got query index %d and %d series", rsp.QueryIndex, len(rsp.ChunkedSeries))
+	}
+	series := rsp.ChunkedSeries[0]
+	if len(series.Labels) != 2 || series.Labels[0].Name != PromNameLabel || series.Labels[1].Name != "host" {
+		t.Errorf("labels not sorted or empty labels kept: %v", series.Labels)
+	}
+	var got [][3]int64
+	for _, c := range series.Chunks {
+		got = append(got, [3]int64{c.MinTimeMs, c.MaxTimeMs, int64(binary.BigEndian.Uint16(c.Data))})
+	}
+	want := [][3]int64{{0, 119000, 120}, {120000, 239000, 120}, {240000, 249000, 10}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got chunks %v, want %v", got, want)
+	}
+}
+
+func TestReadPromSchema(t *testing.T) {
+	dir, err := os.MkdirTemp("", "influx-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var points []models.Point
+	// the backend answers the selects with the stored points of the measurement and field of the statement
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		q := r.FormValue("q")
+		var series models.Rows
+		rows := make(map[string]*models.Row)
+		add := func(key string, row *models.Row, value []interface{}) {
+			if rows[key] == nil {
+				rows[key] = row
+				series = append(series, row)
+			}
+			rows[key].Values = append(rows[key].Values, value)
+		}
+		stmt, _ := influxql.ParseStatement(q)
+		for _, p := range points {
+			fields, _ := p.Fields()
+			switch st := stmt.(type) {
+			case *influxql.ShowMeasurementsStatement:
+				add("", &models.Row{Name: "measurements", Columns: []string{"name"}}, []interface{}{string(p.Name())})
+			case *influxql.ShowFieldKeysStatement:
+				if string(p.Name()) == st.Sources[0].(*influxql.Measurement).Name {
+					for k := range fields {
+						add("", &models.Row{Name: string(p.Name()), Columns: []string{"fieldKey", "fieldType"}}, []interface{}{k, "float"})
+					}
+				}
+			case *influxql.SelectStatement:
+				field := st.Fields[0].Expr.(*influxql.VarRef).Val
+				if v, ok := fields[field]; ok && string(p.Name()) == st.Sources[0].(*influxql.Measurement).Name {
+					row := &models.Row{Name: string(p.Name()), Tags: p.Tags().Map(), Columns: []string{"time", field}}
+					add(string(p.Key()), row, []interface{}{p.UnixNano() / 1e6, v})
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(util.MarshalJSON(ResponseFromSeries(series), false))
+	}))
+	defer server.Close()
+
+	cfg := &ProxyConfig{
+		Circles: []*CircleConfig{{Name: "circle-1", Backends: []*BackendConfig{{Name: "b1", Url: server.URL}}}},
+		DataDir: dir,
+	}
+	cfg.setDefault()
+	ip := NewProxy(cfg)
+	defer ip.Close()
+
+	label := func(name, value string) *remote.LabelPair { return &remote.LabelPair{Name: name, Value: value} }
+	writeReq := &remote.WriteRequest{Timeseries: []*remote.TimeSeries{
+		{Labels: []*remote.LabelPair{label(PromNameLabel, "cpu_idle"), label("host", "a")}, Samples: []*remote.Sample{{TimestampMs: 1000, Value: 1}, {TimestampMs: 2000, Value: 2}}},
+		{Labels: []*remote.LabelPair{label(PromNameLabel, "cpu_idle"), label("host", "b")}, Samples: []*remote.Sample{{TimestampMs: 1000, Value: 3}}},
+		{Labels: []*remote.LabelPair{label(PromNameLabel, "up"), label("host", "a")}, Samples: []*remote.Sample{{TimestampMs: 1000, Value: 1}}},
+	}}
+	readReq := &remote.ReadRequest{Queries: []*remote.Query{{
+		StartTimestampMs: 0,
+		EndTimestampMs:   3000,
+		Matchers:         []*remote.LabelMatcher{{Type: remote.MatchType_REGEX_MATCH, Name: PromNameLabel, Value: "cpu_.*"}},
+	}}}
+	for _, version := range []string{prometheus.SchemaV1, prometheus.SchemaV2} {
+		schema := prometheus.NewSchema(version, "", nil)
+		if points, err = prometheus.WriteRequestToPoints(writeReq, schema); err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/api/v1/prom/read", nil)
+		rsp, err := ip.ReadProm(req, "db1", readReq, schema)
+		if err != nil {
+			t.Fatalf("schema %s: %s", version, err)
+		}
+		var got []*remote.TimeSeries
+		for _, result := range rsp.Results {
+			got = append(got, result.Timeseries...)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i].String() < got[j].String() })
+		if want := writeReq.Timeseries[:2]; !reflect.DeepEqual(got, want) {
+			t.Errorf("schema %s: got %v, want %v", version, got, want)
+		}
+	}
+
+	schema := prometheus.NewSchema(prometheus.SchemaV1, "job", nil)
+	if _, err = ip.ReadProm(httptest.NewRequest("POST", "/api/v1/prom/read", nil), "db1", readReq, schema); err != prometheus.ErrReadMeasurementLabel {
+		t.Errorf("got error %v, want %v", err, prometheus.ErrReadMeasurementLabel)
+	}
+}
+
+func TestReadPromConcurrency(t *testing.T) {
+	dir, err := os.MkdirTemp("", "influx-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mu sync.Mutex
+	var inflight, peak, selects int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ping" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if q := r.FormValue("q"); strings.HasPrefix(q, "show measurements") {
+			w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"measurements","columns":["name"],"values":[["m0"],["m1"],["m2"],["m3"],["m4"],["m5"],["m6"],["m7"]]}]}]}`))
+			return
+		}
+		mu.Lock()
+		selects++
+		inflight++
+		if inflight > peak {
+			peak = inflight
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inflight--
+		mu.Unlock()
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer server.Close()
+
+	cfg := &ProxyConfig{
+		Circles:      []*CircleConfig{{Name: "circle-1", Backends: []*BackendConfig{{Name: "b1", Url: server.URL}}}},
+		DataDir:      dir,
+		ConnPoolSize: 2,
+	}
+	cfg.setDefault()
+	ip := NewProxy(cfg)
+	defer ip.Close()
+
+	readReq := &remote.ReadRequest{Queries: []*remote.Query{{
+		EndTimestampMs: 1000,
+		Matchers:       []*remote.LabelMatcher{{Type: remote.MatchType_REGEX_MATCH, Name: PromNameLabel, Value: "m.*"}},
+	}}}
+	if _, err = ip.ReadProm(httptest.NewRequest("POST", "/api/v1/prom/read", nil), "db1", readReq, prometheus.NewSchema("", "", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if selects != 8 || peak > 2 {
+		t.Errorf("got %d selects with %d in flight, want 8 selects with at most 2 in flight", selects, peak)
+	}
+}
@@ -5,35 +5,74 @@
 package backend
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"math/rand"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/chengshiwen/influx-proxy/logging"
+	"github.com/chengshiwen/influx-proxy/tracing"
 	"github.com/chengshiwen/influx-proxy/util"
 	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxql"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
 )
 
-var HashKeyMeasureOnly = false
+var (
+	HashKeyMeasureOnly = false
+	ShardedKeySet      = util.NewSet()
+)
 
 type Proxy struct {
-	Circles []*Circle
-	dbSet   util.Set
+	Circles      []*Circle
+	dbSet        util.Set
+	cache        *QueryCache
+	guardrails   map[string]*GuardrailConfig
+	queryTimeout time.Duration
+	// readConcurrency limits the backend reads in flight of a request reading several measurements
+	readConcurrency int
+
+	shadowReadRatio float64
+	shadowStats     *ShadowReadStats
+	shadowSem       chan struct{}
+
+	metrics    *prometheus.Registry
+	metricsMu  sync.Mutex
+	metricsDBs util.Set
+
+	done chan struct{}
 }
 
 func NewProxy(cfg *ProxyConfig) (ip *Proxy) {
 	err := util.MakeDir(cfg.DataDir)
 	if err != nil {
-		log.Fatalf("create data dir error: %s", err)
+		logging.L().Fatal("create data dir error", zap.Error(err))
 		return
 	}
 	ip = &Proxy{
-		Circles: make([]*Circle, len(cfg.Circles)),
-		dbSet:   util.NewSet(),
+		Circles:      make([]*Circle, len(cfg.Circles)),
+		dbSet:        util.NewSet(),
+		queryTimeout: time.Duration(cfg.QueryTimeout) * time.Second,
+
+		readConcurrency: cfg.ConnPoolSize,
+
+		shadowReadRatio: cfg.ShadowReadRatio,
+		shadowStats:     &ShadowReadStats{},
+		shadowSem:       make(chan struct{}, maxShadowReads),
+
+		metrics:    prometheus.NewRegistry(),
+		metricsDBs: util.NewSet(),
+
+		done: make(chan struct{}),
 	}
+	ip.metrics.MustRegister(NewProxyCollector(ip))
 	for idx, circfg := range cfg.Circles {
 		ip.Circles[idx] = NewCircle(circfg, cfg, idx)
 	}
@@ -43,6 +82,21 @@ func NewProxy(cfg *ProxyConfig) (ip *Proxy) {
 	if cfg.HashKeyMeasureOnly {
 		HashKeyMeasureOnly = true
 	}
+	for _, key := range cfg.ShardedMeasurements {
+		ShardedKeySet.Add(key)
+	}
+	if cfg.QueryCacheSize > 0 {
+		ip.cache = NewQueryCache(cfg.QueryCacheSize, time.Duration(cfg.QueryCacheTTL)*time.Second, time.Duration(cfg.QueryCachePastTTL)*time.Second)
+	}
+	if len(cfg.QueryGuardrails) > 0 {
+		ip.guardrails = make(map[string]*GuardrailConfig)
+		for _, g := range cfg.QueryGuardrails {
+			ip.guardrails[g.Database] = g
+		}
+	}
+	if cfg.MonitorDatabase != "" {
+		go ip.Monitor(cfg.MonitorDatabase, time.Duration(cfg.MonitorInterval)*time.Second)
+	}
 	rand.Seed(time.Now().UnixNano())
 	return
 }
@@ -59,6 +113,21 @@ func GetKey(db, meas string) string {
 	return b.String()
 }
 
+// IsShardedKey reports whether the points of key(db,meas) are spread over all backends of a circle by series
+func IsShardedKey(key string) bool {
+	return ShardedKeySet[key]
+}
+
+func GetSeriesKey(key string, line []byte) string {
+	_, tags := models.ParseKey(line)
+	sort.Sort(tags)
+	var b strings.Builder
+	b.WriteString(key)
+	b.WriteByte('|')
+	b.Write(tags.HashKey())
+	return b.String()
+}
+
 func (ip *Proxy) GetBackends(key string) []*Backend {
 	backends := make([]*Backend, len(ip.Circles))
 	for i, circle := range ip.Circles {
@@ -79,6 +148,99 @@ func (ip *Proxy) GetAllBackends() []*Backend {
 	return backends
 }
 
+// GetV1Backends returns the backends of all circles except the v2 backends,
+// whose buckets, users and tasks are managed on the backends
+func (ip *Proxy) GetV1Backends() []*Backend {
+	var backends []*Backend
+	for _, be := range ip.GetAllBackends() {
+		if !be.IsV2() {
+			backends = append(backends, be)
+		}
+	}
+	return backends
+}
+
+func (ip *Proxy) GetBackendByName(name string) *Backend {
+	for _, circle := range ip.Circles {
+		for _, be := range circle.Backends {
+			if be.Name == name {
+				return be
+			}
+		}
+	}
+	return nil
+}
+
+// GetQueryCircle returns a random circle whose backends of all keys (all backends if keys is nil) are readable,
+// otherwise a random circle whose backends of all keys are active
+func (ip *Proxy) GetQueryCircle(keys []string) *Circle {
+	return ip.getQueryCircle(keys, func(*Backend) bool { return true })
+}
+
+// GetV1QueryCircle returns a query circle like GetQueryCircle whose backends are all v1 backends
+func (ip *Proxy) GetV1QueryCircle() *Circle {
+	return ip.getQueryCircle(nil, func(be *Backend) bool { return !be.IsV2() })
+}
+
+func (ip *Proxy) getQueryCircle(keys []string, accept func(*Backend) bool) *Circle {
+	perms := rand.Perm(len(ip.Circles))
+	for _, p := range perms {
+		circle := ip.Circles[p]
+		if circle.checkBackends(keys, func(be *Backend) bool {
+			return accept(be) && be.IsActive() && !be.IsRewriting() && !be.IsWriteOnly()
+		}) {
+			return circle
+		}
+	}
+	for _, p := range perms {
+		circle := ip.Circles[p]
+		if circle.checkBackends(keys, func(be *Backend) bool {
+			return accept(be) && be.IsActive()
+		}) {
+			return circle
+		}
+	}
+	return nil
+}
+
+func (ip *Proxy) GetMeasurements(db string, regex *influxql.RegexLiteral) ([]string, error) {
+	q := "show measurements"
+	if regex != nil {
+		q = fmt.Sprintf("show measurements with measurement =~ %s", regex.String())
+	}
+	return ip.getValues(db, q)
+}
+
+// GetFieldKeys returns the merged field keys of meas of all backends
+func (ip *Proxy) GetFieldKeys(db, meas string) ([]string, error) {
+	return ip.getValues(db, fmt.Sprintf("show field keys from \"%s\"", util.EscapeIdentifier(meas)))
+}
+
+// getValues returns the sorted first column of the merged values of the show statement q of all backends
+func (ip *Proxy) getValues(db, q string) ([]string, error) {
+	req := NewQueryRequest("GET", db, q, "")
+	bodies, _, err := QueryInParallel(ip.GetAllBackends(), req, nil, true)
+	if err != nil {
+		return nil, err
+	}
+	rsps, err := ResponsesFromResponseBytes(bodies)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := reduceByValues(rsps)
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	for _, serie := range rsp.Results[0].Series {
+		for _, value := range serie.Values {
+			values = append(values, value[0].(string))
+		}
+	}
+	sort.Strings(values)
+	return values, nil
+}
+
 func (ip *Proxy) GetHealth(stats bool) []interface{} {
 	var wg sync.WaitGroup
 	health := make([]interface{}, len(ip.Circles))
@@ -98,24 +260,53 @@ func (ip *Proxy) IsForbiddenDB(db string) bool {
 }
 
 func (ip *Proxy) QueryFlux(w http.ResponseWriter, req *http.Request, qr *QueryRequest) (err error) {
-	var bucket, meas string
+	var buckets, measurements []string
+	var checkMerge func() error
 	if qr.Query != "" {
-		bucket, meas, err = ScanQuery(qr.Query)
+		var fq *FluxQuery
+		fq, err = ParseFluxQuery(qr.Query)
+		if err != nil {
+			return
+		}
+		buckets, measurements, err = fq.Sources()
+		checkMerge = fq.CheckMerge
 	} else if qr.Spec != nil {
+		var bucket, meas string
 		bucket, meas, err = ScanSpec(qr.Spec)
+		buckets, measurements = []string{bucket}, []string{meas}
+		checkMerge = qr.Spec.CheckMerge
 	}
 	if err != nil {
 		return
 	}
-	if bucket == "" {
+	var keys []string
+	sharded := false
+	for _, bucket := range buckets {
+		if bucket == "" {
+			return ErrGetBucket
+		} else if ip.IsForbiddenDB(bucket) {
+			return fmt.Errorf("database forbidden: %s", bucket)
+		}
+		for _, meas := range measurements {
+			if meas == "" {
+				return ErrGetMeasurement
+			}
+			key := GetKey(bucket, meas)
+			keys = appendUnique(keys, key)
+			sharded = sharded || IsShardedKey(key)
+		}
+	}
+	if len(keys) == 0 {
 		return ErrGetBucket
-	} else if ip.IsForbiddenDB(bucket) {
-		return fmt.Errorf("database forbidden: %s", bucket)
 	}
-	if meas == "" {
-		return ErrGetMeasurement
+	if len(buckets) > 1 || len(measurements) > 1 || sharded {
+		// the tables of the backends are concatenated, which is only right for scripts transforming each table alone
+		if err = checkMerge(); err != nil {
+			return
+		}
+		return QueryFanOutFlux(w, req, ip, keys)
 	}
-	return QueryFlux(w, req, ip, bucket, meas)
+	return QueryFlux(w, req, ip, buckets[0], measurements[0])
 }
 
 func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, err error) {
@@ -123,12 +314,121 @@ func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, e
 	if q == "" {
 		return nil, ErrEmptyQuery
 	}
+	ctx, span := tracing.Start(req.Context(), "Proxy.Query", tracing.Query(q), tracing.DB(req.FormValue("db")))
+	defer func() { tracing.End(span, err) }()
+	req = req.WithContext(ctx)
+
+	// backend requests derive from the client context, which is canceled when the client disconnects or on timeout
+	if ip.queryTimeout > 0 {
+		ctx, cancel := context.WithTimeout(req.Context(), ip.queryTimeout)
+		defer cancel()
+		req = req.WithContext(ctx)
+		defer func() {
+			if ctx.Err() == context.DeadlineExceeded && (err != nil || body != nil) {
+				body, err = nil, ErrQueryTimeout
+			}
+		}()
+	}
 
+	stmts := SplitStatements(q)
+	if len(stmts) > 1 {
+		return ip.queryStatements(w, req, stmts)
+	}
+	if ip.cache != nil {
+		return ip.queryCached(w, req, q)
+	}
+	return ip.queryStatement(w, req, q)
+}
+
+func (ip *Proxy) queryCached(w http.ResponseWriter, req *http.Request, q string) (body []byte, err error) {
+	key, tags, ttl, ok := ip.cache.Key(req, q, req.FormValue("db"))
+	if !ok {
+		return ip.queryStatement(w, req, q)
+	}
+	if header, body, ok := ip.cache.Get(key); ok {
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		w.Header().Del("Content-Length")
+		return body, nil
+	}
+	// the response is buffered and decoded rather than streamed, so that only the results without error are cached
+	cr := CloneQueryRequest(req)
+	cr.Header.Del("Accept-Encoding")
+	cr.Header.Set("Accept", "application/json")
+	cr.Header.Set(HeaderQueryOrigin, QueryCached)
+	b, err := ip.queryStatement(w, cr, q)
+	if err != nil || b == nil {
+		return b, err
+	}
+	w.Header().Del("Content-Encoding")
+	rsp, err := ResponseFromResponseBytes(b)
+	if err != nil {
+		return
+	}
+	body, err = MarshalResponse(w, req, rsp)
+	if err == nil && checkResponses([]*Response{rsp}) == nil {
+		ip.cache.Set(key, tags, ttl, w.Header(), body)
+	}
+	return
+}
+
+func (ip *Proxy) queryStatements(w http.ResponseWriter, req *http.Request, stmts []string) (body []byte, err error) {
+	// each statement is routed and executed independently, then all results are reassembled into one response
+	results := make([]*Result, 0, len(stmts))
+	for i, stmt := range stmts {
+		cr := CloneQueryRequest(req)
+		cr.Form.Set("q", stmt)
+		cr.Form.Del("chunked")
+		cr.Header.Del("Accept-Encoding")
+		cr.Header.Set(HeaderQueryOrigin, QueryStatements)
+		cr.Header.Set("Accept", "application/json")
+		var rsp *Response
+		b, err := ip.queryStatement(w, cr, stmt)
+		if err == nil {
+			rsp, err = ResponseFromResponseBytes(b)
+		}
+		if err == nil && rsp.Err != "" {
+			err = errors.New(rsp.Err)
+		}
+		if err != nil {
+			results = append(results, &Result{StatementID: i, Err: err.Error()})
+			break
+		}
+		for _, r := range rsp.Results {
+			r.StatementID = i
+			results = append(results, r)
+		}
+	}
+	w.Header().Del("Content-Encoding")
+	return MarshalResponse(w, req, ResponseFromResults(results))
+}
+
+func (ip *Proxy) queryStatement(w http.ResponseWriter, req *http.Request, q string) (body []byte, err error) {
 	tokens, check, from := CheckQuery(q)
 	if !check {
 		return nil, ErrIllegalQL
 	}
 
+	switch CheckQueriesFromTokens(tokens) {
+	case "show queries":
+		return QueryShowQueriesQL(w, req, ip)
+	case "kill query":
+		return QueryKillQL(w, req, ip)
+	}
+
+	user, show := CheckUserFromTokens(tokens)
+	cq := CheckContinuousQueryFromTokens(tokens)
+	if user || cq != "" {
+		if db, _ := GetDatabaseFromTokens(tokens); db != "" && ip.IsForbiddenDB(db) {
+			return nil, fmt.Errorf("database forbidden: %s", db)
+		}
+		if cq != "" {
+			return QueryContinuousQL(w, req, ip, cq)
+		}
+		return QueryUserQL(w, req, ip, show)
+	}
+
 	checkDb, showDb, alterDb, db := CheckDatabaseFromTokens(tokens)
 	if !checkDb {
 		db, _ = GetDatabaseFromTokens(tokens)
@@ -145,6 +445,12 @@ func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, e
 		}
 	}
 
+	if CheckSelectIntoFromTokens(tokens) {
+		return QuerySelectIntoQL(w, req, ip, db)
+	}
+	if head, exact := CheckCardinalityFromTokens(tokens); head != "" {
+		return QueryCardinalityQL(w, req, ip, head, exact)
+	}
 	selectOrShow := CheckSelectOrShowFromTokens(tokens)
 	if selectOrShow && from {
 		return QueryFromQL(w, req, ip, tokens, db)
@@ -158,11 +464,15 @@ func (ip *Proxy) Query(w http.ResponseWriter, req *http.Request) (body []byte, e
 	return nil, ErrIllegalQL
 }
 
-func (ip *Proxy) Write(p []byte, db, rp, precision string) (err error) {
+func (ip *Proxy) Write(ctx context.Context, p []byte, db, rp, precision string) (err error) {
 	var (
 		pos   int
 		block []byte
 	)
+	_, span := tracing.Start(ctx, "Proxy.Write", tracing.DB(db), tracing.RP(rp), attribute.Int("bytes", len(p)))
+	defer span.End()
+	label := ip.dbLabel(db)
+	writeRequests.WithLabelValues(label).Inc()
 	for pos < len(p) {
 		pos, block = ScanLine(p, pos)
 		pos++
@@ -189,58 +499,76 @@ func (ip *Proxy) WriteRow(line []byte, db, rp, precision string) {
 	nanoLine := AppendNano(line, precision)
 	meas, err := ScanKey(nanoLine)
 	if err != nil {
-		log.Printf("scan key error: %s", err)
+		logging.L().Warn("scan key error", zap.Error(err), logging.DB(db), logging.RP(rp), zap.ByteString("line", line))
 		return
 	}
 	if !RapidCheck(nanoLine[len(meas):]) {
-		log.Printf("invalid format, db: %s, rp: %s, precision: %s, line: %s", db, rp, precision, string(line))
+		logging.L().Warn("invalid format", logging.DB(db), logging.RP(rp), zap.String("precision", precision), zap.ByteString("line", line))
 		return
 	}
 
+	if ip.cache != nil {
+		ip.cache.Invalidate(db, meas)
+	}
 	key := GetKey(db, meas)
+	if IsShardedKey(key) {
+		key = GetSeriesKey(key, nanoLine)
+	}
 	backends := ip.GetBackends(key)
 	if len(backends) == 0 {
-		log.Printf("write data error: can't get backends, db: %s, meas: %s", db, meas)
+		logging.L().Warn("write data error: can't get backends", logging.DB(db), logging.Measurement(meas))
 		return
 	}
 
+	// the bytes of the line protocol routed to backends, as in WritePoints
+	label := ip.dbLabel(db)
+	writePoints.WithLabelValues(label).Inc()
+	writeBytes.WithLabelValues(label).Add(float64(len(nanoLine)))
 	point := &LinePoint{db, rp, nanoLine}
 	for _, be := range backends {
 		err = be.WritePoint(point)
 		if err != nil {
-			log.Printf("write data to buffer error: %s, url: %s, db: %s, rp: %s, precision: %s, line: %s", err, be.Url, db, rp, precision, string(line))
+			be.logger().Warn("write data to buffer error", zap.Error(err), logging.DB(db), logging.RP(rp), zap.String("precision", precision), zap.ByteString("line", line))
 		}
 	}
 }
 
-func (ip *Proxy) WritePoints(points []models.Point, db, rp string) error {
-	var err error
+func (ip *Proxy) WritePoints(ctx context.Context, points []models.Point, db, rp string) (err error) {
+	_, span := tracing.Start(ctx, "Proxy.WritePoints", tracing.DB(db), tracing.RP(rp), attribute.Int("points", len(points)))
+	defer func() { tracing.End(span, err) }()
+	label := ip.dbLabel(db)
+	writeRequests.WithLabelValues(label).Inc()
 	for _, pt := range points {
 		meas := string(pt.Name())
+		if ip.cache != nil {
+			ip.cache.Invalidate(db, meas)
+		}
 		key := GetKey(db, meas)
+		if IsShardedKey(key) {
+			key = GetSeriesKey(key, pt.Key())
+		}
 		backends := ip.GetBackends(key)
 		if len(backends) == 0 {
-			log.Printf("write point error: can't get backends, db: %s, meas: %s", db, meas)
+			logging.L().Warn("write point error: can't get backends", logging.DB(db), logging.Measurement(meas))
 			err = ErrEmptyBackends
 			continue
 		}
 
 		point := &LinePoint{db, rp, []byte(pt.String())}
+		writePoints.WithLabelValues(label).Inc()
+		writeBytes.WithLabelValues(label).Add(float64(len(point.Line)))
 		for _, be := range backends {
 			err = be.WritePoint(point)
 			if err != nil {
-				log.Printf("write point to buffer error: %s, url: %s, db: %s, rp: %s, point: %s", err, be.Url, db, rp, pt.String())
+				be.logger().Warn("write point to buffer error", zap.Error(err), logging.DB(db), logging.RP(rp), zap.String("point", pt.String()))
 			}
 		}
 	}
 	return err
 }
 
-func (ip *Proxy) ReadProm(w http.ResponseWriter, req *http.Request, db, metric string) (err error) {
-	return ReadProm(w, req, ip, db, metric)
-}
-
 func (ip *Proxy) Close() {
+	close(ip.done)
 	for _, c := range ip.Circles {
 		c.Close()
 	}
@@ -0,0 +1,93 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxql"
+)
+
+var (
+	ErrKillQuery        = errors.New("invalid kill query statement")
+	ErrKillQueryBackend = errors.New("kill query requires the backend name by on clause")
+	ErrQueryTimeout     = errors.New("query timeout")
+)
+
+func QueryShowQueriesQL(w http.ResponseWriter, req *http.Request, ip *Proxy) (body []byte, err error) {
+	// all circles -> all backends -> show queries, merged with the backend column
+	var backends []*Backend
+	for _, be := range ip.GetAllBackends() {
+		if be.IsActive() {
+			backends = append(backends, be)
+		}
+	}
+	if len(backends) == 0 {
+		return nil, ErrBackendsUnavailable
+	}
+	cr := CloneQueryRequest(req)
+	cr.Form.Del("chunked")
+	rsps, errs := QueryBackendsInOrder(backends, cr)
+	rsp, err := concatByBackend(backends, rsps, errs)
+	if err != nil {
+		return
+	}
+	return MarshalResponse(w, req, rsp)
+}
+
+func QueryKillQL(w http.ResponseWriter, req *http.Request, ip *Proxy) (body []byte, err error) {
+	// the backend named by on clause -> kill query
+	st, err := influxql.ParseStatement(strings.TrimSpace(req.FormValue("q")))
+	if err != nil {
+		return
+	}
+	stmt, ok := st.(*influxql.KillQueryStatement)
+	if !ok {
+		return nil, ErrKillQuery
+	}
+	if stmt.Host == "" {
+		return nil, ErrKillQueryBackend
+	}
+	be := ip.GetBackendByName(stmt.Host)
+	if be == nil {
+		return nil, fmt.Errorf("backend not found: %s", stmt.Host)
+	}
+	if !be.IsActive() {
+		return nil, fmt.Errorf("backend unavailable: %s", stmt.Host)
+	}
+	// the on clause names the backend to the proxy, the backend itself kills a local query
+	cr := CloneQueryRequest(req)
+	cr.Form.Set("q", fmt.Sprintf("kill query %d", stmt.QueryID))
+	qr := be.Query(cr, w, false)
+	return qr.Body, qr.Err
+}
+
+// concatByBackend concatenates the rows of all backends into one series with an extra backend column
+func concatByBackend(backends []*Backend, rsps []*Response, errs []error) (rsp *Response, err error) {
+	var columns []string
+	values := make([][]interface{}, 0)
+	for i, r := range rsps {
+		if err = responseError(r, errs[i]); err != nil {
+			return nil, fmt.Errorf("backend %s(%s) error: %s", backends[i].Name, backends[i].Url, err)
+		}
+		for _, serie := range SeriesFromResponse(r) {
+			if columns == nil {
+				columns = append(append([]string{}, serie.Columns...), "backend")
+			}
+			for _, value := range serie.Values {
+				values = append(values, append(value, backends[i].Name))
+			}
+		}
+	}
+	var series models.Rows
+	if columns != nil {
+		series = models.Rows{&models.Row{Columns: columns, Values: values}}
+	}
+	return ResponseFromSeries(series), nil
+}
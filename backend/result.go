@@ -6,8 +6,12 @@ package backend
 
 import (
 	"bytes"
+	"fmt"
+	"sort"
+	"time"
 
 	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxql"
 	jsoniter "github.com/json-iterator/go"
 )
 
@@ -38,7 +42,81 @@ type Response struct {
 func (rsp *Response) Unmarshal(b []byte) (e error) {
 	dec := jsoniter.NewDecoder(bytes.NewReader(b))
 	dec.UseNumber()
-	return dec.Decode(rsp)
+	e = dec.Decode(rsp)
+	// a chunked response consists of several json objects
+	for e == nil && dec.More() {
+		chunk := &Response{}
+		e = dec.Decode(chunk)
+		if e == nil {
+			rsp.merge(chunk)
+		}
+	}
+	return
+}
+
+func (rsp *Response) merge(chunk *Response) {
+	if chunk.Err != "" {
+		rsp.Err = chunk.Err
+	}
+	for _, r := range chunk.Results {
+		n := len(rsp.Results)
+		if n == 0 || rsp.Results[n-1].StatementID != r.StatementID {
+			rsp.Results = append(rsp.Results, r)
+			continue
+		}
+		last := rsp.Results[n-1]
+		for _, serie := range r.Series {
+			m := len(last.Series)
+			if m > 0 && last.Series[m-1].Partial && last.Series[m-1].Name == serie.Name && stringMapEqual(last.Series[m-1].Tags, serie.Tags) {
+				last.Series[m-1].Values = append(last.Series[m-1].Values, serie.Values...)
+				last.Series[m-1].Partial = serie.Partial
+			} else {
+				last.Series = append(last.Series, serie)
+			}
+		}
+		last.Messages = append(last.Messages, r.Messages...)
+		last.Partial = r.Partial
+		if r.Err != "" {
+			last.Err = r.Err
+		}
+	}
+}
+
+// ChunkResult splits the values of the result into several partial results with at most size values
+func ChunkResult(result *Result, size int) (chunks []*Result) {
+	chunk := &Result{StatementID: result.StatementID, Messages: result.Messages, Err: result.Err}
+	n := 0
+	for _, serie := range result.Series {
+		values := serie.Values
+		for {
+			part := size - n
+			if part > len(values) {
+				part = len(values)
+			}
+			row := &models.Row{Name: serie.Name, Tags: serie.Tags, Columns: serie.Columns, Values: values[:part]}
+			values = values[part:]
+			row.Partial = len(values) > 0
+			chunk.Series = append(chunk.Series, row)
+			n += part
+			if n < size {
+				break
+			}
+			chunks = append(chunks, chunk)
+			chunk = &Result{StatementID: result.StatementID, Partial: true}
+			n = 0
+			if len(values) == 0 {
+				break
+			}
+		}
+	}
+	if len(chunk.Series) > 0 || len(chunks) == 0 {
+		chunks = append(chunks, chunk)
+	}
+	for i := 0; i < len(chunks)-1; i++ {
+		chunks[i].Partial = true
+	}
+	chunks[len(chunks)-1].Partial = false
+	return
 }
 
 func SeriesFromResponseBytes(b []byte) (series models.Rows, e error) {
@@ -50,6 +128,25 @@ func SeriesFromResponseBytes(b []byte) (series models.Rows, e error) {
 	return
 }
 
+func SeriesFromResponse(rsp *Response) (series models.Rows) {
+	if len(rsp.Results) > 0 && len(rsp.Results[0].Series) > 0 {
+		series = rsp.Results[0].Series
+	}
+	return
+}
+
+func ResponsesFromResponseBytes(bodies [][]byte) (rsps []*Response, e error) {
+	rsps = make([]*Response, 0, len(bodies))
+	for _, b := range bodies {
+		rsp, e := ResponseFromResponseBytes(b)
+		if e != nil {
+			return nil, e
+		}
+		rsps = append(rsps, rsp)
+	}
+	return
+}
+
 func ResultsFromResponseBytes(b []byte) (results []*Result, e error) {
 	rsp := &Response{}
 	e = rsp.Unmarshal(b)
@@ -82,9 +179,311 @@ func ResponseFromResults(results []*Result) (rsp *Response) {
 	return
 }
 
+func ResponseFromQueryResult(qr *QueryResult) *Response {
+	if qr.Err != nil {
+		return ResponseFromError(qr.Err.Error())
+	}
+	rsp, err := ResponseFromResponseBytes(qr.Body)
+	if err != nil {
+		return ResponseFromError(err.Error())
+	}
+	return rsp
+}
+
 func ResponseFromError(err string) (rsp *Response) {
 	rsp = &Response{
 		Err: err,
 	}
 	return
 }
+
+// number is implemented by both json.Number and jsoniter.Number decoded with UseNumber
+type number interface {
+	Int64() (int64, error)
+	Float64() (float64, error)
+}
+
+type mergedSeries struct {
+	row     *models.Row
+	buckets map[int64][][]interface{}
+	times   []int64
+}
+
+// MergeSeries merges the partial series returned by several backends per group by time() bucket and tag set
+func MergeSeries(plan *QueryPlan, series models.Rows) (rows models.Rows, err error) {
+	var keys []string
+	seriesMap := make(map[string]*mergedSeries)
+	for _, serie := range series {
+		key := serie.Name + "\x00" + string(models.NewTags(serie.Tags).HashKey())
+		ms, ok := seriesMap[key]
+		if !ok {
+			ms = &mergedSeries{
+				row:     &models.Row{Name: serie.Name, Tags: serie.Tags, Columns: plan.Columns},
+				buckets: make(map[int64][][]interface{}),
+			}
+			seriesMap[key] = ms
+			keys = append(keys, key)
+		}
+		for _, value := range serie.Values {
+			var bucket int64
+			if !plan.Aggregate || plan.GroupByTime {
+				bucket = parseTime(value[0])
+			}
+			if _, ok := ms.buckets[bucket]; !ok {
+				ms.times = append(ms.times, bucket)
+			}
+			ms.buckets[bucket] = append(ms.buckets[bucket], value)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		ms := seriesMap[key]
+		sort.Slice(ms.times, func(i, j int) bool {
+			if plan.Ascending {
+				return ms.times[i] < ms.times[j]
+			}
+			return ms.times[i] > ms.times[j]
+		})
+		var values [][]interface{}
+		for _, t := range ms.times {
+			if !plan.Aggregate {
+				values = append(values, ms.buckets[t]...)
+				continue
+			}
+			value, err := mergeBucket(plan, key, t, ms.buckets[t])
+			if err != nil {
+				return nil, err
+			}
+			if value != nil {
+				values = append(values, value)
+			}
+		}
+		if plan.Aggregate && plan.Fill == influxql.PreviousFill {
+			fillPrevious(values)
+		}
+		values = limitValues(values, plan.Offset, plan.Limit)
+		if len(values) > 0 {
+			ms.row.Values = values
+			rows = append(rows, ms.row)
+		}
+	}
+	if plan.SOffset > 0 || plan.SLimit > 0 {
+		if plan.SOffset >= len(rows) {
+			return nil, nil
+		}
+		rows = rows[plan.SOffset:]
+		if plan.SLimit > 0 && plan.SLimit < len(rows) {
+			rows = rows[:plan.SLimit]
+		}
+	}
+	return
+}
+
+// SelectorConflicts returns the intervals of each first() or last() field in which several backends return a point,
+// whose partial values cannot be ordered since they carry the time of the interval rather than of the points
+func SelectorConflicts(plan *QueryPlan, series models.Rows) (conflicts map[int][]int64) {
+	if !plan.Aggregate || plan.SelectorTime {
+		return
+	}
+	counts := make(map[selectedKey]int)
+	for _, serie := range series {
+		key := serie.Name + "\x00" + string(models.NewTags(serie.Tags).HashKey())
+		for _, value := range serie.Values {
+			var bucket int64
+			if plan.GroupByTime {
+				bucket = parseTime(value[0])
+			}
+			for i, pf := range plan.Fields {
+				if (pf.Name == "first" || pf.Name == "last") && value[pf.Columns[0]] != nil {
+					counts[selectedKey{field: i, bucket: bucket, series: key}]++
+				}
+			}
+		}
+	}
+	seen := make(map[selectedKey]bool)
+	for sk, n := range counts {
+		bk := selectedKey{field: sk.field, bucket: sk.bucket}
+		if n > 1 && !seen[bk] {
+			if conflicts == nil {
+				conflicts = make(map[int][]int64)
+			}
+			seen[bk] = true
+			conflicts[sk.field] = append(conflicts[sk.field], sk.bucket)
+		}
+	}
+	for _, buckets := range conflicts {
+		sort.Slice(buckets, func(i, j int) bool { return buckets[i] < buckets[j] })
+	}
+	return
+}
+
+func mergeBucket(plan *QueryPlan, key string, t int64, bucket [][]interface{}) (value []interface{}, err error) {
+	value = make([]interface{}, len(plan.Fields)+1)
+	value[0] = bucket[0][0]
+	empty := true
+	for i, pf := range plan.Fields {
+		var v interface{}
+		switch pf.Name {
+		case "count", "sum":
+			v = sumValues(bucket, pf.Columns[0])
+		case "min", "max":
+			var row []interface{}
+			row, v = selectValue(bucket, pf.Columns[0], func(a, b float64) bool {
+				if pf.Name == "min" {
+					return a < b
+				}
+				return a > b
+			})
+			if plan.SelectorTime && row != nil {
+				value[0] = row[0]
+			}
+		case "mean":
+			sum, count := toFloat(sumValues(bucket, pf.Columns[0])), toFloat(sumValues(bucket, pf.Columns[1]))
+			if count > 0 {
+				v = sum / count
+			}
+		case "first", "last":
+			var rows [][]interface{}
+			for _, row := range bucket {
+				if row[pf.Columns[0]] != nil {
+					rows = append(rows, row)
+				}
+			}
+			if len(rows) > 1 && !plan.SelectorTime {
+				selected, ok := plan.Selected[selectedKey{field: i, bucket: t, series: key}]
+				if !ok {
+					return nil, fmt.Errorf("function %s() cannot be merged across backends within the same interval", pf.Name)
+				}
+				v = selected
+			} else if len(rows) > 0 {
+				row := rows[0]
+				for _, r := range rows[1:] {
+					if pf.Name == "first" && parseTime(r[0]) < parseTime(row[0]) || pf.Name == "last" && parseTime(r[0]) > parseTime(row[0]) {
+						row = r
+					}
+				}
+				v = row[pf.Columns[0]]
+				if plan.SelectorTime {
+					value[0] = row[0]
+				}
+			}
+		}
+		if v == nil && plan.Fill == influxql.NumberFill {
+			v = plan.FillValue
+		}
+		if v != nil {
+			empty = false
+		}
+		value[i+1] = v
+	}
+	if empty && plan.Fill == influxql.NoFill {
+		return nil, nil
+	}
+	return value, nil
+}
+
+func sumValues(bucket [][]interface{}, col int) interface{} {
+	var isum int64
+	var fsum float64
+	var found, float bool
+	for _, row := range bucket {
+		switch v := row[col].(type) {
+		case number:
+			found = true
+			if i, err := v.Int64(); err == nil && !float {
+				isum += i
+			} else {
+				f, _ := v.Float64()
+				if !float {
+					fsum, float = float64(isum), true
+				}
+				fsum += f
+			}
+		}
+	}
+	switch {
+	case !found:
+		return nil
+	case float:
+		return fsum
+	}
+	return isum
+}
+
+func selectValue(bucket [][]interface{}, col int, less func(float64, float64) bool) (row []interface{}, v interface{}) {
+	for _, r := range bucket {
+		if r[col] == nil {
+			continue
+		}
+		if v == nil || less(toFloat(r[col]), toFloat(v)) {
+			row, v = r, r[col]
+		}
+	}
+	return
+}
+
+func fillPrevious(values [][]interface{}) {
+	for i := 1; i < len(values); i++ {
+		for j := 1; j < len(values[i]); j++ {
+			if values[i][j] == nil {
+				values[i][j] = values[i-1][j]
+			}
+		}
+	}
+}
+
+func limitValues(values [][]interface{}, offset, limit int) [][]interface{} {
+	if offset >= len(values) {
+		return nil
+	}
+	values = values[offset:]
+	if limit > 0 && limit < len(values) {
+		values = values[:limit]
+	}
+	return values
+}
+
+func toFloat(v interface{}) float64 {
+	switch tv := v.(type) {
+	case number:
+		f, _ := tv.Float64()
+		return f
+	case float64:
+		return tv
+	case int64:
+		return float64(tv)
+	}
+	return 0
+}
+
+// FormatSeriesTime converts the times in nanoseconds of series to the epoch of the client,
+// or to rfc3339 without epoch as influxdb does
+func FormatSeriesTime(series models.Rows, epoch string) {
+	mul := models.GetPrecisionMultiplier(epoch)
+	for _, serie := range series {
+		if len(serie.Columns) == 0 || serie.Columns[0] != "time" {
+			continue
+		}
+		for _, value := range serie.Values {
+			t := parseTime(value[0])
+			if epoch == "" {
+				value[0] = time.Unix(0, t).UTC().Format(time.RFC3339Nano)
+			} else {
+				value[0] = t / mul
+			}
+		}
+	}
+}
+
+func parseTime(v interface{}) int64 {
+	switch tv := v.(type) {
+	case number:
+		i, _ := tv.Int64()
+		return i
+	case string:
+		t, _ := time.Parse(time.RFC3339Nano, tv)
+		return t.UnixNano()
+	}
+	return 0
+}
@@ -0,0 +1,214 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/chengshiwen/influx-proxy/logging"
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+	"go.uber.org/zap"
+)
+
+// maxShadowReadBody limits the primary response held for the comparison, larger responses are not compared
+const maxShadowReadBody = 8 << 20
+
+// maxShadowReads limits the comparisons in flight, the sampled selects beyond it are skipped
+const maxShadowReads = 16
+
+// ShadowReadStats counts the sampled selects compared between circles
+type ShadowReadStats struct {
+	Sampled    int64 `json:"sampled"`
+	Mismatched int64 `json:"mismatched"`
+	Failed     int64 `json:"failed"`
+	Skipped    int64 `json:"skipped"`
+}
+
+func (ip *Proxy) GetShadowReadStats() *ShadowReadStats {
+	return &ShadowReadStats{
+		Sampled:    atomic.LoadInt64(&ip.shadowStats.Sampled),
+		Mismatched: atomic.LoadInt64(&ip.shadowStats.Mismatched),
+		Failed:     atomic.LoadInt64(&ip.shadowStats.Failed),
+		Skipped:    atomic.LoadInt64(&ip.shadowStats.Skipped),
+	}
+}
+
+// shadowReader captures the response of a sampled select served to the client, and compares it
+// with the response of the backend of another circle owning the key
+type shadowReader struct {
+	http.ResponseWriter
+	ip       *Proxy
+	req      *http.Request
+	shadow   *Backend
+	buf      bytes.Buffer
+	overflow bool
+}
+
+// shadowRead samples a select served by the backend of circle idx, the returned reader wraps w
+// to capture the response, or is nil if the select is not sampled
+func (ip *Proxy) shadowRead(w http.ResponseWriter, req *http.Request, key string, idx int) *shadowReader {
+	if ip.shadowReadRatio <= 0 || len(ip.Circles) < 2 || w == nil || rand.Float64() >= ip.shadowReadRatio {
+		return nil
+	}
+	// form is parsed by influxql queries only, the body of flux and prometheus queries is left unread,
+	// and chunked responses are split differently by the backends
+	q := strings.TrimSpace(req.Form.Get("q"))
+	if len(q) < 6 || !strings.EqualFold(q[:6], "select") || req.Form.Get("chunked") == "true" {
+		return nil
+	}
+	var shadow *Backend
+	for _, p := range rand.Perm(len(ip.Circles)) {
+		if p == idx {
+			continue
+		}
+		if sbe := ip.Circles[p].GetBackend(key); sbe.IsActive() && !sbe.IsRewriting() && !sbe.IsWriteOnly() {
+			shadow = sbe
+			break
+		}
+	}
+	if shadow == nil {
+		return nil
+	}
+	// the client context ends with the response, and the shadow backend is asked for the same format and encoding
+	cr := CloneQueryRequest(req).WithContext(logging.WithRequestID(context.Background(), logging.RequestIDFromContext(req.Context())))
+	cr.Header.Del(HeaderQueryOrigin)
+	return &shadowReader{ResponseWriter: w, ip: ip, req: cr, shadow: shadow}
+}
+
+func (sr *shadowReader) Write(p []byte) (int, error) {
+	if !sr.overflow {
+		if sr.buf.Len()+len(p) > maxShadowReadBody {
+			sr.overflow = true
+			sr.buf = bytes.Buffer{}
+		} else {
+			sr.buf.Write(p)
+		}
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+func (sr *shadowReader) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// compare compares in the background the response of be, which is body unless it was streamed through the reader,
+// with the response of the shadow backend, at most maxShadowReads comparisons are in flight
+func (sr *shadowReader) compare(be *Backend, body []byte) {
+	if body == nil {
+		if sr.overflow {
+			return
+		}
+		body = sr.buf.Bytes()
+	}
+	select {
+	case sr.ip.shadowSem <- struct{}{}:
+	default:
+		atomic.AddInt64(&sr.ip.shadowStats.Skipped, 1)
+		return
+	}
+	atomic.AddInt64(&sr.ip.shadowStats.Sampled, 1)
+	header := sr.Header().Clone()
+	go func() {
+		defer func() { <-sr.ip.shadowSem }()
+		sr.ip.compareShadowRead(sr.req, be, sr.shadow, header, body)
+	}()
+}
+
+func (ip *Proxy) compareShadowRead(req *http.Request, be, shadow *Backend, header http.Header, body []byte) {
+	q, db := req.FormValue("q"), req.FormValue("db")
+	qr := shadow.Query(req, nil, false)
+	var diff string
+	err := qr.Err
+	if err == nil {
+		diff, err = diffBodies(header, body, qr.Header, qr.Body)
+	}
+	if err != nil {
+		atomic.AddInt64(&ip.shadowStats.Failed, 1)
+		shadow.reqLogger(req).Warn("shadow read error", zap.Error(err), logging.Query(q), logging.DB(db))
+		return
+	}
+	if diff != "" {
+		atomic.AddInt64(&ip.shadowStats.Mismatched, 1)
+		logging.FromContext(req.Context()).Warn("shadow read mismatch: "+diff, zap.Strings("backends", []string{be.Name, shadow.Name}),
+			logging.Query(q), logging.DB(db))
+	}
+}
+
+// diffBodies describes the first difference between two response bodies of the same format, json responses
+// are compared by series and other formats by bytes
+func diffBodies(ha http.Header, a []byte, hb http.Header, b []byte) (diff string, err error) {
+	if a, err = decodeBody(ha, a); err != nil {
+		return
+	}
+	if b, err = decodeBody(hb, b); err != nil {
+		return
+	}
+	if !strings.HasPrefix(ha.Get("Content-Type"), "application/json") {
+		if !bytes.Equal(a, b) {
+			diff = "bodies differ"
+		}
+		return
+	}
+	ra, err := ResponseFromResponseBytes(a)
+	if err != nil {
+		return
+	}
+	rb, err := ResponseFromResponseBytes(b)
+	if err != nil {
+		return
+	}
+	if err = checkResponses([]*Response{ra, rb}); err != nil {
+		return
+	}
+	return diffResponses(ra, rb), nil
+}
+
+func decodeBody(header http.Header, body []byte) ([]byte, error) {
+	if header.Get("Content-Encoding") != "gzip" {
+		return body, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// diffResponses describes the first difference between two decoded responses, or returns empty if they are equal
+func diffResponses(a, b *Response) string {
+	sa, sb := SeriesFromResponse(a), SeriesFromResponse(b)
+	if len(sa) != len(sb) {
+		return fmt.Sprintf("%d series != %d series", len(sa), len(sb))
+	}
+	for i := range sa {
+		ka, kb := shadowSeriesKey(sa[i]), shadowSeriesKey(sb[i])
+		if ka != kb {
+			return fmt.Sprintf("series %d: %s != %s", i, ka, kb)
+		}
+		if len(sa[i].Values) != len(sb[i].Values) {
+			return fmt.Sprintf("series %s: %d values != %d values", ka, len(sa[i].Values), len(sb[i].Values))
+		}
+		if !columnsEqual(sa[i].Columns, sb[i].Columns) || !bytes.Equal(util.MarshalJSON(sa[i].Values, false), util.MarshalJSON(sb[i].Values, false)) {
+			return fmt.Sprintf("series %s: values differ", ka)
+		}
+	}
+	return ""
+}
+
+func shadowSeriesKey(row *models.Row) string {
+	return row.Name + string(models.NewTags(row.Tags).HashKey())
+}
@@ -0,0 +1,93 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDiffResponses(t *testing.T) {
+	base := `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1,1.5],[2,2]]}]}]}`
+	tests := []struct {
+		name string
+		body string
+		diff string
+	}{
+		{"equal", base, ""},
+		{"no series", `{"results":[{"statement_id":0}]}`, "1 series != 0 series"},
+		{"tags", `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"b"},"columns":["time","value"],"values":[[1,1.5],[2,2]]}]}]}`, "series 0: cpu,host=a != cpu,host=b"},
+		{"count", `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1,1.5]]}]}]}`, "series cpu,host=a: 2 values != 1 values"},
+		{"values", `{"results":[{"statement_id":0,"series":[{"name":"cpu","tags":{"host":"a"},"columns":["time","value"],"values":[[1,1.5],[2,3]]}]}]}`, "series cpu,host=a: values differ"},
+	}
+	rsps := mustResponses(t, [][]byte{[]byte(base)})
+	for _, tt := range tests {
+		other := mustResponses(t, [][]byte{[]byte(tt.body)})
+		if diff := diffResponses(rsps[0], other[0]); diff != tt.diff {
+			t.Errorf("%v: diff %q, expected %q", tt.name, diff, tt.diff)
+		}
+	}
+}
+
+func TestShadowReaderCompare(t *testing.T) {
+	var requests int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,2]]}]}]}`))
+	}))
+	defer server.Close()
+
+	ip := &Proxy{shadowStats: &ShadowReadStats{}, shadowSem: make(chan struct{}, 1)}
+	primary := NewSimpleBackend(&BackendConfig{Name: "b1", Url: "http://127.0.0.1:1"})
+	shadow := NewSimpleBackend(&BackendConfig{Name: "b2", Url: server.URL})
+	newReader := func() *shadowReader {
+		sr := &shadowReader{ResponseWriter: httptest.NewRecorder(), ip: ip, req: NewQueryRequest("GET", "db1", "select value from cpu", ""), shadow: shadow}
+		sr.Header().Set("Content-Type", "application/json")
+		sr.WriteHeader(http.StatusOK)
+		// the primary response is streamed to the client through the reader
+		sr.Write([]byte(`{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time","value"],"values":[[1,1]]}]}]}`))
+		return sr
+	}
+
+	newReader().compare(primary, nil)
+	// the comparison in flight holds the semaphore until it ends
+	ip.shadowSem <- struct{}{}
+	newReader().compare(primary, nil)
+	<-ip.shadowSem
+
+	stats := ip.GetShadowReadStats()
+	if stats.Sampled != 1 || stats.Mismatched != 1 || stats.Failed != 0 || stats.Skipped != 1 {
+		t.Errorf("got stats %+v, want 1 sampled, 1 mismatched and 1 skipped", stats)
+	}
+	// only the shadow backend is queried again
+	if n := atomic.LoadInt64(&requests); n != 1 {
+		t.Errorf("got %d shadow requests, want 1", n)
+	}
+}
+
+func TestDiffBodies(t *testing.T) {
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	csvHeader := http.Header{"Content-Type": {"application/csv"}}
+	tests := []struct {
+		name   string
+		header http.Header
+		a, b   string
+		diff   string
+	}{
+		{"json equal", jsonHeader, `{"results":[{"statement_id":0}]}`, `{"results":[{"statement_id":0}]}`, ""},
+		{"json differ", jsonHeader, `{"results":[{"statement_id":0}]}`, `{"results":[{"statement_id":0,"series":[{"name":"cpu","columns":["time"],"values":[[1]]}]}]}`, "0 series != 1 series"},
+		{"csv equal", csvHeader, "name,tags,time\ncpu,,1\n", "name,tags,time\ncpu,,1\n", ""},
+		{"csv differ", csvHeader, "name,tags,time\ncpu,,1\n", "name,tags,time\ncpu,,2\n", "bodies differ"},
+	}
+	for _, tt := range tests {
+		diff, err := diffBodies(tt.header, []byte(tt.a), tt.header, []byte(tt.b))
+		if err != nil || diff != tt.diff {
+			t.Errorf("%v: diff %q, %v, expected %q", tt.name, diff, err, tt.diff)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxql"
+)
+
+// UserDrift lists the users and grants of a backend which differ from the majority of backends
+type UserDrift struct {
+	Name        string   `json:"name"`
+	Url         string   `json:"url"` // nolint:golint
+	Differences []string `json:"differences"`
+}
+
+// GetUserDrift compares users and grants of all active backends and returns the backends differing from the majority
+func (ip *Proxy) GetUserDrift() (drifts []*UserDrift, err error) {
+	var backends []*Backend
+	for _, be := range ip.GetAllBackends() {
+		if be.IsActive() {
+			backends = append(backends, be)
+		}
+	}
+	if len(backends) == 0 {
+		return nil, ErrBackendsUnavailable
+	}
+
+	states := make([]map[string]string, len(backends))
+	rsps, errs := QueryBackendsInOrder(backends, NewQueryRequest("GET", "", "show users", ""))
+	users := util.NewSet()
+	for i, rsp := range rsps {
+		if err = responseError(rsp, errs[i]); err != nil {
+			return nil, fmt.Errorf("backend %s(%s) show users error: %s", backends[i].Name, backends[i].Url, err)
+		}
+		states[i] = make(map[string]string)
+		for _, value := range rowValues(rsp) {
+			if len(value) < 2 {
+				continue
+			}
+			user := util.CastString(value[0])
+			users.Add(user)
+			states[i]["user "+user] = "admin=" + util.CastString(value[1])
+		}
+	}
+
+	for _, user := range sortedKeys(users) {
+		q := "show grants for " + influxql.QuoteIdent(user)
+		rsps, errs := QueryBackendsInOrder(backends, NewQueryRequest("GET", "", q, ""))
+		for i, rsp := range rsps {
+			if _, ok := states[i]["user "+user]; !ok || responseError(rsp, errs[i]) != nil {
+				continue
+			}
+			for _, value := range rowValues(rsp) {
+				if len(value) < 2 {
+					continue
+				}
+				key := fmt.Sprintf("grant %s on %s", user, util.CastString(value[0]))
+				states[i][key] = util.CastString(value[1])
+			}
+		}
+	}
+
+	keys := util.NewSet()
+	for _, state := range states {
+		for key := range state {
+			keys.Add(key)
+		}
+	}
+	differences := make([][]string, len(backends))
+	for _, key := range sortedKeys(keys) {
+		values := make([]string, len(states))
+		for i, state := range states {
+			values[i] = state[key]
+		}
+		majority := majorityValue(values)
+		for i, value := range values {
+			switch {
+			case value == majority:
+			case value == "":
+				differences[i] = append(differences[i], fmt.Sprintf("missing %s (%s)", key, majority))
+			case majority == "":
+				differences[i] = append(differences[i], fmt.Sprintf("unexpected %s (%s)", key, value))
+			default:
+				differences[i] = append(differences[i], fmt.Sprintf("%s: %s, majority %s", key, value, majority))
+			}
+		}
+	}
+	drifts = make([]*UserDrift, 0)
+	for i, diffs := range differences {
+		if len(diffs) > 0 {
+			drifts = append(drifts, &UserDrift{Name: backends[i].Name, Url: backends[i].Url, Differences: diffs})
+		}
+	}
+	return
+}
+
+// reduceByMajority merges show users or show grants by keeping for each user or database the row returned by most backends,
+// and returns the names of backends whose rows differ from the merged ones
+func reduceByMajority(backends []*Backend, rsps []*Response, errs []error) (rsp *Response, drifted []string, err error) {
+	var columns []string
+	rows := make([]map[string]string, len(rsps))
+	values := make(map[string][]interface{})
+	keys := util.NewSet()
+	succeeded := 0
+	for i, r := range rsps {
+		if e := responseError(r, errs[i]); e != nil {
+			// a backend missing the user of show grants returns an error, treat it as no rows
+			if err == nil {
+				err = e
+			}
+			rows[i] = make(map[string]string)
+			continue
+		}
+		succeeded++
+		if series := SeriesFromResponse(r); len(series) > 0 && columns == nil {
+			columns = series[0].Columns
+		}
+		rows[i] = make(map[string]string)
+		for _, value := range rowValues(r) {
+			if len(value) == 0 {
+				continue
+			}
+			key := util.CastString(value[0])
+			row := fmt.Sprint(value)
+			rows[i][key] = row
+			values[row] = value
+			keys.Add(key)
+		}
+	}
+	if succeeded == 0 {
+		return nil, nil, err
+	}
+	err = nil
+
+	merged := make(map[string]string)
+	var series models.Rows
+	var mergedValues [][]interface{}
+	for _, key := range sortedKeys(keys) {
+		candidates := make([]string, len(rows))
+		for i, row := range rows {
+			candidates[i] = row[key]
+		}
+		if majority := majorityValue(candidates); majority != "" {
+			merged[key] = majority
+			mergedValues = append(mergedValues, values[majority])
+		}
+	}
+	if columns != nil {
+		series = models.Rows{&models.Row{Columns: columns, Values: mergedValues}}
+	}
+	for i, row := range rows {
+		if !stringMapEqual(row, merged) {
+			drifted = append(drifted, backends[i].Name)
+		}
+	}
+	return ResponseFromSeries(series), drifted, nil
+}
+
+// majorityValue returns the most frequent value, an empty value means absent, ties prefer present and then smaller values
+func majorityValue(values []string) (majority string) {
+	counts := make(map[string]int)
+	for _, v := range values {
+		counts[v]++
+	}
+	max := -1
+	for v, n := range counts {
+		if n > max || n == max && (majority == "" || v != "" && v < majority) {
+			majority, max = v, n
+		}
+	}
+	return
+}
+
+func responseError(rsp *Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if rsp.Err != "" {
+		return errors.New(rsp.Err)
+	}
+	if len(rsp.Results) > 0 && rsp.Results[0].Err != "" {
+		return errors.New(rsp.Results[0].Err)
+	}
+	return nil
+}
+
+func rowValues(rsp *Response) (values [][]interface{}) {
+	for _, serie := range SeriesFromResponse(rsp) {
+		values = append(values, serie.Values...)
+	}
+	return
+}
+
+func sortedKeys(set util.Set) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func stringMapEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+func userDriftMessage(drifted []string) *Message {
+	return &Message{Level: "warning", Text: "users or grants differ from the majority on backends: " + strings.Join(drifted, ", ")}
+}
+
+func queryUserShow(req *http.Request, backends []*Backend) (rsp *Response, err error) {
+	cr := CloneQueryRequest(req)
+	cr.Form.Del("chunked")
+	rsps, errs := QueryBackendsInOrder(backends, cr)
+	rsp, drifted, err := reduceByMajority(backends, rsps, errs)
+	if err != nil {
+		return
+	}
+	if len(drifted) > 0 {
+		rsp.Results[0].Messages = append(rsp.Results[0].Messages, userDriftMessage(drifted))
+	}
+	return
+}
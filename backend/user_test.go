@@ -0,0 +1,61 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/util"
+)
+
+func TestMajorityValue(t *testing.T) {
+	tests := []struct {
+		values   []string
+		majority string
+	}{
+		{[]string{"a", "a", "b"}, "a"},
+		{[]string{"", "", "a"}, ""},
+		{[]string{"", "a"}, "a"},
+		{[]string{"b", "a"}, "a"},
+		{[]string{"", "b", "a"}, "a"},
+	}
+	for _, tt := range tests {
+		if m := majorityValue(tt.values); m != tt.majority {
+			t.Errorf("majority wrong: %q, %q != %q", tt.values, m, tt.majority)
+		}
+	}
+}
+
+func TestReduceByMajority(t *testing.T) {
+	backends := []*Backend{
+		{HttpBackend: &HttpBackend{Name: "b1"}},
+		{HttpBackend: &HttpBackend{Name: "b2"}},
+		{HttpBackend: &HttpBackend{Name: "b3"}},
+	}
+	bodies := [][]byte{
+		[]byte(`{"results":[{"statement_id":0,"series":[{"columns":["user","admin"],"values":[["admin",true],["jdoe",false]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"columns":["user","admin"],"values":[["admin",true],["jdoe",false],["tmp",false]]}]}]}`),
+		[]byte(`{"results":[{"statement_id":0,"series":[{"columns":["user","admin"],"values":[["admin",true],["jdoe",true]]}]}]}`),
+	}
+	rsp, drifted, err := reduceByMajority(backends, mustResponses(t, bodies), make([]error, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := util.MarshalJSON(rsp, false)
+	want := `{"results":[{"statement_id":0,"series":[{"columns":["user","admin"],"values":[["admin",true],["jdoe",false]]}]}]}`
+	if string(b[:len(b)-1]) != want {
+		t.Errorf("response wrong: %s != %s", b[:len(b)-1], want)
+	}
+	if len(drifted) != 2 || drifted[0] != "b2" || drifted[1] != "b3" {
+		t.Errorf("drifted wrong: %v", drifted)
+	}
+
+	rsps := mustResponses(t, bodies[:1])
+	_, _, err = reduceByMajority(backends[:1], rsps, []error{errors.New("user not found")})
+	if err == nil || err.Error() != "user not found" {
+		t.Errorf("error wrong: %v", err)
+	}
+}
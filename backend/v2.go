@@ -0,0 +1,207 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/util"
+	"github.com/influxdata/influxql"
+)
+
+const DefaultOrg = "influx-proxy"
+
+var (
+	ErrDeleteTimeRange = errors.New("delete requires start and stop, and start must not be after stop")
+	ErrDeletePredicate = errors.New("illegal delete predicate")
+)
+
+// Bucket is a database and retention policy exposed as an InfluxDB 2.x bucket named db/rp
+type Bucket struct {
+	Database        string
+	RetentionPolicy string
+	Duration        time.Duration
+	Default         bool
+}
+
+func (b *Bucket) Name() string {
+	return b.Database + "/" + b.RetentionPolicy
+}
+
+func (b *Bucket) ID() string {
+	return GenerateID(b.Name())
+}
+
+// GenerateID returns a stable 16-digit hex id for the name, as the ids of InfluxDB 2.x resources
+func GenerateID(name string) string {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// GetBuckets merges the databases and retention policies of all active backends into buckets sorted by name
+func (ip *Proxy) GetBuckets() (buckets []*Bucket, err error) {
+	var backends []*Backend
+	for _, be := range ip.GetAllBackends() {
+		if be.IsActive() {
+			backends = append(backends, be)
+		}
+	}
+	if len(backends) == 0 {
+		return nil, ErrBackendsUnavailable
+	}
+
+	dbs := util.NewSet()
+	rsps, errs := QueryBackendsInOrder(backends, NewQueryRequest("GET", "", "show databases", ""))
+	for i, rsp := range rsps {
+		if err = responseError(rsp, errs[i]); err != nil {
+			return nil, fmt.Errorf("backend %s(%s) show databases error: %s", backends[i].Name, backends[i].Url, err)
+		}
+		for _, value := range rowValues(rsp) {
+			if db := util.CastString(value[0]); db != "_internal" && !ip.IsForbiddenDB(db) {
+				dbs.Add(db)
+			}
+		}
+	}
+
+	for _, db := range sortedKeys(dbs) {
+		set := make(map[string]bool)
+		rsps, errs := QueryBackendsInOrder(backends, NewQueryRequest("GET", db, "show retention policies", ""))
+		for i, rsp := range rsps {
+			// the database may be missing on some backends
+			if responseError(rsp, errs[i]) != nil {
+				continue
+			}
+			for _, value := range rowValues(rsp) {
+				if len(value) < 5 || set[util.CastString(value[0])] {
+					continue
+				}
+				b := &Bucket{Database: db, RetentionPolicy: util.CastString(value[0])}
+				b.Duration, _ = time.ParseDuration(util.CastString(value[1]))
+				b.Default, _ = value[4].(bool)
+				set[b.RetentionPolicy] = true
+				buckets = append(buckets, b)
+			}
+		}
+	}
+	sort.SliceStable(buckets, func(i, j int) bool {
+		return buckets[i].Name() < buckets[j].Name()
+	})
+	return
+}
+
+// DeleteRequest is the body of the InfluxDB 2.x delete api
+type DeleteRequest struct {
+	Start     time.Time `json:"start"`
+	Stop      time.Time `json:"stop"`
+	Predicate string    `json:"predicate"`
+}
+
+// Statement translates the request into an influxql delete statement and returns the measurement of the predicate
+func (dr *DeleteRequest) Statement() (q string, meas string, err error) {
+	if dr.Start.IsZero() || dr.Stop.IsZero() || dr.Start.After(dr.Stop) {
+		return "", "", ErrDeleteTimeRange
+	}
+	var cond influxql.Expr = &influxql.BinaryExpr{
+		Op:  influxql.AND,
+		LHS: &influxql.BinaryExpr{Op: influxql.GTE, LHS: &influxql.VarRef{Val: "time"}, RHS: &influxql.TimeLiteral{Val: dr.Start.UTC()}},
+		RHS: &influxql.BinaryExpr{Op: influxql.LTE, LHS: &influxql.VarRef{Val: "time"}, RHS: &influxql.TimeLiteral{Val: dr.Stop.UTC()}},
+	}
+	if strings.TrimSpace(dr.Predicate) != "" {
+		expr, err := influxql.ParseExpr(dr.Predicate)
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %s", ErrDeletePredicate, err)
+		}
+		var tags []influxql.Expr
+		if err = flattenDeletePredicate(expr, &tags, &meas); err != nil {
+			return "", "", err
+		}
+		for _, tag := range tags {
+			cond = &influxql.BinaryExpr{Op: influxql.AND, LHS: cond, RHS: tag}
+		}
+	}
+	// influxql.DeleteStatement cannot be formatted without source
+	q = "DELETE"
+	if meas != "" {
+		q += " FROM " + influxql.QuoteIdent(meas)
+	}
+	q += " WHERE " + cond.String()
+	return
+}
+
+// flattenDeletePredicate accepts the predicate syntax of InfluxDB 2.x: key="value" or key!="value" joined by AND
+func flattenDeletePredicate(expr influxql.Expr, tags *[]influxql.Expr, meas *string) error {
+	switch e := expr.(type) {
+	case *influxql.ParenExpr:
+		return flattenDeletePredicate(e.Expr, tags, meas)
+	case *influxql.BinaryExpr:
+		switch e.Op {
+		case influxql.AND:
+			if err := flattenDeletePredicate(e.LHS, tags, meas); err != nil {
+				return err
+			}
+			return flattenDeletePredicate(e.RHS, tags, meas)
+		case influxql.EQ, influxql.NEQ:
+			key, ok := e.LHS.(*influxql.VarRef)
+			if !ok {
+				return fmt.Errorf("%w: %s requires a key on the left", ErrDeletePredicate, e)
+			}
+			var value string
+			switch v := e.RHS.(type) {
+			case *influxql.VarRef:
+				value = v.Val
+			case *influxql.StringLiteral:
+				value = v.Val
+			default:
+				return fmt.Errorf("%w: %s requires a string value on the right", ErrDeletePredicate, e)
+			}
+			if key.Val == "_measurement" {
+				if e.Op != influxql.EQ || (*meas != "" && *meas != value) {
+					return fmt.Errorf("%w: _measurement must use = with a single measurement", ErrDeletePredicate)
+				}
+				*meas = value
+				return nil
+			}
+			*tags = append(*tags, &influxql.BinaryExpr{Op: e.Op, LHS: &influxql.VarRef{Val: key.Val}, RHS: &influxql.StringLiteral{Val: value}})
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: unsupported expression %s", ErrDeletePredicate, expr)
+}
+
+// Delete runs the delete statement translated from the request on the owning backends of all circles,
+// the retention policy is not applicable since an influxql delete removes the points of all retention policies
+func (ip *Proxy) Delete(req *http.Request, db string, dr *DeleteRequest) (err error) {
+	q, meas, err := dr.Statement()
+	if err != nil {
+		return
+	}
+	// all circles -> backend by key(db,meas), or all backends without measurement -> delete
+	backends := ip.GetAllBackends()
+	if key := GetKey(db, meas); meas != "" && !IsShardedKey(key) {
+		backends = ip.GetBackends(key)
+	}
+	for _, be := range backends {
+		if !be.IsActive() {
+			return fmt.Errorf("backend %s(%s) unavailable", be.Name, be.Url)
+		}
+	}
+	rsps, errs := QueryBackendsInOrder(backends, NewQueryRequest("POST", db, q, "").WithContext(req.Context()))
+	for i, rsp := range rsps {
+		if err = responseError(rsp, errs[i]); err != nil {
+			return fmt.Errorf("backend %s(%s) delete error: %s", backends[i].Name, backends[i].Url, err)
+		}
+	}
+	if ip.cache != nil && meas != "" {
+		ip.cache.Invalidate(db, meas)
+	}
+	return
+}
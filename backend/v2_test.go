@@ -0,0 +1,80 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package backend
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDeleteRequestStatement(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	stop := time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		dr   *DeleteRequest
+		want string
+		meas string
+		werr error
+	}{
+		{
+			name: "test1",
+			dr:   &DeleteRequest{Start: start, Stop: stop, Predicate: `_measurement="cpu" AND host="server 01"`},
+			want: `DELETE FROM cpu WHERE time >= '2021-01-01T00:00:00Z' AND time <= '2021-01-02T00:00:00Z' AND host = 'server 01'`,
+			meas: "cpu",
+		},
+		{
+			name: "test2",
+			dr:   &DeleteRequest{Start: start, Stop: stop, Predicate: `(region != "us") and _measurement = "mem"`},
+			want: `DELETE FROM mem WHERE time >= '2021-01-01T00:00:00Z' AND time <= '2021-01-02T00:00:00Z' AND region != 'us'`,
+			meas: "mem",
+		},
+		{
+			name: "test3",
+			dr:   &DeleteRequest{Start: start, Stop: stop},
+			want: `DELETE WHERE time >= '2021-01-01T00:00:00Z' AND time <= '2021-01-02T00:00:00Z'`,
+		},
+		{
+			name: "test4",
+			dr:   &DeleteRequest{Start: stop, Stop: start},
+			werr: ErrDeleteTimeRange,
+		},
+		{
+			name: "test5",
+			dr:   &DeleteRequest{Start: start, Stop: stop, Predicate: `host="a" OR host="b"`},
+			werr: ErrDeletePredicate,
+		},
+		{
+			name: "test6",
+			dr:   &DeleteRequest{Start: start, Stop: stop, Predicate: `_measurement="cpu" AND _measurement="mem"`},
+			werr: ErrDeletePredicate,
+		},
+	}
+	for _, tt := range tests {
+		q, meas, err := tt.dr.Statement()
+		if !errors.Is(err, tt.werr) {
+			t.Errorf("%v: got error %v, want %v", tt.name, err, tt.werr)
+			continue
+		}
+		if err == nil && (q != tt.want || meas != tt.meas) {
+			t.Errorf("%v: got %v, %v, want %v, %v", tt.name, q, meas, tt.want, tt.meas)
+		}
+	}
+}
+
+func TestGetV1Backends(t *testing.T) {
+	ip := &Proxy{Circles: []*Circle{
+		{Backends: []*Backend{{HttpBackend: &HttpBackend{Name: "b1"}}, {HttpBackend: &HttpBackend{Name: "b2", v2: true}}}},
+		{Backends: []*Backend{{HttpBackend: &HttpBackend{Name: "b3"}}}},
+	}}
+	var names []string
+	for _, be := range ip.GetV1Backends() {
+		names = append(names, be.Name)
+	}
+	if len(names) != 2 || names[0] != "b1" || names[1] != "b3" {
+		t.Errorf("got backends %v, want [b1 b3]", names)
+	}
+}
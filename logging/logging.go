@@ -0,0 +1,168 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	FormatConsole = "console"
+	FormatJSON    = "json"
+)
+
+var (
+	ErrInvalidLevel  = errors.New("invalid log level, require debug, info, warn or error")
+	ErrInvalidFormat = errors.New("invalid log format, require console or json")
+)
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+var (
+	// level is shared by all loggers, so that it can be changed at runtime
+	level  = zap.NewAtomicLevel()
+	format atomic.Value
+	logger atomic.Value
+)
+
+func init() {
+	format.Store(FormatConsole)
+	logger.Store(New(os.Stdout))
+}
+
+// Init sets the level and the format of the loggers, the default logger writes to stdout
+func Init(lvl, form string) error {
+	if err := SetLevel(lvl); err != nil {
+		return err
+	}
+	switch form {
+	case "", FormatConsole:
+		format.Store(FormatConsole)
+	case FormatJSON:
+		format.Store(FormatJSON)
+	default:
+		return ErrInvalidFormat
+	}
+	logger.Store(New(os.Stdout))
+	return nil
+}
+
+// New returns a logger writing to w with the shared level and the format set by Init
+func New(w io.Writer) *zap.Logger {
+	cfg := zap.NewProductionEncoderConfig()
+	cfg.TimeKey = "time"
+	cfg.EncodeTime = zapcore.ISO8601TimeEncoder
+	var encoder zapcore.Encoder
+	if format.Load().(string) == FormatJSON {
+		encoder = zapcore.NewJSONEncoder(cfg)
+	} else {
+		cfg.EncodeLevel = zapcore.CapitalLevelEncoder
+		encoder = zapcore.NewConsoleEncoder(cfg)
+	}
+	return zap.New(zapcore.NewCore(encoder, zapcore.AddSync(w), level), zap.AddCaller())
+}
+
+// L returns the default logger
+func L() *zap.Logger {
+	return logger.Load().(*zap.Logger)
+}
+
+// FromContext returns the default logger with the request id of ctx if any
+func FromContext(ctx context.Context) *zap.Logger {
+	if id := RequestIDFromContext(ctx); id != "" {
+		return L().With(RequestID(id))
+	}
+	return L()
+}
+
+// GetLevel returns the current level of all loggers
+func GetLevel() string {
+	return level.String()
+}
+
+// SetLevel changes the level of all loggers, an empty level means info
+func SetLevel(lvl string) error {
+	if lvl == "" {
+		lvl = "info"
+	}
+	var l zapcore.Level
+	if err := l.UnmarshalText([]byte(lvl)); err != nil || l > zapcore.ErrorLevel {
+		return ErrInvalidLevel
+	}
+	level.SetLevel(l)
+	return nil
+}
+
+// WithRequestID returns a context carrying the request id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// NewRequestID returns a random uuid as the request id
+func NewRequestID() string {
+	var b [16]byte
+	rand.Read(b[:]) // nolint:errcheck
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// RequestIDFromContext returns the request id carried by ctx, or empty
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// The fields below keep the keys consistent across the proxy and the transfer tool
+
+func Backend(name string) zap.Field {
+	return zap.String("backend", name)
+}
+
+func URL(url string) zap.Field {
+	return zap.String("url", url)
+}
+
+func DB(db string) zap.Field {
+	return zap.String("db", db)
+}
+
+func RP(rp string) zap.Field {
+	return zap.String("rp", rp)
+}
+
+func Measurement(meas string) zap.Field {
+	return zap.String("measurement", meas)
+}
+
+func Circle(id int) zap.Field {
+	return zap.Int("circle", id)
+}
+
+func Client(addr string) zap.Field {
+	return zap.String("client", addr)
+}
+
+func RequestID(id string) zap.Field {
+	return zap.String("request_id", id)
+}
+
+func Query(q string) zap.Field {
+	return zap.String("query", q)
+}
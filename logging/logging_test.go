@@ -0,0 +1,48 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	if err := Init("info", FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	defer Init("info", FormatConsole) // nolint:errcheck
+
+	var buf bytes.Buffer
+	ctx := WithRequestID(context.Background(), "req-1")
+	logger := New(&buf).With(Backend("be1"), URL("http://127.0.0.1:8086"), RequestID(RequestIDFromContext(ctx)))
+
+	logger.Debug("hidden")
+	if buf.Len() != 0 {
+		t.Errorf("debug logged at info level: %s", buf.String())
+	}
+	if err := SetLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("shown", DB("db1"))
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("invalid json entry %q: %s", buf.String(), err)
+	}
+	want := map[string]string{"level": "debug", "msg": "shown", "backend": "be1", "url": "http://127.0.0.1:8086", "request_id": "req-1", "db": "db1"}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("field %s: got %v, want %s", k, entry[k], v)
+		}
+	}
+	if err := SetLevel("trace"); err != ErrInvalidLevel {
+		t.Errorf("invalid level: got %v", err)
+	}
+	if GetLevel() != "debug" {
+		t.Errorf("level changed by invalid level: %s", GetLevel())
+	}
+}
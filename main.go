@@ -5,16 +5,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/logging"
 	"github.com/chengshiwen/influx-proxy/service"
+	"github.com/chengshiwen/influx-proxy/tracing"
+	"go.uber.org/zap"
 )
 
 var (
@@ -23,8 +28,6 @@ var (
 )
 
 func init() {
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
-	log.SetOutput(os.Stdout)
 	flag.StringVar(&configFile, "config", "proxy.json", "proxy config file with json/yaml/toml format")
 	flag.BoolVar(&version, "version", false, "proxy version")
 	flag.Parse()
@@ -49,9 +52,22 @@ func main() {
 		fmt.Printf("illegal config file: %s\n", err)
 		return
 	}
-	log.Printf("version: %s, commit: %s, build: %s", backend.Version, backend.GitCommit, backend.BuildTime)
+	if err = logging.Init(cfg.LogLevel, cfg.LogFormat); err != nil {
+		fmt.Printf("illegal config file: %s\n", err)
+		return
+	}
+	logger := logging.L()
+	defer logger.Sync() // nolint:errcheck
+	logger.Info(fmt.Sprintf("version: %s, commit: %s, build: %s", backend.Version, backend.GitCommit, backend.BuildTime))
 	cfg.PrintSummary()
 
+	shutdown, err := tracing.Init(cfg.TraceExporter, cfg.TraceEndpoint, cfg.TraceFile, cfg.TraceSampleRatio, backend.Version)
+	if err != nil {
+		logger.Error("init tracing error", zap.Error(err))
+		return
+	}
+	defer shutdown(context.Background()) // nolint:errcheck
+
 	mux := service.NewServeMux()
 	service.NewHttpService(cfg).Register(mux)
 
@@ -60,15 +76,22 @@ func main() {
 		Handler:     mux,
 		IdleTimeout: time.Duration(cfg.IdleTimeout) * time.Second,
 	}
+	// the server is shut down on signals so that the pending spans are exported before exit
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+		<-ch
+		server.Shutdown(context.Background()) // nolint:errcheck
+	}()
 	if cfg.HTTPSEnabled {
-		log.Printf("https service start, listen on %s", server.Addr)
+		logger.Info("https service start, listen on " + server.Addr)
 		err = server.ListenAndServeTLS(cfg.HTTPSCert, cfg.HTTPSKey)
 	} else {
-		log.Printf("http service start, listen on %s", server.Addr)
+		logger.Info("http service start, listen on " + server.Addr)
 		err = server.ListenAndServe()
 	}
-	if err != nil {
-		log.Print(err)
+	if err != nil && err != http.ErrServerClosed {
+		logger.Error("service stopped", zap.Error(err))
 		return
 	}
 }
@@ -0,0 +1,229 @@
+package prometheus
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+	"math/bits"
+	"net/http"
+
+	"github.com/chengshiwen/influx-proxy/prometheus/remote"
+)
+
+const (
+	// StreamedContentType is the content type of the remote read responses of STREAMED_XOR_CHUNKS
+	StreamedContentType = "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse"
+
+	// MaxSamplesPerChunk is the number of samples prometheus cuts a chunk at
+	MaxSamplesPerChunk = 120
+
+	// MaxBytesPerFrame is the soft limit of the chunk bytes of a streamed frame, a series is split into several frames over it
+	MaxBytesPerFrame = 1 << 20
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// XORChunk encodes samples with the gorilla compression of delta-of-delta timestamps and xor values,
+// the layout is the same as the xor chunk of the prometheus tsdb
+type XORChunk struct {
+	b      bstream
+	num    uint16
+	t      int64
+	tDelta uint64
+	v      float64
+	// leading is 0xff until the first window of meaningful bits is written
+	leading  uint8
+	trailing uint8
+}
+
+// NewXORChunk returns an empty chunk whose first two bytes hold the number of samples
+func NewXORChunk() *XORChunk {
+	return &XORChunk{b: bstream{stream: make([]byte, 2, 128)}, leading: 0xff}
+}
+
+// Append adds a sample, timestamps must be appended in increasing order
+func (c *XORChunk) Append(t int64, v float64) {
+	var buf [binary.MaxVarintLen64]byte
+	switch c.num {
+	case 0:
+		n := binary.PutVarint(buf[:], t)
+		for _, b := range buf[:n] {
+			c.b.writeByte(b)
+		}
+		c.b.writeBits(math.Float64bits(v), 64)
+	case 1:
+		tDelta := uint64(t - c.t)
+		n := binary.PutUvarint(buf[:], tDelta)
+		for _, b := range buf[:n] {
+			c.b.writeByte(b)
+		}
+		c.writeVDelta(v)
+		c.tDelta = tDelta
+	default:
+		tDelta := uint64(t - c.t)
+		dod := int64(tDelta - c.tDelta)
+		switch {
+		case dod == 0:
+			c.b.writeBit(false)
+		case bitRange(dod, 14):
+			c.b.writeBits(0b10, 2)
+			c.b.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			c.b.writeBits(0b110, 3)
+			c.b.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			c.b.writeBits(0b1110, 4)
+			c.b.writeBits(uint64(dod), 20)
+		default:
+			c.b.writeBits(0b1111, 4)
+			c.b.writeBits(uint64(dod), 64)
+		}
+		c.writeVDelta(v)
+		c.tDelta = tDelta
+	}
+	c.t, c.v = t, v
+	c.num++
+	binary.BigEndian.PutUint16(c.b.stream, c.num)
+}
+
+func (c *XORChunk) writeVDelta(v float64) {
+	vDelta := math.Float64bits(v) ^ math.Float64bits(c.v)
+	if vDelta == 0 {
+		c.b.writeBit(false)
+		return
+	}
+	c.b.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(vDelta))
+	trailing := uint8(bits.TrailingZeros64(vDelta))
+	// the leading count is stored in 5 bits
+	if leading >= 32 {
+		leading = 31
+	}
+	if c.leading != 0xff && leading >= c.leading && trailing >= c.trailing {
+		// the meaningful bits fall within the window of the previous value
+		c.b.writeBit(false)
+		c.b.writeBits(vDelta>>c.trailing, 64-int(c.leading)-int(c.trailing))
+		return
+	}
+	c.leading, c.trailing = leading, trailing
+	c.b.writeBit(true)
+	c.b.writeBits(uint64(leading), 5)
+	// 64 significant bits overflow to 0 in 6 bits, which is unambiguous since a delta of 0 is written as a single bit
+	sigbits := 64 - leading - trailing
+	c.b.writeBits(uint64(sigbits), 6)
+	c.b.writeBits(vDelta>>trailing, int(sigbits))
+}
+
+// Bytes returns the encoded chunk
+func (c *XORChunk) Bytes() []byte {
+	return c.b.stream
+}
+
+// NumSamples returns the number of appended samples
+func (c *XORChunk) NumSamples() int {
+	return int(c.num)
+}
+
+// EncodeChunks encodes the samples sorted by time into xor chunks of at most MaxSamplesPerChunk samples
+func EncodeChunks(samples []*remote.Sample) (chunks []*remote.Chunk) {
+	var c *XORChunk
+	var minTime int64
+	for i, s := range samples {
+		if c == nil {
+			c, minTime = NewXORChunk(), s.TimestampMs
+		}
+		c.Append(s.TimestampMs, s.Value)
+		if c.NumSamples() == MaxSamplesPerChunk || i == len(samples)-1 {
+			chunks = append(chunks, &remote.Chunk{MinTimeMs: minTime, MaxTimeMs: s.TimestampMs, Type: remote.Chunk_XOR, Data: c.Bytes()})
+			c = nil
+		}
+	}
+	return
+}
+
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+// bstream is a stream of bits, count is the number of free bits in the last byte
+type bstream struct {
+	stream []byte
+	count  uint8
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+	if bit {
+		b.stream[len(b.stream)-1] |= 1 << (b.count - 1)
+	}
+	b.count--
+}
+
+func (b *bstream) writeByte(byt byte) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+	// fill up the free bits of the last byte with the high bits of byt, and the rest into a new byte
+	b.stream[len(b.stream)-1] |= byt >> (8 - b.count)
+	b.stream = append(b.stream, byt<<b.count)
+}
+
+func (b *bstream) writeBits(u uint64, nbits int) {
+	u <<= 64 - uint(nbits)
+	for nbits >= 8 {
+		b.writeByte(byte(u >> 56))
+		u <<= 8
+		nbits -= 8
+	}
+	for nbits > 0 {
+		b.writeBit((u >> 63) == 1)
+		u <<= 1
+		nbits--
+	}
+}
+
+// ChunkedWriter writes the frames of a streamed remote read response, each frame is the uvarint size of the message,
+// the big-endian crc32 castagnoli checksum of the message and the message, and is flushed at once
+type ChunkedWriter struct {
+	writer  io.Writer
+	flusher http.Flusher
+	written bool
+}
+
+// NewChunkedWriter returns a frame writer, flusher is optional
+func NewChunkedWriter(w io.Writer, f http.Flusher) *ChunkedWriter {
+	return &ChunkedWriter{writer: w, flusher: f}
+}
+
+// Write writes the message as a frame, empty messages are skipped
+func (w *ChunkedWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var buf [binary.MaxVarintLen64 + 4]byte
+	n := binary.PutUvarint(buf[:], uint64(len(b)))
+	binary.BigEndian.PutUint32(buf[n:], crc32.Checksum(b, castagnoliTable))
+	w.written = true
+	if _, err := w.writer.Write(buf[:n+4]); err != nil {
+		return 0, err
+	}
+	written, err := w.writer.Write(b)
+	if err != nil {
+		return written, err
+	}
+	if w.flusher != nil {
+		w.flusher.Flush()
+	}
+	return written, nil
+}
+
+// Written reports whether any frame has been written, after which an error can no longer be responded
+func (w *ChunkedWriter) Written() bool {
+	return w.written
+}
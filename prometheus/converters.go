@@ -0,0 +1,200 @@
+package prometheus
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/chengshiwen/influx-proxy/prometheus/remote"
+	"github.com/influxdata/influxdb1-client/models"
+)
+
+const (
+	// measurementName is the default name used if no Prometheus name can be found on write
+	measurementName = "prom_metric_not_specified"
+
+	// fieldName is the field all prometheus values get written to
+	fieldName = "value"
+
+	// prometheusNameTag is the tag key that Prometheus uses for metric names
+	prometheusNameTag = "__name__"
+
+	// v2MeasurementName is the measurement all metrics are written to in the InfluxDB 2.x layout
+	v2MeasurementName = "prometheus"
+)
+
+const (
+	// SchemaV1 writes a measurement per metric with a single field value, as InfluxDB 1.x does
+	SchemaV1 = "v1"
+	// SchemaV2 writes all metrics to the measurement prometheus with the metric names as fields, as InfluxDB 2.x does
+	SchemaV2 = "v2"
+)
+
+// ErrReadMeasurementLabel is returned when reading the time series written with a measurement label
+var ErrReadMeasurementLabel = errors.New("prometheus read is unsupported with a measurement label")
+
+// Schema is the layout Prometheus time series are converted into Influx points with
+type Schema struct {
+	// Version is SchemaV1 or SchemaV2, SchemaV1 by default
+	Version string
+	// MeasurementLabel is the label whose value is used as measurement instead of the default one of the layout
+	MeasurementLabel string
+	// DropLabels are the labels not written as tags
+	DropLabels map[string]bool
+}
+
+// NewSchema returns a schema, an empty version means SchemaV1
+func NewSchema(version, measurementLabel string, dropLabels []string) *Schema {
+	if version == "" {
+		version = SchemaV1
+	}
+	s := &Schema{Version: version, MeasurementLabel: measurementLabel, DropLabels: make(map[string]bool, len(dropLabels))}
+	for _, label := range dropLabels {
+		s.DropLabels[label] = true
+	}
+	return s
+}
+
+// CheckRead returns an error if the time series written in the schema cannot be read by metric, which is the case
+// with a measurement label since the measurement of a metric depends on the labels of each series
+func (s *Schema) CheckRead() error {
+	if s.MeasurementLabel != "" {
+		return ErrReadMeasurementLabel
+	}
+	return nil
+}
+
+// ReadSource returns the measurement and field the samples of metric are read from
+func (s *Schema) ReadSource(metric string) (measurement string, field string) {
+	if s.Version == SchemaV2 {
+		return v2MeasurementName, metric
+	}
+	return metric, fieldName
+}
+
+// MetricsMeasurement returns the measurement whose field keys are the metrics and true in SchemaV2,
+// the metrics are the measurements in SchemaV1
+func (s *Schema) MetricsMeasurement() (string, bool) {
+	if s.Version == SchemaV2 {
+		return v2MeasurementName, true
+	}
+	return "", false
+}
+
+// measurementAndField returns the measurement and field name of a time series, and the labels written as tags
+func (s *Schema) measurementAndField(labels []*remote.LabelPair) (measurement string, field string, tags map[string]string) {
+	measurement, field = measurementName, fieldName
+	var metric, mapped string
+	tags = make(map[string]string, len(labels))
+	for _, l := range labels {
+		if l.Name == prometheusNameTag {
+			metric = l.Value
+		}
+		if s.MeasurementLabel != "" && l.Name == s.MeasurementLabel {
+			mapped = l.Value
+		}
+		if s.DropLabels[l.Name] || (s.Version == SchemaV2 && l.Name == prometheusNameTag) {
+			continue
+		}
+		tags[l.Name] = l.Value
+	}
+	if s.Version == SchemaV2 {
+		measurement = v2MeasurementName
+		if metric != "" {
+			field = metric
+		}
+	} else if metric != "" {
+		measurement = metric
+	}
+	if mapped != "" {
+		measurement = mapped
+	}
+	return
+}
+
+// A DroppedValuesError is returned when the prometheus write request contains
+// unsupported float64 values.
+type DroppedValuesError struct {
+	nan  uint64
+	ninf uint64
+	inf  uint64
+}
+
+// Error returns a descriptive error of the values dropped.
+func (e DroppedValuesError) Error() string {
+	return fmt.Sprintf("dropped unsupported Prometheus values: [NaN = %d, +Inf = %d, -Inf = %d]", e.nan, e.inf, e.ninf)
+}
+
+// SplitWriteRequest splits the time series of the request by the value of label, the series without label
+// are keyed by the empty string, and label is removed from the series if strip is true
+func SplitWriteRequest(req *remote.WriteRequest, label string, strip bool) map[string]*remote.WriteRequest {
+	if label == "" {
+		return map[string]*remote.WriteRequest{"": req}
+	}
+	reqs := make(map[string]*remote.WriteRequest)
+	for _, ts := range req.Timeseries {
+		var value string
+		for i, l := range ts.Labels {
+			if l.Name == label {
+				value = l.Value
+				if strip {
+					ts.Labels = append(ts.Labels[:i:i], ts.Labels[i+1:]...)
+				}
+				break
+			}
+		}
+		if reqs[value] == nil {
+			reqs[value] = &remote.WriteRequest{}
+		}
+		reqs[value].Timeseries = append(reqs[value].Timeseries, ts)
+	}
+	return reqs
+}
+
+// WriteRequestToPoints converts a Prometheus remote write request of time series and their
+// samples into Points that can be written into Influx, in the layout of schema or SchemaV1 if schema is nil
+func WriteRequestToPoints(req *remote.WriteRequest, schema *Schema) ([]models.Point, error) {
+	if schema == nil {
+		schema = NewSchema(SchemaV1, "", nil)
+	}
+	var maxPoints int
+	for _, ts := range req.Timeseries {
+		maxPoints += len(ts.Samples)
+	}
+	points := make([]models.Point, 0, maxPoints)
+
+	// Track any dropped values.
+	var nan, inf, ninf uint64
+
+	for _, ts := range req.Timeseries {
+		measurement, field, tags := schema.measurementAndField(ts.Labels)
+
+		for _, s := range ts.Samples {
+			if v := s.Value; math.IsNaN(v) {
+				nan++
+				continue
+			} else if math.IsInf(v, -1) {
+				ninf++
+				continue
+			} else if math.IsInf(v, 1) {
+				inf++
+				continue
+			}
+
+			// convert and append
+			t := time.Unix(0, s.TimestampMs*int64(time.Millisecond))
+			fields := map[string]interface{}{field: s.Value}
+			p, err := models.NewPoint(measurement, models.NewTags(tags), fields, t)
+			if err != nil {
+				return nil, err
+			}
+			points = append(points, p)
+		}
+	}
+
+	if nan+inf+ninf > 0 {
+		return points, DroppedValuesError{nan: nan, inf: inf, ninf: ninf}
+	}
+	return points, nil
+}
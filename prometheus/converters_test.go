@@ -0,0 +1,108 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package prometheus
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/chengshiwen/influx-proxy/prometheus/remote"
+)
+
+func TestPromWriteSchema(t *testing.T) {
+	req := &remote.WriteRequest{Timeseries: []*remote.TimeSeries{
+		{
+			Labels:  []*remote.LabelPair{{Name: prometheusNameTag, Value: "cpu"}, {Name: "job", Value: "node"}, {Name: "instance", Value: "h1"}},
+			Samples: []*remote.Sample{{Value: 1.5, TimestampMs: 1000}},
+		},
+		{
+			Labels:  []*remote.LabelPair{{Name: "job", Value: "node"}},
+			Samples: []*remote.Sample{{Value: 2, TimestampMs: 2000}},
+		},
+	}}
+	tests := []struct {
+		name   string
+		schema *Schema
+		want   []string
+	}{
+		{
+			name:   "default",
+			schema: nil,
+			want:   []string{"cpu,__name__=cpu,instance=h1,job=node value=1.5 1000000000", "prom_metric_not_specified,job=node value=2 2000000000"},
+		},
+		{
+			name:   "v2",
+			schema: NewSchema(SchemaV2, "", nil),
+			want:   []string{"prometheus,instance=h1,job=node cpu=1.5 1000000000", "prometheus,job=node value=2 2000000000"},
+		},
+		{
+			name:   "v1 measurement label",
+			schema: NewSchema(SchemaV1, "job", nil),
+			want:   []string{"node,__name__=cpu,instance=h1,job=node value=1.5 1000000000", "node,job=node value=2 2000000000"},
+		},
+		{
+			name:   "v2 measurement label and drop labels",
+			schema: NewSchema(SchemaV2, "job", []string{"job", "instance"}),
+			want:   []string{"node cpu=1.5 1000000000", "node value=2 2000000000"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, err := WriteRequestToPoints(req, tt.schema)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range points {
+				got = append(got, p.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitWriteRequest(t *testing.T) {
+	series := func(labels ...string) *remote.TimeSeries {
+		ts := &remote.TimeSeries{}
+		for i := 0; i < len(labels); i += 2 {
+			ts.Labels = append(ts.Labels, &remote.LabelPair{Name: labels[i], Value: labels[i+1]})
+		}
+		return ts
+	}
+	req := &remote.WriteRequest{Timeseries: []*remote.TimeSeries{
+		series(prometheusNameTag, "cpu", "tenant", "team_a"),
+		series(prometheusNameTag, "mem", "tenant", "team_b/weekly"),
+		series(prometheusNameTag, "up"),
+		series("tenant", "team_a", prometheusNameTag, "disk"),
+	}}
+
+	reqs := SplitWriteRequest(req, "", true)
+	if len(reqs) != 1 || reqs[""] != req {
+		t.Errorf("got %v, want the request without label", reqs)
+	}
+
+	reqs = SplitWriteRequest(req, "tenant", true)
+	got := make(map[string][]string)
+	for tenant, r := range reqs {
+		for _, ts := range r.Timeseries {
+			var labels []string
+			for _, l := range ts.Labels {
+				labels = append(labels, l.Name+"="+l.Value)
+			}
+			got[tenant] = append(got[tenant], strings.Join(labels, ","))
+		}
+	}
+	want := map[string][]string{
+		"team_a":        {"__name__=cpu", "__name__=disk"},
+		"team_b/weekly": {"__name__=mem"},
+		"":              {"__name__=up"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
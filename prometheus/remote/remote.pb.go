@@ -6,11 +6,10 @@ package remote
 import (
 	encoding_binary "encoding/binary"
 	fmt "fmt"
+	proto "github.com/gogo/protobuf/proto"
 	io "io"
 	math "math"
 	math_bits "math/bits"
-
-	proto "github.com/gogo/protobuf/proto"
 )
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -55,6 +54,58 @@ func (MatchType) EnumDescriptor() ([]byte, []int) {
 	return fileDescriptor_eefc82927d57d89b, []int{0}
 }
 
+type ReadRequest_ResponseType int32
+
+const (
+	// Server will return a single ReadResponse message with matched series that includes list of raw samples.
+	ReadRequest_SAMPLES ReadRequest_ResponseType = 0
+	// Server will stream a delimited ChunkedReadResponse message that contains XOR encoded chunks for a single series.
+	ReadRequest_STREAMED_XOR_CHUNKS ReadRequest_ResponseType = 1
+)
+
+var ReadRequest_ResponseType_name = map[int32]string{
+	0: "SAMPLES",
+	1: "STREAMED_XOR_CHUNKS",
+}
+
+var ReadRequest_ResponseType_value = map[string]int32{
+	"SAMPLES":             0,
+	"STREAMED_XOR_CHUNKS": 1,
+}
+
+func (x ReadRequest_ResponseType) String() string {
+	return proto.EnumName(ReadRequest_ResponseType_name, int32(x))
+}
+
+func (ReadRequest_ResponseType) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_eefc82927d57d89b, []int{4, 0}
+}
+
+type Chunk_Encoding int32
+
+const (
+	Chunk_UNKNOWN Chunk_Encoding = 0
+	Chunk_XOR     Chunk_Encoding = 1
+)
+
+var Chunk_Encoding_name = map[int32]string{
+	0: "UNKNOWN",
+	1: "XOR",
+}
+
+var Chunk_Encoding_value = map[string]int32{
+	"UNKNOWN": 0,
+	"XOR":     1,
+}
+
+func (x Chunk_Encoding) String() string {
+	return proto.EnumName(Chunk_Encoding_name, int32(x))
+}
+
+func (Chunk_Encoding) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_eefc82927d57d89b, []int{10, 0}
+}
+
 type Sample struct {
 	Value       float64 `protobuf:"fixed64,1,opt,name=value,proto3" json:"value,omitempty"`
 	TimestampMs int64   `protobuf:"varint,2,opt,name=timestamp_ms,json=timestampMs,proto3" json:"timestamp_ms,omitempty"`
@@ -258,6 +309,8 @@ func (m *WriteRequest) GetTimeseries() []*TimeSeries {
 
 type ReadRequest struct {
 	Queries []*Query `protobuf:"bytes,1,rep,name=queries,proto3" json:"queries,omitempty"`
+	// accepted_response_types allows negotiating the content type of the response, the first supported one is used.
+	AcceptedResponseTypes []ReadRequest_ResponseType `protobuf:"varint,2,rep,packed,name=accepted_response_types,json=acceptedResponseTypes,proto3,enum=remote.ReadRequest_ResponseType" json:"accepted_response_types,omitempty"`
 }
 
 func (m *ReadRequest) Reset()         { *m = ReadRequest{} }
@@ -300,6 +353,13 @@ func (m *ReadRequest) GetQueries() []*Query {
 	return nil
 }
 
+func (m *ReadRequest) GetAcceptedResponseTypes() []ReadRequest_ResponseType {
+	if m != nil {
+		return m.AcceptedResponseTypes
+	}
+	return nil
+}
+
 type ReadResponse struct {
 	// In same order as the request's queries.
 	Results []*QueryResult `protobuf:"bytes,1,rep,name=results,proto3" json:"results,omitempty"`
@@ -509,8 +569,190 @@ func (m *QueryResult) GetTimeseries() []*TimeSeries {
 	return nil
 }
 
+// ChunkedReadResponse is a response when response_type equals STREAMED_XOR_CHUNKS.
+// We strictly stream full series after series, optionally split by time.
+type ChunkedReadResponse struct {
+	ChunkedSeries []*ChunkedSeries `protobuf:"bytes,1,rep,name=chunked_series,json=chunkedSeries,proto3" json:"chunked_series,omitempty"`
+	// query_index represents an index of the query from ReadRequest.queries these chunks relates to.
+	QueryIndex int64 `protobuf:"varint,2,opt,name=query_index,json=queryIndex,proto3" json:"query_index,omitempty"`
+}
+
+func (m *ChunkedReadResponse) Reset()         { *m = ChunkedReadResponse{} }
+func (m *ChunkedReadResponse) String() string { return proto.CompactTextString(m) }
+func (*ChunkedReadResponse) ProtoMessage()    {}
+func (*ChunkedReadResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_eefc82927d57d89b, []int{9}
+}
+func (m *ChunkedReadResponse) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *ChunkedReadResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_ChunkedReadResponse.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *ChunkedReadResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ChunkedReadResponse.Merge(m, src)
+}
+func (m *ChunkedReadResponse) XXX_Size() int {
+	return m.Size()
+}
+func (m *ChunkedReadResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ChunkedReadResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ChunkedReadResponse proto.InternalMessageInfo
+
+func (m *ChunkedReadResponse) GetChunkedSeries() []*ChunkedSeries {
+	if m != nil {
+		return m.ChunkedSeries
+	}
+	return nil
+}
+
+func (m *ChunkedReadResponse) GetQueryIndex() int64 {
+	if m != nil {
+		return m.QueryIndex
+	}
+	return 0
+}
+
+// Chunk represents a TSDB chunk.
+// Time range [min, max] is inclusive.
+type Chunk struct {
+	MinTimeMs int64          `protobuf:"varint,1,opt,name=min_time_ms,json=minTimeMs,proto3" json:"min_time_ms,omitempty"`
+	MaxTimeMs int64          `protobuf:"varint,2,opt,name=max_time_ms,json=maxTimeMs,proto3" json:"max_time_ms,omitempty"`
+	Type      Chunk_Encoding `protobuf:"varint,3,opt,name=type,proto3,enum=remote.Chunk_Encoding" json:"type,omitempty"`
+	Data      []byte         `protobuf:"bytes,4,opt,name=data,proto3" json:"data,omitempty"`
+}
+
+func (m *Chunk) Reset()         { *m = Chunk{} }
+func (m *Chunk) String() string { return proto.CompactTextString(m) }
+func (*Chunk) ProtoMessage()    {}
+func (*Chunk) Descriptor() ([]byte, []int) {
+	return fileDescriptor_eefc82927d57d89b, []int{10}
+}
+func (m *Chunk) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *Chunk) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_Chunk.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *Chunk) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Chunk.Merge(m, src)
+}
+func (m *Chunk) XXX_Size() int {
+	return m.Size()
+}
+func (m *Chunk) XXX_DiscardUnknown() {
+	xxx_messageInfo_Chunk.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Chunk proto.InternalMessageInfo
+
+func (m *Chunk) GetMinTimeMs() int64 {
+	if m != nil {
+		return m.MinTimeMs
+	}
+	return 0
+}
+
+func (m *Chunk) GetMaxTimeMs() int64 {
+	if m != nil {
+		return m.MaxTimeMs
+	}
+	return 0
+}
+
+func (m *Chunk) GetType() Chunk_Encoding {
+	if m != nil {
+		return m.Type
+	}
+	return Chunk_UNKNOWN
+}
+
+func (m *Chunk) GetData() []byte {
+	if m != nil {
+		return m.Data
+	}
+	return nil
+}
+
+// ChunkedSeries represents single, encoded time series.
+type ChunkedSeries struct {
+	// Labels should be sorted.
+	Labels []*LabelPair `protobuf:"bytes,1,rep,name=labels,proto3" json:"labels,omitempty"`
+	// Chunks will be in start time order and may overlap.
+	Chunks []*Chunk `protobuf:"bytes,2,rep,name=chunks,proto3" json:"chunks,omitempty"`
+}
+
+func (m *ChunkedSeries) Reset()         { *m = ChunkedSeries{} }
+func (m *ChunkedSeries) String() string { return proto.CompactTextString(m) }
+func (*ChunkedSeries) ProtoMessage()    {}
+func (*ChunkedSeries) Descriptor() ([]byte, []int) {
+	return fileDescriptor_eefc82927d57d89b, []int{11}
+}
+func (m *ChunkedSeries) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *ChunkedSeries) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_ChunkedSeries.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *ChunkedSeries) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ChunkedSeries.Merge(m, src)
+}
+func (m *ChunkedSeries) XXX_Size() int {
+	return m.Size()
+}
+func (m *ChunkedSeries) XXX_DiscardUnknown() {
+	xxx_messageInfo_ChunkedSeries.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ChunkedSeries proto.InternalMessageInfo
+
+func (m *ChunkedSeries) GetLabels() []*LabelPair {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+func (m *ChunkedSeries) GetChunks() []*Chunk {
+	if m != nil {
+		return m.Chunks
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterEnum("remote.MatchType", MatchType_name, MatchType_value)
+	proto.RegisterEnum("remote.ReadRequest_ResponseType", ReadRequest_ResponseType_name, ReadRequest_ResponseType_value)
+	proto.RegisterEnum("remote.Chunk_Encoding", Chunk_Encoding_name, Chunk_Encoding_value)
 	proto.RegisterType((*Sample)(nil), "remote.Sample")
 	proto.RegisterType((*LabelPair)(nil), "remote.LabelPair")
 	proto.RegisterType((*TimeSeries)(nil), "remote.TimeSeries")
@@ -520,41 +762,58 @@ func init() {
 	proto.RegisterType((*Query)(nil), "remote.Query")
 	proto.RegisterType((*LabelMatcher)(nil), "remote.LabelMatcher")
 	proto.RegisterType((*QueryResult)(nil), "remote.QueryResult")
+	proto.RegisterType((*ChunkedReadResponse)(nil), "remote.ChunkedReadResponse")
+	proto.RegisterType((*Chunk)(nil), "remote.Chunk")
+	proto.RegisterType((*ChunkedSeries)(nil), "remote.ChunkedSeries")
 }
 
 func init() { proto.RegisterFile("remote.proto", fileDescriptor_eefc82927d57d89b) }
 
 var fileDescriptor_eefc82927d57d89b = []byte{
-	// 457 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x53, 0xc1, 0x6e, 0xd3, 0x40,
-	0x10, 0xcd, 0x26, 0x4d, 0x82, 0xc7, 0x6e, 0x08, 0x43, 0x0f, 0x3e, 0x59, 0xc1, 0x12, 0xc2, 0x20,
-	0xa8, 0x50, 0x11, 0xdc, 0x38, 0xa4, 0x28, 0x02, 0xa1, 0xa6, 0xa5, 0x5b, 0x23, 0xb8, 0x59, 0x5b,
-	0x32, 0x12, 0x96, 0xec, 0xc4, 0xdd, 0x5d, 0x23, 0xe5, 0x2f, 0xe0, 0xaf, 0x38, 0xf6, 0xc8, 0x11,
-	0x25, 0x3f, 0x82, 0xb2, 0x1b, 0x3b, 0x8e, 0xd4, 0x13, 0xb7, 0xcc, 0xbc, 0xf7, 0x66, 0x5e, 0xf6,
-	0x8d, 0xc1, 0x93, 0x94, 0x2f, 0x34, 0x1d, 0x17, 0x72, 0xa1, 0x17, 0xd8, 0xb3, 0x55, 0x38, 0x86,
-	0xde, 0x95, 0xc8, 0x8b, 0x8c, 0xf0, 0x08, 0xba, 0x3f, 0x44, 0x56, 0x92, 0xcf, 0x46, 0x2c, 0x62,
-	0xdc, 0x16, 0xf8, 0x08, 0x3c, 0x9d, 0xe6, 0xa4, 0xb4, 0xc8, 0x8b, 0x24, 0x57, 0x7e, 0x7b, 0xc4,
-	0xa2, 0x0e, 0x77, 0xeb, 0xde, 0x54, 0x85, 0xaf, 0xc1, 0x39, 0x13, 0xd7, 0x94, 0x7d, 0x12, 0xa9,
-	0x44, 0x84, 0x83, 0xb9, 0xc8, 0xed, 0x10, 0x87, 0x9b, 0xdf, 0xbb, 0xc9, 0x6d, 0xd3, 0xb4, 0x45,
-	0x28, 0x00, 0xe2, 0x34, 0xa7, 0x2b, 0x92, 0x29, 0x29, 0x7c, 0x0a, 0xbd, 0x6c, 0x33, 0x44, 0xf9,
-	0x6c, 0xd4, 0x89, 0xdc, 0x93, 0x07, 0xc7, 0x5b, 0xbb, 0xf5, 0x68, 0xbe, 0x25, 0x60, 0x04, 0x7d,
-	0x65, 0x2c, 0x6f, 0xdc, 0x6c, 0xb8, 0x83, 0x8a, 0x6b, 0xff, 0x09, 0xaf, 0xe0, 0xf0, 0x14, 0xbc,
-	0x2f, 0x32, 0xd5, 0xc4, 0xe9, 0xa6, 0x24, 0xa5, 0xf1, 0x04, 0xc0, 0x18, 0x37, 0x2b, 0xb7, 0x8b,
-	0xb0, 0x12, 0xef, 0xcc, 0xf0, 0x06, 0x2b, 0x7c, 0x03, 0x2e, 0x27, 0x31, 0xab, 0x46, 0x3c, 0x81,
-	0xfe, 0x4d, 0xd9, 0xd4, 0x1f, 0x56, 0xfa, 0xcb, 0x92, 0xe4, 0x92, 0x57, 0x68, 0xf8, 0x16, 0x3c,
-	0xab, 0x53, 0xc5, 0x62, 0xae, 0x08, 0x5f, 0x40, 0x5f, 0x92, 0x2a, 0x33, 0x5d, 0x09, 0x1f, 0xee,
-	0x0b, 0x0d, 0xc6, 0x2b, 0x4e, 0xf8, 0x8b, 0x41, 0xd7, 0x00, 0xf8, 0x1c, 0x50, 0x69, 0x21, 0x75,
-	0xb2, 0x97, 0x03, 0x33, 0x39, 0x0c, 0x0d, 0x12, 0xef, 0xc2, 0xc0, 0x08, 0x86, 0x34, 0x9f, 0x25,
-	0x77, 0x64, 0x36, 0xa0, 0xf9, 0xac, 0xc9, 0x7c, 0x09, 0xf7, 0x72, 0xa1, 0xbf, 0x7d, 0x27, 0xa9,
-	0xfc, 0x8e, 0x71, 0x74, 0xb4, 0xf7, 0xe6, 0x53, 0x0b, 0xf2, 0x9a, 0x15, 0x26, 0xe0, 0x35, 0x11,
-	0x7c, 0x0c, 0x07, 0x7a, 0x59, 0xd8, 0xac, 0x07, 0xbb, 0xc4, 0x0c, 0x1c, 0x2f, 0x0b, 0xe2, 0x06,
-	0xae, 0x4f, 0xa2, 0x7d, 0xd7, 0x49, 0x74, 0x9a, 0x27, 0x31, 0x06, 0xb7, 0xf1, 0x18, 0xff, 0x13,
-	0xd7, 0xb3, 0x8f, 0xe0, 0xd4, 0xfb, 0xd1, 0x81, 0xee, 0xe4, 0xf2, 0xf3, 0xf8, 0x6c, 0xd8, 0xc2,
-	0x43, 0x70, 0xce, 0x2f, 0xe2, 0xc4, 0x96, 0x0c, 0xef, 0x83, 0xcb, 0x27, 0xef, 0x27, 0x5f, 0x93,
-	0xe9, 0x38, 0x7e, 0xf7, 0x61, 0xd8, 0x46, 0x84, 0x81, 0x6d, 0x9c, 0x5f, 0x6c, 0x7b, 0x9d, 0x53,
-	0xff, 0xf7, 0x2a, 0x60, 0xb7, 0xab, 0x80, 0xfd, 0x5d, 0x05, 0xec, 0xe7, 0x3a, 0x68, 0xdd, 0xae,
-	0x83, 0xd6, 0x9f, 0x75, 0xd0, 0xba, 0xee, 0x99, 0x8f, 0xe8, 0xd5, 0xbf, 0x00, 0x00, 0x00, 0xff,
-	0xff, 0x2a, 0xc9, 0xc7, 0x07, 0x54, 0x03, 0x00, 0x00,
+	// 681 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x54, 0x41, 0x6f, 0xd3, 0x30,
+	0x18, 0xad, 0xdb, 0xb5, 0x5d, 0xbf, 0xa4, 0x25, 0x78, 0x1b, 0xeb, 0x29, 0x94, 0x48, 0x13, 0x65,
+	0x82, 0x0a, 0x0d, 0xb8, 0xc1, 0xa1, 0x1b, 0x11, 0x83, 0xad, 0xed, 0xe6, 0x76, 0x5a, 0x6f, 0x91,
+	0xd7, 0x58, 0x2c, 0xa2, 0x49, 0xb3, 0xd8, 0x45, 0xeb, 0xbf, 0x80, 0x9f, 0xc1, 0x1f, 0x41, 0x1c,
+	0x77, 0xe4, 0x88, 0xb6, 0x3f, 0x82, 0xe2, 0xc4, 0x6d, 0x22, 0xed, 0x02, 0xb7, 0xf8, 0x7b, 0xcf,
+	0xcf, 0xcf, 0x2f, 0x4f, 0x06, 0x3d, 0x62, 0xfe, 0x4c, 0xb0, 0x4e, 0x18, 0xcd, 0xc4, 0x0c, 0x57,
+	0x92, 0x95, 0xd5, 0x85, 0xca, 0x90, 0xfa, 0xe1, 0x94, 0xe1, 0x4d, 0x28, 0x7f, 0xa5, 0xd3, 0x39,
+	0x6b, 0xa2, 0x16, 0x6a, 0x23, 0x92, 0x2c, 0xf0, 0x13, 0xd0, 0x85, 0xe7, 0x33, 0x2e, 0xa8, 0x1f,
+	0x3a, 0x3e, 0x6f, 0x16, 0x5b, 0xa8, 0x5d, 0x22, 0xda, 0x72, 0xd6, 0xe3, 0xd6, 0x1b, 0xa8, 0x1d,
+	0xd3, 0x0b, 0x36, 0x3d, 0xa1, 0x5e, 0x84, 0x31, 0xac, 0x05, 0xd4, 0x4f, 0x44, 0x6a, 0x44, 0x7e,
+	0xaf, 0x94, 0x8b, 0x72, 0x98, 0x2c, 0x2c, 0x0a, 0x30, 0xf2, 0x7c, 0x36, 0x64, 0x91, 0xc7, 0x38,
+	0x7e, 0x06, 0x95, 0x69, 0x2c, 0xc2, 0x9b, 0xa8, 0x55, 0x6a, 0x6b, 0x7b, 0x0f, 0x3b, 0xa9, 0xdd,
+	0xa5, 0x34, 0x49, 0x09, 0xb8, 0x0d, 0x55, 0x2e, 0x2d, 0xc7, 0x6e, 0x62, 0x6e, 0x43, 0x71, 0x93,
+	0x9b, 0x10, 0x05, 0x5b, 0xfb, 0xa0, 0x9f, 0x47, 0x9e, 0x60, 0x84, 0x5d, 0xcd, 0x19, 0x17, 0x78,
+	0x0f, 0x40, 0x1a, 0x97, 0x47, 0xa6, 0x07, 0x61, 0xb5, 0x79, 0x65, 0x86, 0x64, 0x58, 0xd6, 0x4f,
+	0x04, 0x1a, 0x61, 0xd4, 0x55, 0x1a, 0x4f, 0xa1, 0x7a, 0x35, 0xcf, 0x0a, 0xd4, 0x95, 0xc0, 0xe9,
+	0x9c, 0x45, 0x0b, 0xa2, 0x50, 0x3c, 0x86, 0x6d, 0x3a, 0x99, 0xb0, 0x50, 0x30, 0xd7, 0x89, 0x18,
+	0x0f, 0x67, 0x01, 0x67, 0x8e, 0x58, 0x84, 0xa9, 0xed, 0xc6, 0x5e, 0x4b, 0x6d, 0xcc, 0xc8, 0x77,
+	0x48, 0xca, 0x1c, 0x2d, 0x42, 0x46, 0xb6, 0x94, 0x40, 0x76, 0xca, 0xad, 0xd7, 0xa0, 0x67, 0x07,
+	0x58, 0x83, 0xea, 0xb0, 0xdb, 0x3b, 0x39, 0xb6, 0x87, 0x46, 0x01, 0x6f, 0xc3, 0xc6, 0x70, 0x44,
+	0xec, 0x6e, 0xcf, 0x7e, 0xef, 0x8c, 0x07, 0xc4, 0x39, 0x38, 0x3c, 0xeb, 0x1f, 0x0d, 0x0d, 0x64,
+	0xbd, 0x03, 0x3d, 0x39, 0x28, 0xd9, 0x89, 0x5f, 0x40, 0x35, 0x62, 0x7c, 0x3e, 0x15, 0xea, 0x22,
+	0x1b, 0xf9, 0x8b, 0x48, 0x8c, 0x28, 0x8e, 0xf5, 0x1d, 0x41, 0x59, 0x02, 0xf8, 0x39, 0x60, 0x2e,
+	0x68, 0x24, 0x9c, 0x5c, 0x31, 0x90, 0x2c, 0x86, 0x21, 0x91, 0xd1, 0xaa, 0x1d, 0xb8, 0x0d, 0x06,
+	0x0b, 0x5c, 0xe7, 0x9e, 0x12, 0x35, 0x58, 0xe0, 0x66, 0x99, 0x2f, 0x61, 0xdd, 0xa7, 0x62, 0x72,
+	0xc9, 0x22, 0xde, 0x2c, 0x49, 0x47, 0x9b, 0xb9, 0x12, 0xf4, 0x12, 0x90, 0x2c, 0x59, 0x96, 0x03,
+	0x7a, 0x16, 0xc1, 0x3b, 0xb0, 0x16, 0x07, 0x2c, 0xbd, 0x34, 0x56, 0x15, 0x92, 0xb0, 0x0c, 0x54,
+	0xc2, 0xcb, 0x8e, 0x16, 0xef, 0xeb, 0x68, 0x29, 0xdb, 0xd1, 0x2e, 0x68, 0x99, 0x30, 0xfe, 0xab,
+	0x3f, 0x02, 0x36, 0x0e, 0x2e, 0xe7, 0xc1, 0x17, 0xe6, 0xe6, 0xd2, 0x7f, 0x0b, 0x8d, 0x49, 0x32,
+	0x76, 0x72, 0x72, 0x5b, 0x4a, 0x2e, 0xdd, 0x94, 0x2a, 0xd6, 0x27, 0xd9, 0x25, 0x7e, 0x0c, 0x5a,
+	0x5c, 0xb3, 0x85, 0xe3, 0x05, 0x2e, 0xbb, 0x4e, 0xf3, 0x04, 0x39, 0xfa, 0x18, 0x4f, 0xac, 0x1f,
+	0x08, 0xca, 0x52, 0x01, 0x9b, 0xa0, 0xf9, 0x5e, 0x20, 0xf3, 0x5f, 0xfd, 0xa6, 0x9a, 0xef, 0x05,
+	0xb1, 0xdf, 0x1e, 0x97, 0x38, 0xbd, 0x5e, 0xe2, 0xc5, 0x14, 0xa7, 0xd7, 0x29, 0xbe, 0x9b, 0x66,
+	0x5a, 0x92, 0x99, 0x3e, 0xca, 0xd9, 0xeb, 0xd8, 0xc1, 0x64, 0xe6, 0x7a, 0xc1, 0xe7, 0x55, 0xb0,
+	0x2e, 0x15, 0xb4, 0xb9, 0xd6, 0x42, 0x6d, 0x9d, 0xc8, 0x6f, 0xab, 0x05, 0xeb, 0x8a, 0x15, 0x17,
+	0xf5, 0xac, 0x7f, 0xd4, 0x1f, 0x9c, 0xf7, 0x8d, 0x02, 0xae, 0x42, 0x69, 0x3c, 0x20, 0x06, 0xb2,
+	0x28, 0xd4, 0x73, 0x97, 0xfd, 0x97, 0xb7, 0x60, 0x07, 0x2a, 0x32, 0x19, 0xf5, 0x14, 0xd4, 0x73,
+	0xfe, 0x48, 0x0a, 0xee, 0x7e, 0x82, 0xda, 0xb2, 0x04, 0xb8, 0x06, 0x65, 0xfb, 0xf4, 0xac, 0x7b,
+	0x6c, 0x14, 0x70, 0x1d, 0x6a, 0xfd, 0xc1, 0xc8, 0x49, 0x96, 0x08, 0x3f, 0x00, 0x8d, 0xd8, 0x1f,
+	0xec, 0xb1, 0xd3, 0xeb, 0x8e, 0x0e, 0x0e, 0x8d, 0x22, 0xc6, 0xd0, 0x48, 0x06, 0xfd, 0x41, 0x3a,
+	0x2b, 0xed, 0x37, 0x7f, 0xdd, 0x9a, 0xe8, 0xe6, 0xd6, 0x44, 0x7f, 0x6e, 0x4d, 0xf4, 0xed, 0xce,
+	0x2c, 0xdc, 0xdc, 0x99, 0x85, 0xdf, 0x77, 0x66, 0xe1, 0xa2, 0x22, 0x9f, 0xd6, 0x57, 0x7f, 0x07,
+	0x00, 0xf5, 0xcd, 0x3c, 0x6c, 0x6a, 0x05, 0x00, 0x00,
 }
 
 func (m *Sample) Marshal() (dAtA []byte, err error) {
@@ -736,6 +995,24 @@ func (m *ReadRequest) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if len(m.AcceptedResponseTypes) > 0 {
+		dAtA2 := make([]byte, len(m.AcceptedResponseTypes)*10)
+		var j1 int
+		for _, num := range m.AcceptedResponseTypes {
+			for num >= 1<<7 {
+				dAtA2[j1] = uint8(uint64(num)&0x7f | 0x80)
+				num >>= 7
+				j1++
+			}
+			dAtA2[j1] = uint8(num)
+			j1++
+		}
+		i -= j1
+		copy(dAtA[i:], dAtA2[:j1])
+		i = encodeVarintRemote(dAtA, i, uint64(j1))
+		i--
+		dAtA[i] = 0x12
+	}
 	if len(m.Queries) > 0 {
 		for iNdEx := len(m.Queries) - 1; iNdEx >= 0; iNdEx-- {
 			{
@@ -916,6 +1193,144 @@ func (m *QueryResult) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *ChunkedReadResponse) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *ChunkedReadResponse) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *ChunkedReadResponse) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.QueryIndex != 0 {
+		i = encodeVarintRemote(dAtA, i, uint64(m.QueryIndex))
+		i--
+		dAtA[i] = 0x10
+	}
+	if len(m.ChunkedSeries) > 0 {
+		for iNdEx := len(m.ChunkedSeries) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.ChunkedSeries[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintRemote(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0xa
+		}
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *Chunk) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *Chunk) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *Chunk) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if len(m.Data) > 0 {
+		i -= len(m.Data)
+		copy(dAtA[i:], m.Data)
+		i = encodeVarintRemote(dAtA, i, uint64(len(m.Data)))
+		i--
+		dAtA[i] = 0x22
+	}
+	if m.Type != 0 {
+		i = encodeVarintRemote(dAtA, i, uint64(m.Type))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.MaxTimeMs != 0 {
+		i = encodeVarintRemote(dAtA, i, uint64(m.MaxTimeMs))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.MinTimeMs != 0 {
+		i = encodeVarintRemote(dAtA, i, uint64(m.MinTimeMs))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
+func (m *ChunkedSeries) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *ChunkedSeries) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *ChunkedSeries) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if len(m.Chunks) > 0 {
+		for iNdEx := len(m.Chunks) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Chunks[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintRemote(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0x12
+		}
+	}
+	if len(m.Labels) > 0 {
+		for iNdEx := len(m.Labels) - 1; iNdEx >= 0; iNdEx-- {
+			{
+				size, err := m.Labels[iNdEx].MarshalToSizedBuffer(dAtA[:i])
+				if err != nil {
+					return 0, err
+				}
+				i -= size
+				i = encodeVarintRemote(dAtA, i, uint64(size))
+			}
+			i--
+			dAtA[i] = 0xa
+		}
+	}
+	return len(dAtA) - i, nil
+}
+
 func encodeVarintRemote(dAtA []byte, offset int, v uint64) int {
 	offset -= sovRemote(v)
 	base := offset
@@ -1007,6 +1422,13 @@ func (m *ReadRequest) Size() (n int) {
 			n += 1 + l + sovRemote(uint64(l))
 		}
 	}
+	if len(m.AcceptedResponseTypes) > 0 {
+		l = 0
+		for _, e := range m.AcceptedResponseTypes {
+			l += sovRemote(uint64(e))
+		}
+		n += 1 + sovRemote(uint64(l)) + l
+	}
 	return n
 }
 
@@ -1081,8 +1503,69 @@ func (m *QueryResult) Size() (n int) {
 	return n
 }
 
-func sovRemote(x uint64) (n int) {
-	return (math_bits.Len64(x|1) + 6) / 7
+func (m *ChunkedReadResponse) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if len(m.ChunkedSeries) > 0 {
+		for _, e := range m.ChunkedSeries {
+			l = e.Size()
+			n += 1 + l + sovRemote(uint64(l))
+		}
+	}
+	if m.QueryIndex != 0 {
+		n += 1 + sovRemote(uint64(m.QueryIndex))
+	}
+	return n
+}
+
+func (m *Chunk) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.MinTimeMs != 0 {
+		n += 1 + sovRemote(uint64(m.MinTimeMs))
+	}
+	if m.MaxTimeMs != 0 {
+		n += 1 + sovRemote(uint64(m.MaxTimeMs))
+	}
+	if m.Type != 0 {
+		n += 1 + sovRemote(uint64(m.Type))
+	}
+	l = len(m.Data)
+	if l > 0 {
+		n += 1 + l + sovRemote(uint64(l))
+	}
+	return n
+}
+
+func (m *ChunkedSeries) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if len(m.Labels) > 0 {
+		for _, e := range m.Labels {
+			l = e.Size()
+			n += 1 + l + sovRemote(uint64(l))
+		}
+	}
+	if len(m.Chunks) > 0 {
+		for _, e := range m.Chunks {
+			l = e.Size()
+			n += 1 + l + sovRemote(uint64(l))
+		}
+	}
+	return n
+}
+
+func sovRemote(x uint64) (n int) {
+	return (math_bits.Len64(x|1) + 6) / 7
 }
 func sozRemote(x uint64) (n int) {
 	return sovRemote(uint64((x << 1) ^ uint64((int64(x) >> 63))))
@@ -1546,6 +2029,75 @@ func (m *ReadRequest) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 2:
+			if wireType == 0 {
+				var v ReadRequest_ResponseType
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowRemote
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					v |= ReadRequest_ResponseType(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				m.AcceptedResponseTypes = append(m.AcceptedResponseTypes, v)
+			} else if wireType == 2 {
+				var packedLen int
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowRemote
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					packedLen |= int(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				if packedLen < 0 {
+					return ErrInvalidLengthRemote
+				}
+				postIndex := iNdEx + packedLen
+				if postIndex < 0 {
+					return ErrInvalidLengthRemote
+				}
+				if postIndex > l {
+					return io.ErrUnexpectedEOF
+				}
+				var elementCount int
+				if elementCount != 0 && len(m.AcceptedResponseTypes) == 0 {
+					m.AcceptedResponseTypes = make([]ReadRequest_ResponseType, 0, elementCount)
+				}
+				for iNdEx < postIndex {
+					var v ReadRequest_ResponseType
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowRemote
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						v |= ReadRequest_ResponseType(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					m.AcceptedResponseTypes = append(m.AcceptedResponseTypes, v)
+				}
+			} else {
+				return fmt.Errorf("proto: wrong wireType = %d for field AcceptedResponseTypes", wireType)
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipRemote(dAtA[iNdEx:])
@@ -1990,6 +2542,368 @@ func (m *QueryResult) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *ChunkedReadResponse) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowRemote
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: ChunkedReadResponse: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: ChunkedReadResponse: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ChunkedSeries", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthRemote
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthRemote
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ChunkedSeries = append(m.ChunkedSeries, &ChunkedSeries{})
+			if err := m.ChunkedSeries[len(m.ChunkedSeries)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field QueryIndex", wireType)
+			}
+			m.QueryIndex = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.QueryIndex |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipRemote(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthRemote
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *Chunk) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowRemote
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: Chunk: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: Chunk: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MinTimeMs", wireType)
+			}
+			m.MinTimeMs = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MinTimeMs |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxTimeMs", wireType)
+			}
+			m.MaxTimeMs = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MaxTimeMs |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Type", wireType)
+			}
+			m.Type = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Type |= Chunk_Encoding(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Data", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthRemote
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex < 0 {
+				return ErrInvalidLengthRemote
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Data = append(m.Data[:0], dAtA[iNdEx:postIndex]...)
+			if m.Data == nil {
+				m.Data = []byte{}
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipRemote(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthRemote
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+func (m *ChunkedSeries) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowRemote
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: ChunkedSeries: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: ChunkedSeries: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Labels", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthRemote
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthRemote
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Labels = append(m.Labels, &LabelPair{})
+			if err := m.Labels[len(m.Labels)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		case 2:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Chunks", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowRemote
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthRemote
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthRemote
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Chunks = append(m.Chunks, &Chunk{})
+			if err := m.Chunks[len(m.Chunks)-1].Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
+		default:
+			iNdEx = preIndex
+			skippy, err := skipRemote(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if (skippy < 0) || (iNdEx+skippy) < 0 {
+				return ErrInvalidLengthRemote
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipRemote(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
@@ -11,21 +11,27 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"mime"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/chengshiwen/influx-proxy/backend"
-	"github.com/chengshiwen/influx-proxy/service/prometheus"
-	"github.com/chengshiwen/influx-proxy/service/prometheus/remote"
+	"github.com/chengshiwen/influx-proxy/logging"
+	"github.com/chengshiwen/influx-proxy/prometheus"
+	"github.com/chengshiwen/influx-proxy/prometheus/remote"
+	"github.com/chengshiwen/influx-proxy/tracing"
 	"github.com/chengshiwen/influx-proxy/transfer"
 	"github.com/chengshiwen/influx-proxy/util"
 	"github.com/gogo/protobuf/proto"
 	"github.com/golang/snappy"
+	"github.com/influxdata/influxdb1-client/models"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
 )
 
 var (
@@ -47,7 +53,34 @@ func NewServeMux() *ServeMux {
 func (mux *ServeMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Influxdb-Version", backend.Version)
 	w.Header().Add("X-Influxdb-Build", "InfluxDB Proxy")
-	mux.ServeMux.ServeHTTP(w, r)
+	// the request id of the client is kept so that the logs can be correlated across services
+	id := r.Header.Get("X-Request-Id")
+	if id == "" {
+		id = logging.NewRequestID()
+	}
+	w.Header().Set("Request-Id", id)
+	w.Header().Set("X-Request-Id", id)
+	ctx, span := tracing.StartServer(r, r.URL.Path, tracing.RequestID(id))
+	sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+	mux.ServeMux.ServeHTTP(sw, r.WithContext(logging.WithRequestID(ctx, id)))
+	tracing.EndStatus(span, sw.status)
+}
+
+// statusWriter records the status code of the response for the span of the request
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Flush() {
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
 }
 
 type HttpService struct { // nolint:golint
@@ -59,6 +92,11 @@ type HttpService struct { // nolint:golint
 	writeTracing bool
 	queryTracing bool
 	pprofEnabled bool
+	promSchema   *prometheus.Schema
+	// promTenantHeader and promTenantLabel select the db and rp of prometheus remote writes as db or db/rp
+	promTenantHeader string
+	promTenantLabel  string
+	promTenantStrip  bool
 }
 
 func NewHttpService(cfg *backend.ProxyConfig) (hs *HttpService) { // nolint:golint
@@ -72,6 +110,15 @@ func NewHttpService(cfg *backend.ProxyConfig) (hs *HttpService) { // nolint:goli
 		writeTracing: cfg.WriteTracing,
 		queryTracing: cfg.QueryTracing,
 		pprofEnabled: cfg.PprofEnabled,
+		promSchema:   prometheus.NewSchema(cfg.PromWriteSchema, cfg.PromMeasureLabel, cfg.PromDropLabels),
+
+		promTenantHeader: cfg.PromTenantHeader,
+		promTenantLabel:  cfg.PromTenantLabel,
+		promTenantStrip:  cfg.PromTenantStrip,
+	}
+	// the collectors of the instance are registered to the registry of its proxy, so that services do not conflict
+	if err := ip.RegisterCollector(transfer.NewStatsCollector(hs.tx)); err != nil {
+		logging.L().Fatal("register transfer metrics error", zap.Error(err))
 	}
 	return
 }
@@ -82,7 +129,13 @@ func (hs *HttpService) Register(mux *ServeMux) {
 	mux.HandleFunc("/write", hs.HandlerWrite)
 	mux.HandleFunc("/api/v2/query", hs.HandlerQueryV2)
 	mux.HandleFunc("/api/v2/write", hs.HandlerWriteV2)
+	mux.HandleFunc("/api/v2/buckets", hs.HandlerBucketsV2)
+	mux.HandleFunc("/api/v2/orgs", hs.HandlerOrgsV2)
+	mux.HandleFunc("/api/v2/health", hs.HandlerHealthV2)
+	mux.HandleFunc("/api/v2/delete", hs.HandlerDeleteV2)
 	mux.HandleFunc("/health", hs.HandlerHealth)
+	mux.HandleFunc("/metrics", hs.HandlerMetrics)
+	mux.HandleFunc("/log/level", hs.HandlerLogLevel)
 	mux.HandleFunc("/replica", hs.HandlerReplica)
 	mux.HandleFunc("/encrypt", hs.HandlerEncrypt)
 	mux.HandleFunc("/decrypt", hs.HandlerDecrypt)
@@ -92,6 +145,8 @@ func (hs *HttpService) Register(mux *ServeMux) {
 	mux.HandleFunc("/cleanup", hs.HandlerCleanup)
 	mux.HandleFunc("/transfer/state", hs.HandlerTransferState)
 	mux.HandleFunc("/transfer/stats", hs.HandlerTransferStats)
+	mux.HandleFunc("/user/drift", hs.HandlerUserDrift)
+	mux.HandleFunc("/shadow/stats", hs.HandlerShadowStats)
 	mux.HandleFunc("/api/v1/prom/read", hs.HandlerPromRead)
 	mux.HandleFunc("/api/v1/prom/write", hs.HandlerPromWrite)
 	if hs.pprofEnabled {
@@ -113,13 +168,15 @@ func (hs *HttpService) HandlerQuery(w http.ResponseWriter, req *http.Request) {
 	q := req.FormValue("q")
 	body, err := hs.ip.Query(w, req)
 	if err != nil {
-		log.Printf("influxql query error: %s, query: %s, db: %s, client: %s", err, q, db, req.RemoteAddr)
+		hs.logger(req).Warn("influxql query error", zap.Error(err), logging.Query(q), logging.DB(db))
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
-	hs.WriteBody(w, body)
+	if body != nil {
+		hs.WriteBody(w, body)
+	}
 	if hs.queryTracing {
-		log.Printf("influxql query: %s, db: %s, client: %s", q, db, req.RemoteAddr)
+		hs.logger(req).Info("influxql query", logging.Query(q), logging.DB(db))
 	}
 }
 
@@ -167,12 +224,12 @@ func (hs *HttpService) HandlerQueryV2(w http.ResponseWriter, req *http.Request)
 	req.Body = ioutil.NopCloser(bytes.NewBuffer(rbody))
 	err = hs.ip.QueryFlux(w, req, qr)
 	if err != nil {
-		log.Printf("flux query error: %s, query: %s, spec: %s, client: %s", err, qr.Query, qr.Spec, req.RemoteAddr)
+		hs.logger(req).Warn("flux query error", zap.Error(err), logging.Query(qr.Query), zap.Any("spec", qr.Spec))
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
 	if hs.queryTracing {
-		log.Printf("flux query: %s, spec: %s, client: %s", qr.Query, qr.Spec, req.RemoteAddr)
+		hs.logger(req).Info("flux query", logging.Query(qr.Query), zap.Any("spec", qr.Spec))
 	}
 }
 
@@ -234,6 +291,143 @@ func (hs *HttpService) HandlerWriteV2(w http.ResponseWriter, req *http.Request)
 	hs.handlerWrite(db, rp, precision, w, req)
 }
 
+func (hs *HttpService) HandlerBucketsV2(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+
+	q := req.URL.Query()
+	offset, err := hs.formPaging(q.Get("offset"), 0)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, "invalid offset")
+		return
+	}
+	limit, err := hs.formPaging(q.Get("limit"), 20)
+	if err != nil || limit == 0 {
+		hs.WriteError(w, req, http.StatusBadRequest, "invalid limit")
+		return
+	}
+	var db, rp string
+	if name := q.Get("name"); name != "" {
+		if db, rp, err = hs.bucket2dbrp(name); err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	buckets, err := hs.ip.GetBuckets()
+	if err != nil {
+		hs.WriteError(w, req, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+
+	org := hs.org(q)
+	data := make([]map[string]interface{}, 0)
+	for _, b := range buckets {
+		name := b.Name()
+		if db != "" {
+			// a bucket named db is the default retention policy of the database
+			if b.Database != db || (rp != "" && b.RetentionPolicy != rp) || (rp == "" && !b.Default) {
+				continue
+			}
+			name = q.Get("name")
+		}
+		if id := q.Get("id"); id != "" && id != b.ID() {
+			continue
+		}
+		rules := make([]map[string]interface{}, 0, 1)
+		if b.Duration > 0 {
+			rules = append(rules, map[string]interface{}{"type": "expire", "everySeconds": int64(b.Duration.Seconds())})
+		}
+		data = append(data, map[string]interface{}{
+			"id":             b.ID(),
+			"orgID":          org["id"],
+			"type":           "user",
+			"name":           name,
+			"retentionRules": rules,
+			"links":          map[string]string{"self": "/api/v2/buckets/" + b.ID()},
+		})
+	}
+	if offset >= len(data) {
+		data = data[:0]
+	} else {
+		data = data[offset:]
+	}
+	if len(data) > limit {
+		data = data[:limit]
+	}
+	hs.Write(w, req, http.StatusOK, map[string]interface{}{"links": map[string]string{"self": "/api/v2/buckets"}, "buckets": data})
+}
+
+func (hs *HttpService) HandlerOrgsV2(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+	org := hs.org(req.URL.Query())
+	hs.Write(w, req, http.StatusOK, map[string]interface{}{"links": map[string]string{"self": "/api/v2/orgs"}, "orgs": []interface{}{org}})
+}
+
+func (hs *HttpService) HandlerHealthV2(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethod(w, req, "GET", "HEAD") {
+		return
+	}
+	status, message := "fail", "no circle is active"
+	checks := make([]map[string]string, len(hs.ip.Circles))
+	for i, c := range hs.ip.Circles {
+		checks[i] = map[string]string{"name": c.Name, "status": "fail"}
+		if c.IsActive() {
+			checks[i]["status"] = "pass"
+			status, message = "pass", "ready for queries and writes"
+		}
+	}
+	resp := map[string]interface{}{
+		"name":    "influx-proxy",
+		"message": message,
+		"status":  status,
+		"checks":  checks,
+		"version": backend.Version,
+		"commit":  backend.GitCommit,
+	}
+	code := http.StatusOK
+	if status == "fail" {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	pretty := req.URL.Query().Get("pretty") == "true"
+	w.Write(util.MarshalJSON(resp, pretty))
+}
+
+func (hs *HttpService) HandlerDeleteV2(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "POST") {
+		return
+	}
+
+	db, _, err := hs.bucket2dbrp(req.URL.Query().Get("bucket"))
+	if err != nil {
+		hs.WriteError(w, req, http.StatusNotFound, err.Error())
+		return
+	}
+	if hs.ip.IsForbiddenDB(db) {
+		hs.WriteError(w, req, http.StatusBadRequest, fmt.Sprintf("database forbidden: %s", db))
+		return
+	}
+	dr := &backend.DeleteRequest{}
+	if err = json.NewDecoder(req.Body).Decode(dr); err != nil {
+		hs.WriteError(w, req, http.StatusBadRequest, fmt.Sprintf("failed parsing request body as JSON: %s", err))
+		return
+	}
+	if err = hs.ip.Delete(req, db, dr); err != nil {
+		hs.logger(req).Warn("delete error", zap.Error(err), zap.String("bucket", req.URL.Query().Get("bucket")), zap.String("predicate", dr.Predicate))
+		status := http.StatusInternalServerError
+		if errors.Is(err, backend.ErrDeleteTimeRange) || errors.Is(err, backend.ErrDeletePredicate) {
+			status = http.StatusBadRequest
+		}
+		hs.WriteError(w, req, status, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (hs *HttpService) handlerWrite(db, rp, precision string, w http.ResponseWriter, req *http.Request) {
 	body := req.Body
 	if req.Header.Get("Content-Encoding") == "gzip" {
@@ -251,12 +445,12 @@ func (hs *HttpService) handlerWrite(db, rp, precision string, w http.ResponseWri
 		return
 	}
 
-	err = hs.ip.Write(p, db, rp, precision)
+	err = hs.ip.Write(req.Context(), p, db, rp, precision)
 	if err == nil {
 		w.WriteHeader(http.StatusNoContent)
 	}
 	if hs.writeTracing {
-		log.Printf("write line protocol, db: %s, rp: %s, precision: %s, data: %s, client: %s", db, rp, precision, p, req.RemoteAddr)
+		hs.logger(req).Info("write line protocol", logging.DB(db), logging.RP(rp), zap.String("precision", precision), zap.ByteString("data", p))
 	}
 }
 
@@ -276,6 +470,13 @@ func (hs *HttpService) HandlerHealth(w http.ResponseWriter, req *http.Request) {
 	hs.Write(w, req, http.StatusOK, resp)
 }
 
+func (hs *HttpService) HandlerMetrics(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+	promhttp.HandlerFor(hs.ip.Gatherer(), promhttp.HandlerOpts{}).ServeHTTP(w, req)
+}
+
 func (hs *HttpService) HandlerReplica(w http.ResponseWriter, req *http.Request) {
 	if !hs.checkMethodAndAuth(w, req, "GET") {
 		return
@@ -300,6 +501,41 @@ func (hs *HttpService) HandlerReplica(w http.ResponseWriter, req *http.Request)
 	}
 }
 
+func (hs *HttpService) HandlerUserDrift(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+	drifts, err := hs.ip.GetUserDrift()
+	if err != nil {
+		hs.WriteError(w, req, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	hs.Write(w, req, http.StatusOK, drifts)
+}
+
+func (hs *HttpService) HandlerShadowStats(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET") {
+		return
+	}
+	hs.Write(w, req, http.StatusOK, hs.ip.GetShadowReadStats())
+}
+
+func (hs *HttpService) HandlerLogLevel(w http.ResponseWriter, req *http.Request) {
+	if !hs.checkMethodAndAuth(w, req, "GET", "POST") {
+		return
+	}
+
+	if req.Method == "POST" {
+		level := req.FormValue("level")
+		if err := logging.SetLevel(level); err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			return
+		}
+		hs.logger(req).Info("log level changed to " + logging.GetLevel())
+	}
+	hs.Write(w, req, http.StatusOK, map[string]string{"level": logging.GetLevel()})
+}
+
 func (hs *HttpService) HandlerEncrypt(w http.ResponseWriter, req *http.Request) {
 	if !hs.checkMethod(w, req, "GET") {
 		return
@@ -585,35 +821,53 @@ func (hs *HttpService) HandlerPromRead(w http.ResponseWriter, req *http.Request)
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
-	if len(readReq.Queries) != 1 {
-		err = errors.New("prometheus read endpoint currently only supports one query at a time")
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
-		return
-	}
 
-	var metric string
-	q := readReq.Queries[0]
-	for _, m := range q.Matchers {
-		if m.Name == "__name__" {
-			metric = m.Value
+	if promResponseType(&readReq) == remote.ReadRequest_STREAMED_XOR_CHUNKS {
+		w.Header().Set("Content-Type", prometheus.StreamedContentType)
+		flusher, _ := w.(http.Flusher)
+		cw := prometheus.NewChunkedWriter(w, flusher)
+		if err = hs.ip.StreamProm(req, cw, db, &readReq, hs.promSchema); err != nil {
+			hs.logger(req).Warn("prometheus stream read error", zap.Error(err), zap.String("method", req.Method), logging.DB(db), zap.String("queries", fmt.Sprint(readReq.Queries)))
+			// the status has been sent with the first frame
+			if !cw.Written() {
+				hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			}
+			return
 		}
-	}
-	if metric == "" {
-		log.Printf("prometheus query: %v", q)
-		err = errors.New("prometheus metric not found")
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		if hs.queryTracing {
+			hs.logger(req).Info("prometheus stream read", zap.String("method", req.Method), logging.DB(db), zap.String("queries", fmt.Sprint(readReq.Queries)))
+		}
+		return
 	}
 
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(compressed))
-	err = hs.ip.ReadProm(w, req, db, metric)
+	readRsp, err := hs.ip.ReadProm(req, db, &readReq, hs.promSchema)
 	if err != nil {
-		log.Printf("prometheus read error: %s, query: %s %s %v, client: %s", err, req.Method, db, q, req.RemoteAddr)
+		hs.logger(req).Warn("prometheus read error", zap.Error(err), zap.String("method", req.Method), logging.DB(db), zap.String("queries", fmt.Sprint(readReq.Queries)))
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
+	data, err := proto.Marshal(readRsp)
+	if err != nil {
+		hs.WriteError(w, req, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Header().Set("Content-Encoding", "snappy")
+	w.WriteHeader(http.StatusOK)
+	w.Write(snappy.Encode(nil, data))
 	if hs.queryTracing {
-		log.Printf("prometheus read: %s %s %v, client: %s", req.Method, db, q, req.RemoteAddr)
+		hs.logger(req).Info("prometheus read", zap.String("method", req.Method), logging.DB(db), zap.String("queries", fmt.Sprint(readReq.Queries)))
+	}
+}
+
+// promResponseType returns the first accepted response type supported, the sampled response by default
+func promResponseType(readReq *remote.ReadRequest) remote.ReadRequest_ResponseType {
+	for _, t := range readReq.AcceptedResponseTypes {
+		if t == remote.ReadRequest_SAMPLES || t == remote.ReadRequest_STREAMED_XOR_CHUNKS {
+			return t
+		}
 	}
+	return remote.ReadRequest_SAMPLES
 }
 
 func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request) {
@@ -621,12 +875,19 @@ func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request
 		return
 	}
 
-	db, err := hs.queryDB(req, false)
-	if err != nil {
-		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+	// the target of the series without tenant label, from the tenant header or the db and rp parameters
+	db, rp := req.URL.Query().Get("db"), req.URL.Query().Get("rp")
+	var err error
+	if tenant := req.Header.Get(hs.promTenantHeader); hs.promTenantHeader != "" && tenant != "" {
+		if db, rp, err = hs.bucket2dbrp(tenant); err != nil {
+			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if db == "" && hs.promTenantLabel == "" {
+		hs.WriteError(w, req, http.StatusBadRequest, "database not found")
 		return
 	}
-	rp := req.URL.Query().Get("rp")
 
 	body := req.Body
 	var bs []byte
@@ -640,7 +901,7 @@ func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request
 	_, err = buf.ReadFrom(body)
 	if err != nil {
 		if hs.writeTracing {
-			log.Printf("prom write handler unable to read bytes from request body")
+			hs.logger(req).Warn("prom write handler unable to read bytes from request body", zap.Error(err))
 		}
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
@@ -649,7 +910,7 @@ func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request
 	reqBuf, err := snappy.Decode(nil, buf.Bytes())
 	if err != nil {
 		if hs.writeTracing {
-			log.Printf("prom write handler unable to snappy decode from request body, error: %s", err)
+			hs.logger(req).Warn("prom write handler unable to snappy decode from request body", zap.Error(err))
 		}
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
@@ -659,29 +920,69 @@ func (hs *HttpService) HandlerPromWrite(w http.ResponseWriter, req *http.Request
 	var writeReq remote.WriteRequest
 	if err = proto.Unmarshal(reqBuf, &writeReq); err != nil {
 		if hs.writeTracing {
-			log.Printf("prom write handler unable to unmarshal from snappy decoded bytes, error: %s", err)
+			hs.logger(req).Warn("prom write handler unable to unmarshal from snappy decoded bytes", zap.Error(err))
 		}
 		hs.WriteError(w, req, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	points, err := prometheus.WriteRequestToPoints(&writeReq)
-	if err != nil {
-		if hs.writeTracing {
-			log.Printf("prom write handler, error: %s", err)
+	// Split the series per tenant, then check and convert all targets before writing any of them,
+	// so that a rejected request writes nothing
+	type target struct {
+		db, rp string
+		req    *remote.WriteRequest
+		points []models.Point
+	}
+	tenants := prometheus.SplitWriteRequest(&writeReq, hs.promTenantLabel, hs.promTenantStrip)
+	names := make([]string, 0, len(tenants))
+	for tenant := range tenants {
+		names = append(names, tenant)
+	}
+	sort.Strings(names)
+	targets := make([]target, 0, len(names))
+	for _, tenant := range names {
+		t := target{db: db, rp: rp, req: tenants[tenant]}
+		if tenant != "" {
+			if t.db, t.rp, err = hs.bucket2dbrp(tenant); err != nil {
+				hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+				return
+			}
 		}
-		// Check if the error was from something other than dropping invalid values.
-		if _, ok := err.(prometheus.DroppedValuesError); !ok {
-			hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+		if t.db == "" {
+			hs.WriteError(w, req, http.StatusBadRequest, "database not found")
 			return
 		}
+		if hs.ip.IsForbiddenDB(t.db) {
+			hs.WriteError(w, req, http.StatusBadRequest, fmt.Sprintf("database forbidden: %s", t.db))
+			return
+		}
+		t.points, err = prometheus.WriteRequestToPoints(t.req, hs.promSchema)
+		if err != nil {
+			if hs.writeTracing {
+				hs.logger(req).Warn("prom write handler error", zap.Error(err))
+			}
+			// Check if the error was from something other than dropping invalid values.
+			if _, ok := err.(prometheus.DroppedValuesError); !ok {
+				hs.WriteError(w, req, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		targets = append(targets, t)
 	}
 
 	// Write points.
-	err = hs.ip.WritePoints(points, db, rp)
-	if err == nil {
-		w.WriteHeader(http.StatusNoContent)
+	var werr error
+	for _, t := range targets {
+		if err = hs.ip.WritePoints(req.Context(), t.points, t.db, t.rp); err != nil {
+			hs.logger(req).Warn("prom write points error", zap.Error(err), logging.DB(t.db), logging.RP(t.rp))
+			werr = err
+		}
+	}
+	if werr != nil {
+		hs.WriteError(w, req, http.StatusServiceUnavailable, werr.Error())
+		return
 	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (hs *HttpService) Write(w http.ResponseWriter, req *http.Request, status int, data interface{}) {
@@ -714,6 +1015,11 @@ func (hs *HttpService) WriteText(w http.ResponseWriter, status int, text string)
 	w.Write([]byte(text + "\n"))
 }
 
+// logger returns the logger with the request id and the client of req
+func (hs *HttpService) logger(req *http.Request) *zap.Logger {
+	return logging.FromContext(req.Context()).With(logging.Client(req.RemoteAddr))
+}
+
 func (hs *HttpService) checkMethodAndAuth(w http.ResponseWriter, req *http.Request, methods ...string) bool {
 	return hs.checkMethod(w, req, methods...) && hs.checkAuth(w, req)
 }
@@ -795,6 +1101,29 @@ func (hs *HttpService) bucket2dbrp(bucket string) (string, string, error) {
 	}
 }
 
+// org returns the organization requested by org or orgID, organizations are not distinguished by the proxy
+func (hs *HttpService) org(q url.Values) map[string]interface{} {
+	name, id := q.Get("org"), q.Get("orgID")
+	if name == "" {
+		name = backend.DefaultOrg
+	}
+	if id == "" {
+		id = backend.GenerateID(name)
+	}
+	return map[string]interface{}{"id": id, "name": name}
+}
+
+func (hs *HttpService) formPaging(str string, dft int) (int, error) {
+	if str == "" {
+		return dft, nil
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid paging")
+	}
+	return n, nil
+}
+
 func (hs *HttpService) queryDB(req *http.Request, form bool) (string, error) {
 	var db string
 	if form {
@@ -0,0 +1,208 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+	ExporterFile   = "file"
+
+	ServiceName = "influx-proxy"
+)
+
+var ErrInvalidExporter = errors.New("invalid trace_exporter, require otlp, stdout or file")
+
+// passwordLiteral matches the string literal following the keyword password in influxql
+var passwordLiteral = regexp.MustCompile(`(?i)(\bpassword\b[^']*)'(?:[^'\\]|\\.)*'`)
+
+func init() {
+	// the w3c trace context is propagated even if no exporter is set, so that backends join the traces of the clients
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Init sets the global tracer provider exporting the spans sampled by ratio, an empty exporter disables the export,
+// endpoint is the otlp/http collector as host:port or url, file is the json file of the file exporter,
+// the returned shutdown flushes the pending spans
+func Init(exporter, endpoint, file string, ratio float64, version string) (shutdown func(context.Context) error, err error) {
+	var exp sdktrace.SpanExporter
+	var f *os.File
+	switch exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		exp, err = otlptracehttp.New(context.Background(), otlpOptions(endpoint)...)
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterFile:
+		f, err = os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return
+		}
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	default:
+		return nil, ErrInvalidExporter
+	}
+	if err != nil {
+		return
+	}
+	res := resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(ServiceName), semconv.ServiceVersionKey.String(version))
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+		if f != nil {
+			f.Close()
+		}
+		return err
+	}, nil
+}
+
+func otlpOptions(endpoint string) (opts []otlptracehttp.Option) {
+	if endpoint == "" {
+		// the endpoint is read from OTEL_EXPORTER_OTLP_ENDPOINT or defaults to localhost:4318
+		return
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint), otlptracehttp.WithInsecure()}
+	}
+	opts = append(opts, otlptracehttp.WithEndpoint(u.Host))
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+	return
+}
+
+// Start starts an internal span as a child of the span in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(ServiceName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartServer starts a server span of an incoming request as a child of the trace context in its headers
+func StartServer(req *http.Request, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+	attrs = append(attrs, semconv.HTTPMethodKey.String(req.Method), semconv.HTTPTargetKey.String(req.URL.Path), semconv.NetPeerIPKey.String(req.RemoteAddr))
+	return otel.Tracer(ServiceName).Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// End records err on span if any and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// EndStatus records the status code of a response on span and ends it, server errors mark the span as failed
+func EndStatus(span trace.Span, status int) {
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// RoundTripFunc sends a request, such as http.Client.Do or http.RoundTripper.RoundTrip
+type RoundTripFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip sends req by fn within a client span whose trace context is injected into the request headers,
+// the span ends when the response body is closed
+func RoundTrip(fn RoundTripFunc, req *http.Request, name string, attrs ...attribute.KeyValue) (*http.Response, error) {
+	attrs = append(attrs, semconv.HTTPMethodKey.String(req.Method))
+	ctx, span := otel.Tracer(ServiceName).Start(req.Context(), name, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	cr := req.WithContext(ctx)
+	// the headers may be shared with other requests of the client
+	cr.Header = req.Header.Clone()
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(cr.Header))
+	resp, err := fn(cr)
+	if err != nil {
+		End(span, err)
+		return resp, err
+	}
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	if resp.StatusCode >= 400 {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	resp.Body = &spanBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+type spanBody struct {
+	io.ReadCloser
+	span trace.Span
+	once sync.Once
+}
+
+func (b *spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.span.End() })
+	return err
+}
+
+// The attributes below keep the keys consistent with the fields of the logs
+
+func Backend(name string) attribute.KeyValue {
+	return attribute.String("backend", name)
+}
+
+func URL(u string) attribute.KeyValue {
+	return attribute.String("url", u)
+}
+
+func DB(db string) attribute.KeyValue {
+	return semconv.DBNameKey.String(db)
+}
+
+func RP(rp string) attribute.KeyValue {
+	return attribute.String("rp", rp)
+}
+
+func Measurement(meas string) attribute.KeyValue {
+	return attribute.String("measurement", meas)
+}
+
+func Circle(id int) attribute.KeyValue {
+	return attribute.Int("circle", id)
+}
+
+// Query returns the statement attribute of q whose password literals are redacted,
+// such as those of create user and set password
+func Query(q string) attribute.KeyValue {
+	return semconv.DBStatementKey.String(passwordLiteral.ReplaceAllString(q, "$1'[REDACTED]'"))
+}
+
+func RequestID(id string) attribute.KeyValue {
+	return attribute.String("request_id", id)
+}
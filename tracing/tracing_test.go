@@ -0,0 +1,78 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{"select value from cpu where host = 'a'", "select value from cpu where host = 'a'"},
+		{"CREATE USER admin WITH PASSWORD 'p@ss' WITH ALL PRIVILEGES", "CREATE USER admin WITH PASSWORD '[REDACTED]' WITH ALL PRIVILEGES"},
+		{`set password for "admin" = 'it\'s'`, `set password for "admin" = '[REDACTED]'`},
+		{"create user a with password 'x'; create user b with password 'y'", "create user a with password '[REDACTED]'; create user b with password '[REDACTED]'"},
+	}
+	for _, tt := range tests {
+		if got := Query(tt.q).Value.AsString(); got != tt.want {
+			t.Errorf("query %q: got %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestRoundTripTraceContext(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("Traceparent")
+		w.Write([]byte(`{"results":[{"statement_id":0}]}`))
+	}))
+	defer server.Close()
+
+	client := httptest.NewRequest("GET", "/query", nil)
+	client.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, span := StartServer(client, "/query")
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL+"/query", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := RoundTrip(http.DefaultClient.Do, req, "HttpBackend.Query", Backend("be1"), DB("db1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Header.Get("Traceparent") != "" {
+		t.Errorf("trace context injected into the headers of the original request")
+	}
+	if len(sr.Ended()) != 0 {
+		t.Errorf("client span ended before the response body is closed")
+	}
+	resp.Body.Close()
+	span.End()
+
+	spans := sr.Ended()
+	if len(spans) != 2 || spans[0].Name() != "HttpBackend.Query" {
+		t.Fatalf("spans wrong: %v", spans)
+	}
+	sc := spans[0].SpanContext()
+	if want := "00-" + sc.TraceID().String() + "-" + sc.SpanID().String() + "-01"; traceparent != want {
+		t.Errorf("traceparent: got %s, want %s", traceparent, want)
+	}
+	if sc.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || spans[0].Parent().SpanID() != spans[1].SpanContext().SpanID() {
+		t.Errorf("trace of the client not joined: %s", traceparent)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Shiwen Cheng. All rights reserved.
+// Use of this source code is governed by a MIT
+// license that can be found in the LICENSE file.
+
+package transfer
+
+import (
+	"sync/atomic"
+
+	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	transferringDesc = newTransferDesc("transferring", "Whether a transfer is running on the circle.", "circle")
+	statsDescs       = []*prometheus.Desc{
+		newTransferDesc("databases_total", "Databases to transfer from the backend.", "circle", "backend"),
+		newTransferDesc("databases_done", "Databases transferred from the backend.", "circle", "backend"),
+		newTransferDesc("measurements_total", "Measurements to transfer from the backend.", "circle", "backend"),
+		newTransferDesc("measurements_done", "Measurements transferred from the backend.", "circle", "backend"),
+		newTransferDesc("transferred_measurements", "Measurements moved from the backend.", "circle", "backend"),
+		newTransferDesc("inplace_measurements", "Measurements kept in place on the backend.", "circle", "backend"),
+	}
+)
+
+func newTransferDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(backend.MetricsNamespace, "transfer", name), help, labels, nil)
+}
+
+// StatsCollector exposes the progress of rebalance, recovery, resync and cleanup from the stats of the circles
+type StatsCollector struct {
+	tx *Transfer
+}
+
+func NewStatsCollector(tx *Transfer) *StatsCollector {
+	return &StatsCollector{tx: tx}
+}
+
+func (sc *StatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- transferringDesc
+	for _, desc := range statsDescs {
+		ch <- desc
+	}
+}
+
+func (sc *StatsCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, cs := range sc.tx.CircleStates {
+		var transferring float64
+		if cs.Transferring {
+			transferring = 1
+		}
+		ch <- prometheus.MustNewConstMetric(transferringDesc, prometheus.GaugeValue, transferring, cs.Name)
+		for _, be := range cs.Backends {
+			stats := cs.Stats[be.Url]
+			if stats == nil {
+				continue
+			}
+			values := []int32{
+				atomic.LoadInt32(&stats.DatabaseTotal),
+				atomic.LoadInt32(&stats.DatabaseDone),
+				atomic.LoadInt32(&stats.MeasurementTotal),
+				atomic.LoadInt32(&stats.MeasurementDone),
+				atomic.LoadInt32(&stats.TransferCount),
+				atomic.LoadInt32(&stats.InPlaceCount),
+			}
+			for i, desc := range statsDescs {
+				ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(values[i]), cs.Name, be.Name)
+			}
+		}
+	}
+}
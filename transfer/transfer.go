@@ -7,19 +7,21 @@ package transfer
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"net/http"
-	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/chengshiwen/influx-proxy/backend"
+	"github.com/chengshiwen/influx-proxy/logging"
 	"github.com/chengshiwen/influx-proxy/util"
 	"github.com/influxdata/influxdb1-client/models"
+	"github.com/influxdata/influxql"
 	"github.com/panjf2000/ants/v2"
+	"go.uber.org/zap"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
@@ -30,7 +32,6 @@ var (
 	DefaultWorker = 1
 	DefaultBatch  = 25000
 	DefaultLimit  = 1000000
-	tlog          = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds|log.Lshortfile)
 )
 
 type QueryResult struct {
@@ -46,6 +47,8 @@ type Transfer struct {
 
 	pool         *ants.Pool
 	tlogDir      string
+	tlog         atomic.Value // *zap.Logger of the current operation
+	tlogFile     *lumberjack.Logger
 	CircleStates []*CircleState
 	Worker       int
 	Batch        int
@@ -65,6 +68,7 @@ func NewTransfer(cfg *backend.ProxyConfig, circles []*backend.Circle) (tx *Trans
 	for idx, circfg := range cfg.Circles {
 		tx.CircleStates[idx] = NewCircleState(circfg, circles[idx])
 	}
+	tx.tlog.Store(logging.L())
 	return
 }
 
@@ -80,19 +84,28 @@ func (tx *Transfer) resetBasicParam() {
 	tx.Limit = DefaultLimit
 }
 
+// setLogOutput directs the logs of the operation to its own file under the tlog dir, with the level and format of the proxy
 func (tx *Transfer) setLogOutput(name string) {
-	logPath := filepath.Join(tx.tlogDir, name)
-	if logPath == "" {
-		tlog.SetOutput(os.Stdout)
-	} else {
-		util.MakeDir(tx.tlogDir)
-		tlog.SetOutput(&lumberjack.Logger{
-			Filename:   logPath,
-			MaxSize:    100,
-			MaxBackups: 5,
-			MaxAge:     7,
-		})
+	if tx.tlogFile != nil {
+		tx.tlogFile.Close()
+		tx.tlogFile = nil
+	}
+	if tx.tlogDir == "" {
+		tx.tlog.Store(logging.L())
+		return
+	}
+	util.MakeDir(tx.tlogDir)
+	tx.tlogFile = &lumberjack.Logger{
+		Filename:   filepath.Join(tx.tlogDir, name),
+		MaxSize:    100,
+		MaxBackups: 5,
+		MaxAge:     7,
 	}
+	tx.tlog.Store(logging.New(tx.tlogFile).With(zap.String("operation", strings.TrimSuffix(name, ".log"))))
+}
+
+func (tx *Transfer) logger() *zap.Logger {
+	return tx.tlog.Load().(*zap.Logger)
 }
 
 func (tx *Transfer) getRetentionPolicies(db string) []string {
@@ -138,7 +151,12 @@ func (tx *Transfer) createDatabases(dbs []string) ([]string, error) {
 	if len(dbs) > 0 {
 		backends := make([]*backend.Backend, 0)
 		for _, cs := range tx.CircleStates {
-			backends = append(backends, cs.Backends...)
+			for _, be := range cs.Backends {
+				// the buckets of v2 backends are managed on the backends
+				if !be.IsV2() {
+					backends = append(backends, be)
+				}
+			}
 		}
 		// create database
 		for _, db := range dbs {
@@ -146,23 +164,23 @@ func (tx *Transfer) createDatabases(dbs []string) ([]string, error) {
 			req := backend.NewQueryRequest("POST", "", q, "")
 			_, _, err := backend.QueryInParallel(backends, req, nil, false)
 			if err != nil {
-				tlog.Printf("create databases error: %s, db: %s, dbs: %v", err, db, dbs)
+				tx.logger().Error("create databases error", zap.Error(err), logging.DB(db), zap.Strings("dbs", dbs))
 				return dbs, err
 			}
 			// create retention policy
 			rps := tx.getRetentionPolicies(db)
-			tlog.Printf("create retention policy, db: %s, rps: %v", db, rps)
+			tx.logger().Info("create retention policy", logging.DB(db), zap.Strings("rps", rps))
 			for _, rp := range rps {
 				q = fmt.Sprintf("create retention policy \"%s\" on \"%s\" duration 0s replication 1", util.EscapeIdentifier(rp), util.EscapeIdentifier(db))
 				req = backend.NewQueryRequest("POST", "", q, "")
 				_, _, err = backend.QueryInParallel(backends, req, nil, false)
 				if err != nil {
-					tlog.Printf("create retention policy error: %s, db: %s, rp: %s", err, db, rp)
+					tx.logger().Error("create retention policy error", zap.Error(err), logging.DB(db), logging.RP(rp))
 				}
 			}
 		}
 	} else {
-		tlog.Printf("databases are empty in all backends")
+		tx.logger().Info("databases are empty in all backends")
 	}
 	return dbs, nil
 }
@@ -199,8 +217,32 @@ func reformFieldKeys(fieldKeys map[string][]string) map[string]string {
 	return fieldMap
 }
 
-func (tx *Transfer) write(ch chan *QueryResult, dsts []*backend.Backend, db, rp, meas string, tagMap util.Set, fieldMap map[string]string) error {
-	var buf bytes.Buffer
+// seriesRoute returns the destination backends of a series given by its measurement and tags in line protocol
+type seriesRoute func(series string) []*backend.Backend
+
+// fixedRoute routes all series of a measurement to dsts
+func fixedRoute(dsts []*backend.Backend) seriesRoute {
+	return func(string) []*backend.Backend {
+		return dsts
+	}
+}
+
+// shardedRoute routes each series of a sharded measurement to the backend of every circle owning its series key,
+// except the source backend
+func shardedRoute(css []*CircleState, src *backend.Backend, key string) seriesRoute {
+	return func(series string) (dsts []*backend.Backend) {
+		skey := backend.GetSeriesKey(key, []byte(series))
+		for _, cs := range css {
+			if dst := cs.GetBackend(skey); dst.Url != src.Url {
+				dsts = append(dsts, dst)
+			}
+		}
+		return
+	}
+}
+
+func (tx *Transfer) write(ch chan *QueryResult, dsts []*backend.Backend, route seriesRoute, db, rp, meas string, tagMap util.Set, fieldMap map[string]string) error {
+	bufs := make(map[*backend.Backend]*bytes.Buffer)
 	var wg sync.WaitGroup
 	pool, err := ants.NewPool(len(dsts) * 20)
 	if err != nil {
@@ -239,11 +281,15 @@ func (tx *Transfer) write(ch chan *QueryResult, dsts []*backend.Backend, db, rp,
 			mtagStr := strings.Join(mtagSet, ",")
 			fieldStr := strings.Join(fieldSet, ",")
 			line := fmt.Sprintf("%s %s %v\n", mtagStr, fieldStr, value[0])
-			buf.WriteString(line)
+			for _, dst := range route(mtagStr) {
+				if bufs[dst] == nil {
+					bufs[dst] = &bytes.Buffer{}
+				}
+				bufs[dst].WriteString(line)
+			}
 			if (idx+1)%tx.Batch == 0 || idx+1 == valen {
-				p := buf.Bytes()
-				for _, dst := range dsts {
-					dst := dst
+				for dst, buf := range bufs {
+					dst, p := dst, buf.Bytes()
 					wg.Add(1)
 					pool.Submit(func() {
 						defer wg.Done()
@@ -251,7 +297,7 @@ func (tx *Transfer) write(ch chan *QueryResult, dsts []*backend.Backend, db, rp,
 						for i := 0; i <= RetryCount; i++ {
 							if i > 0 {
 								time.Sleep(time.Duration(RetryInterval) * time.Second)
-								tlog.Printf("transfer write retry: %d, err:%s dst:%s db:%s rp:%s meas:%s", i, err, dst.Url, db, rp, meas)
+								tx.logger().Warn("transfer write retry", zap.Int("retry", i), zap.Error(err), zap.String("dst", dst.Url), logging.DB(db), logging.RP(rp), logging.Measurement(meas))
 							}
 							err = dst.Write(db, rp, p)
 							if err == nil {
@@ -259,11 +305,11 @@ func (tx *Transfer) write(ch chan *QueryResult, dsts []*backend.Backend, db, rp,
 							}
 						}
 						if err != nil {
-							tlog.Printf("transfer write error: %s, dst:%s db:%s rp:%s meas:%s", err, dst.Url, db, rp, meas)
+							tx.logger().Error("transfer write error", zap.Error(err), zap.String("dst", dst.Url), logging.DB(db), logging.RP(rp), logging.Measurement(meas))
 						}
 					})
 				}
-				buf = bytes.Buffer{}
+				bufs = make(map[*backend.Backend]*bytes.Buffer)
 			}
 		}
 	}
@@ -284,7 +330,8 @@ func (tx *Transfer) query(ch chan *QueryResult, src *backend.Backend, db, rp, me
 		for i := 0; i <= RetryCount; i++ {
 			if i > 0 {
 				time.Sleep(time.Duration(RetryInterval) * time.Second)
-				tlog.Printf("transfer query retry: %d, err:%s src:%s db:%s rp:%s meas:%s tick:%d limit:%d offset:%d", i, err, src.Url, db, rp, meas, tick, tx.Limit, offset)
+				tx.logger().Warn("transfer query retry", zap.Int("retry", i), zap.Error(err), zap.String("src", src.Url), logging.DB(db), logging.RP(rp), logging.Measurement(meas),
+					zap.Int64("tick", tick), zap.Int("limit", tx.Limit), zap.Int("offset", offset))
 			}
 			rsp, err = src.QueryIQL("GET", db, q, "ns")
 			if err == nil {
@@ -307,7 +354,7 @@ func (tx *Transfer) query(ch chan *QueryResult, src *backend.Backend, db, rp, me
 	}
 }
 
-func (tx *Transfer) transfer(src *backend.Backend, dsts []*backend.Backend, db, rp, meas string, tick int64) error {
+func (tx *Transfer) transfer(src *backend.Backend, dsts []*backend.Backend, route seriesRoute, db, rp, meas string, tick int64) error {
 	ch := make(chan *QueryResult, 4)
 	go tx.query(ch, src, db, rp, meas, tick)
 
@@ -327,21 +374,26 @@ func (tx *Transfer) transfer(src *backend.Backend, dsts []*backend.Backend, db,
 		fieldMap = reformFieldKeys(fieldKeys)
 	}()
 	wg.Wait()
-	return tx.write(ch, dsts, db, rp, meas, tagMap, fieldMap)
+	return tx.write(ch, dsts, route, db, rp, meas, tagMap, fieldMap)
 }
 
-func (tx *Transfer) submitTransfer(cs *CircleState, src *backend.Backend, dsts []*backend.Backend, db, meas string, tick int64) {
+// submitTransfer transfers the series of a measurement from src to the backends of dsts chosen by route,
+// a nil route transfers all series to all dsts
+func (tx *Transfer) submitTransfer(cs *CircleState, src *backend.Backend, dsts []*backend.Backend, route seriesRoute, db, meas string, tick int64) {
+	if route == nil {
+		route = fixedRoute(dsts)
+	}
 	rps := src.GetRetentionPolicies(db)
 	for _, rp := range rps {
 		rp := rp
 		cs.wg.Add(1)
 		tx.pool.Submit(func() {
 			defer cs.wg.Done()
-			err := tx.transfer(src, dsts, db, rp, meas, tick)
+			err := tx.transfer(src, dsts, route, db, rp, meas, tick)
 			if err == nil {
-				tlog.Printf("transfer done, src:%s dst:%v db:%s rp:%s meas:%s tick:%d", src.Url, getBackendUrls(dsts), db, rp, meas, tick)
+				tx.logger().Info("transfer done", zap.String("src", src.Url), zap.Strings("dst", getBackendUrls(dsts)), logging.DB(db), logging.RP(rp), logging.Measurement(meas), zap.Int64("tick", tick))
 			} else {
-				tlog.Printf("transfer error: %s, src:%s dst:%v db:%s rp:%s meas:%s tick:%d", err, src.Url, getBackendUrls(dsts), db, rp, meas, tick)
+				tx.logger().Error("transfer error", zap.Error(err), zap.String("src", src.Url), zap.Strings("dst", getBackendUrls(dsts)), logging.DB(db), logging.RP(rp), logging.Measurement(meas), zap.Int64("tick", tick))
 			}
 		})
 	}
@@ -353,9 +405,56 @@ func (tx *Transfer) submitCleanup(cs *CircleState, be *backend.Backend, db, meas
 		defer cs.wg.Done()
 		_, err := be.DropMeasurement(db, meas)
 		if err == nil {
-			tlog.Printf("cleanup done, backend:%s db:%s meas:%s", be.Url, db, meas)
+			tx.logger().Info("cleanup done", logging.Backend(be.Name), logging.URL(be.Url), logging.DB(db), logging.Measurement(meas))
+		} else {
+			tx.logger().Error("cleanup error", zap.Error(err), logging.Backend(be.Name), logging.URL(be.Url), logging.DB(db), logging.Measurement(meas))
+		}
+	})
+}
+
+// submitCleanupSeries drops the series of a sharded measurement whose series keys are not owned by be
+func (tx *Transfer) submitCleanupSeries(cs *CircleState, be *backend.Backend, db, meas string) {
+	cs.wg.Add(1)
+	tx.pool.Submit(func() {
+		defer cs.wg.Done()
+		key := backend.GetKey(db, meas)
+		keySet := util.NewSet()
+		for _, rp := range be.GetRetentionPolicies(db) {
+			for _, series := range be.GetSeriesValues(db, fmt.Sprintf("show series from \"%s\".\"%s\"", util.EscapeIdentifier(rp), util.EscapeIdentifier(meas))) {
+				keySet.Add(series)
+			}
+		}
+		// a series is matched exactly by its tags and the empty values of the other tag keys of the measurement
+		var drops []models.Tags
+		tagKeys := util.NewSet()
+		for series := range keySet {
+			_, tags := models.ParseKey([]byte(series))
+			for _, tag := range tags {
+				tagKeys.Add(string(tag.Key))
+			}
+			if cs.GetBackend(backend.GetSeriesKey(key, []byte(series))).Url != be.Url {
+				drops = append(drops, tags)
+			}
+		}
+		var err error
+		for _, tags := range drops {
+			conds := make([]string, 0, len(tagKeys))
+			for tk := range tagKeys {
+				conds = append(conds, fmt.Sprintf("%s = %s", influxql.QuoteIdent(tk), influxql.QuoteString(tags.GetString(tk))))
+			}
+			sort.Strings(conds)
+			q := fmt.Sprintf("drop series from \"%s\"", util.EscapeIdentifier(meas))
+			if len(conds) > 0 {
+				q += " where " + strings.Join(conds, " and ")
+			}
+			if _, err = be.QueryIQL("POST", db, q, ""); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			tx.logger().Info("cleanup series done", logging.Backend(be.Name), logging.URL(be.Url), logging.DB(db), logging.Measurement(meas), zap.Int("series", len(drops)))
 		} else {
-			tlog.Printf("cleanup error: %s, backend:%s db:%s meas:%s", err, be.Url, db, meas)
+			tx.logger().Error("cleanup series error", zap.Error(err), logging.Backend(be.Name), logging.URL(be.Url), logging.DB(db), logging.Measurement(meas))
 		}
 	})
 }
@@ -363,7 +462,7 @@ func (tx *Transfer) submitCleanup(cs *CircleState, be *backend.Backend, db, meas
 func (tx *Transfer) runTransfer(cs *CircleState, be *backend.Backend, dbs []string, fn func(*CircleState, *backend.Backend, string, string, []interface{}) bool, args ...interface{}) {
 	defer cs.wg.Done()
 	if !be.IsActive() {
-		tlog.Printf("backend unavailable: %s", be.Url)
+		tx.logger().Warn("backend unavailable", logging.Backend(be.Name), logging.URL(be.Url))
 		return
 	}
 
@@ -405,11 +504,11 @@ func (tx *Transfer) Rebalance(circleId int, backends []*backend.Backend, dbs []s
 	}
 	tx.pool, err = ants.NewPool(tx.Worker)
 	if err != nil {
-		tlog.Printf("new pool error: %s", err)
+		tx.logger().Error("new pool error", zap.Error(err))
 		return
 	}
 	defer tx.pool.Release()
-	tlog.Printf("rebalance start: circle %d", circleId)
+	tx.logger().Info("rebalance start", logging.Circle(circleId))
 	cs := tx.CircleStates[circleId]
 	tx.resetCircleStates()
 	tx.broadcastTransferring(cs, true)
@@ -420,16 +519,105 @@ func (tx *Transfer) Rebalance(circleId int, backends []*backend.Backend, dbs []s
 		go tx.runTransfer(cs, be, dbs, tx.runRebalance)
 	}
 	cs.wg.Wait()
+	tx.rehomeContinuousQueries(cs, backends)
 	tx.resetBasicParam()
-	tlog.Printf("rebalance done: circle %d", circleId)
+	tx.logger().Info("rebalance done", logging.Circle(circleId))
+}
+
+// rehomeContinuousQueries moves continuous queries to the backends owning their source measurements,
+// v2 backends have no continuous queries and are skipped
+func (tx *Transfer) rehomeContinuousQueries(cs *CircleState, backends []*backend.Backend) {
+	installed := make(map[string]util.Set)
+	cqsMap := make(map[string][]*backend.ContinuousQuery)
+	for _, be := range backends {
+		if be.IsV2() {
+			continue
+		}
+		if !be.IsActive() {
+			tx.logger().Warn("backend inactive and continuous queries skipped", logging.Backend(be.Name), logging.URL(be.Url))
+			continue
+		}
+		cqs, err := be.GetContinuousQueries()
+		if err != nil {
+			tx.logger().Error("show continuous queries error", zap.Error(err), logging.Backend(be.Name), logging.URL(be.Url))
+			continue
+		}
+		cqsMap[be.Url] = cqs
+		installed[be.Url] = util.NewSet()
+		for _, cq := range cqs {
+			installed[be.Url].Add(cq.Database + "." + cq.Name)
+		}
+	}
+	for _, be := range backends {
+		for _, cq := range cqsMap[be.Url] {
+			stmt, err := backend.ParseContinuousQuery(cq.Query)
+			if err != nil {
+				tx.logger().Error("continuous query parse error", zap.Error(err), logging.Backend(be.Name), logging.URL(be.Url), logging.DB(cq.Database), zap.String("cq", cq.Name))
+				continue
+			}
+			owners, warnings := cs.GetContinuousQueryOwners(stmt)
+			for _, warning := range warnings {
+				tx.logger().Warn(warning, logging.Backend(be.Name), logging.URL(be.Url), logging.DB(cq.Database), zap.String("cq", cq.Name))
+			}
+			keep, failed := false, false
+			id := cq.Database + "." + cq.Name
+			for _, owner := range owners {
+				if owner.Url == be.Url {
+					keep = true
+					continue
+				}
+				if installed[owner.Url] == nil {
+					tx.logger().Warn("continuous query unavailable to install", logging.Backend(owner.Name), logging.URL(owner.Url), logging.DB(cq.Database), zap.String("cq", cq.Name))
+					failed = true
+					continue
+				}
+				if installed[owner.Url][id] {
+					continue
+				}
+				if err = owner.CreateContinuousQuery(cq.Query); err != nil {
+					tx.logger().Error("continuous query create error", zap.Error(err), logging.Backend(owner.Name), logging.URL(owner.Url), logging.DB(cq.Database), zap.String("cq", cq.Name))
+					failed = true
+					continue
+				}
+				installed[owner.Url].Add(id)
+				tx.logger().Info("continuous query created", logging.Backend(owner.Name), logging.URL(owner.Url), logging.DB(cq.Database), zap.String("cq", cq.Name))
+			}
+			if keep || failed {
+				continue
+			}
+			if err = be.DropContinuousQuery(cq.Database, cq.Name); err != nil {
+				tx.logger().Error("continuous query drop error", zap.Error(err), logging.Backend(be.Name), logging.URL(be.Url), logging.DB(cq.Database), zap.String("cq", cq.Name))
+				continue
+			}
+			tx.logger().Info("continuous query dropped", logging.Backend(be.Name), logging.URL(be.Url), logging.DB(cq.Database), zap.String("cq", cq.Name))
+		}
+	}
 }
 
 func (tx *Transfer) runRebalance(cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
 	key := backend.GetKey(db, meas)
+	if backend.IsShardedKey(key) {
+		// the series of a sharded measurement are spread over all backends of the circle
+		dsts := otherBackends(cs.Backends, be)
+		require = len(dsts) > 0
+		if require {
+			tx.submitTransfer(cs, be, dsts, shardedRoute([]*CircleState{cs}, be, key), db, meas, 0)
+		}
+		return
+	}
 	dst := cs.GetBackend(key)
 	require = dst.Url != be.Url
 	if require {
-		tx.submitTransfer(cs, be, []*backend.Backend{dst}, db, meas, 0)
+		tx.submitTransfer(cs, be, []*backend.Backend{dst}, nil, db, meas, 0)
+	}
+	return
+}
+
+func otherBackends(backends []*backend.Backend, be *backend.Backend) (others []*backend.Backend) {
+	for _, b := range backends {
+		if b.Url != be.Url {
+			others = append(others, b)
+		}
 	}
 	return
 }
@@ -442,11 +630,11 @@ func (tx *Transfer) Recovery(fromCircleId, toCircleId int, backendUrls []string,
 	}
 	tx.pool, err = ants.NewPool(tx.Worker)
 	if err != nil {
-		tlog.Printf("new pool error: %s", err)
+		tx.logger().Error("new pool error", zap.Error(err))
 		return
 	}
 	defer tx.pool.Release()
-	tlog.Printf("recovery start: circle from %d to %d", fromCircleId, toCircleId)
+	tx.logger().Info("recovery start", zap.Int("from_circle", fromCircleId), zap.Int("to_circle", toCircleId))
 	fcs := tx.CircleStates[fromCircleId]
 	tcs := tx.CircleStates[toCircleId]
 	tx.resetCircleStates()
@@ -469,17 +657,37 @@ func (tx *Transfer) Recovery(fromCircleId, toCircleId int, backendUrls []string,
 	}
 	fcs.wg.Wait()
 	tx.resetBasicParam()
-	tlog.Printf("recovery done: circle from %d to %d", fromCircleId, toCircleId)
+	tx.logger().Info("recovery done", zap.Int("from_circle", fromCircleId), zap.Int("to_circle", toCircleId))
 }
 
 func (tx *Transfer) runRecovery(fcs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
 	tcs := args[0].(*CircleState)
 	backendUrlSet := args[1].(util.Set) // nolint:golint
 	key := backend.GetKey(db, meas)
+	if backend.IsShardedKey(key) {
+		var dsts []*backend.Backend
+		for _, dst := range tcs.Backends {
+			if backendUrlSet[dst.Url] {
+				dsts = append(dsts, dst)
+			}
+		}
+		require = len(dsts) > 0
+		if require {
+			route := shardedRoute([]*CircleState{tcs}, be, key)
+			tx.submitTransfer(fcs, be, dsts, func(series string) []*backend.Backend {
+				// only the series owned by the backends to recover are transferred
+				if dsts := route(series); len(dsts) == 1 && backendUrlSet[dsts[0].Url] {
+					return dsts
+				}
+				return nil
+			}, db, meas, 0)
+		}
+		return
+	}
 	dst := tcs.GetBackend(key)
 	require = backendUrlSet[dst.Url]
 	if require {
-		tx.submitTransfer(fcs, be, []*backend.Backend{dst}, db, meas, 0)
+		tx.submitTransfer(fcs, be, []*backend.Backend{dst}, nil, db, meas, 0)
 	}
 	return
 }
@@ -492,31 +700,46 @@ func (tx *Transfer) Resync(dbs []string, tick int64) {
 	}
 	tx.pool, err = ants.NewPool(tx.Worker)
 	if err != nil {
-		tlog.Printf("new pool error: %s", err)
+		tx.logger().Error("new pool error", zap.Error(err))
 		return
 	}
 	defer tx.pool.Release()
-	tlog.Printf("resync start")
+	tx.logger().Info("resync start")
 	tx.resetCircleStates()
 	tx.broadcastResyncing(true)
 	defer tx.broadcastResyncing(false)
 
 	for _, cs := range tx.CircleStates {
-		tlog.Printf("resync start: circle %d", cs.CircleId)
+		tx.logger().Info("resync start", logging.Circle(cs.CircleId))
 		for _, be := range cs.Backends {
 			cs.wg.Add(1)
 			go tx.runTransfer(cs, be, dbs, tx.runResync, tick)
 		}
 		cs.wg.Wait()
-		tlog.Printf("resync done: circle %d", cs.CircleId)
+		tx.logger().Info("resync done", logging.Circle(cs.CircleId))
 	}
 	tx.resetBasicParam()
-	tlog.Printf("resync done")
+	tx.logger().Info("resync done")
 }
 
 func (tx *Transfer) runResync(cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
 	tick := args[0].(int64)
 	key := backend.GetKey(db, meas)
+	if backend.IsShardedKey(key) {
+		var dsts []*backend.Backend
+		var tcss []*CircleState
+		for _, tcs := range tx.CircleStates {
+			if tcs.CircleId != cs.CircleId {
+				dsts = append(dsts, tcs.Backends...)
+				tcss = append(tcss, tcs)
+			}
+		}
+		require = len(tcss) > 0
+		if require {
+			tx.submitTransfer(cs, be, dsts, shardedRoute(tcss, be, key), db, meas, tick)
+		}
+		return
+	}
 	dsts := make([]*backend.Backend, 0)
 	for _, tcs := range tx.CircleStates {
 		if tcs.CircleId != cs.CircleId {
@@ -526,7 +749,7 @@ func (tx *Transfer) runResync(cs *CircleState, be *backend.Backend, db string, m
 	}
 	require = len(dsts) > 0
 	if require {
-		tx.submitTransfer(cs, be, dsts, db, meas, tick)
+		tx.submitTransfer(cs, be, dsts, nil, db, meas, tick)
 	}
 	return
 }
@@ -536,11 +759,11 @@ func (tx *Transfer) Cleanup(circleId int) { // nolint:golint
 	var err error
 	tx.pool, err = ants.NewPool(tx.Worker)
 	if err != nil {
-		tlog.Printf("new pool error: %s", err)
+		tx.logger().Error("new pool error", zap.Error(err))
 		return
 	}
 	defer tx.pool.Release()
-	tlog.Printf("cleanup start: circle %d", circleId)
+	tx.logger().Info("cleanup start", logging.Circle(circleId))
 	cs := tx.CircleStates[circleId]
 	tx.resetCircleStates()
 	tx.broadcastTransferring(cs, true)
@@ -555,18 +778,23 @@ func (tx *Transfer) Cleanup(circleId int) { // nolint:golint
 	}
 	cs.wg.Wait()
 	tx.resetBasicParam()
-	tlog.Printf("cleanup done: circle %d", circleId)
+	tx.logger().Info("cleanup done", logging.Circle(circleId))
 }
 
 func (tx *Transfer) runCleanup(cs *CircleState, be *backend.Backend, db string, meas string, args []interface{}) (require bool) {
 	key := backend.GetKey(db, meas)
+	if backend.IsShardedKey(key) {
+		tx.logger().Info("sharded measurement require to cleanup series", logging.Backend(be.Name), logging.URL(be.Url), logging.DB(db), logging.Measurement(meas))
+		tx.submitCleanupSeries(cs, be, db, meas)
+		return true
+	}
 	dst := cs.GetBackend(key)
 	require = dst.Url != be.Url
 	if require {
-		tlog.Printf("backend:%s db:%s meas:%s require to cleanup", be.Url, db, meas)
+		tx.logger().Info("measurement require to cleanup", logging.Backend(be.Name), logging.URL(be.Url), logging.DB(db), logging.Measurement(meas))
 		tx.submitCleanup(cs, be, db, meas)
 	} else {
-		tlog.Printf("backend:%s db:%s meas:%s checked", be.Url, db, meas)
+		tx.logger().Info("measurement checked", logging.Backend(be.Name), logging.URL(be.Url), logging.DB(db), logging.Measurement(meas))
 	}
 	return
 }